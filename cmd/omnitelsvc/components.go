@@ -36,6 +36,7 @@ import (
 	"github.com/Omnition/omnition-opentelemetry-service/receiver/opencensusreceiver"
 )
 
+// components returns the factories of the components of the service.
 func components() (
 	map[string]receiver.Factory,
 	map[string]processor.Factory,
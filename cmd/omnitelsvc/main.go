@@ -34,5 +34,22 @@ func main() {
 
 	svc := service.New(receivers, processors, exporters)
 	err = svc.StartUnified()
+	// StartUnified returns once the service stopped its receivers and
+	// exporters. The service has no shutdown hook for the processors, so the
+	// factories that need it shut down the processors they created here,
+	// after the service returned.
+	for _, factory := range processors {
+		if f, ok := factory.(shutdownFactory); ok {
+			if shutdownErr := f.Shutdown(); shutdownErr != nil {
+				log.Printf("Failed to shut down %q processors: %v", factory.Type(), shutdownErr)
+			}
+		}
+	}
 	handleErr(err)
 }
+
+// shutdownFactory is implemented by the processor factories holding resources
+// for the processors they created.
+type shutdownFactory interface {
+	Shutdown() error
+}
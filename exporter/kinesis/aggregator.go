@@ -0,0 +1,157 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"crypto/md5"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awskinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/golang/protobuf/proto"
+)
+
+// aggregationMagic prefixes every aggregated record so that consumers using
+// the KCL (or any other KPL aware library) can de-aggregate it.
+var aggregationMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// Field tags of the KPL AggregatedRecord and Record protobuf messages.
+const (
+	tagPartitionKeyTable = 1<<3 | 2
+	tagRecords           = 3<<3 | 2
+	tagPartitionKeyIndex = 1<<3 | 0
+	tagData              = 3<<3 | 2
+
+	// aggregationOverhead is an upper bound of the bytes added to an
+	// aggregated record for each user record or partition key.
+	aggregationOverhead = 16
+)
+
+// record is a single user record waiting to be sent to Kinesis.
+type record struct {
+	data         []byte
+	partitionKey string
+	// items is the number of spans or metrics encoded in data.
+	items int
+	// done, if set, is called with the outcome of sending the record.
+	done func(error)
+}
+
+func (r *record) size() int {
+	return len(r.data) + len(r.partitionKey)
+}
+
+// aggregator packs multiple user records into a single Kinesis record using
+// the KPL aggregation format. All records added to an aggregator must map to
+// the same shard, the aggregated record is sent with the explicit hash key of
+// that shard.
+type aggregator struct {
+	explicitHashKey string
+
+	first    *record
+	keys     map[string]uint64
+	keyTable []string
+	records  proto.Buffer
+	nbytes   int
+	count    int
+	items    int
+	dones    []func(error)
+}
+
+func newAggregator(explicitHashKey string) *aggregator {
+	return &aggregator{
+		explicitHashKey: explicitHashKey,
+		keys:            make(map[string]uint64),
+	}
+}
+
+// put adds a record to the aggregate.
+func (a *aggregator) put(r *record) {
+	if a.count == 0 {
+		a.first = r
+	}
+
+	idx, ok := a.keys[r.partitionKey]
+	if !ok {
+		idx = uint64(len(a.keyTable))
+		a.keys[r.partitionKey] = idx
+		a.keyTable = append(a.keyTable, r.partitionKey)
+		a.nbytes += len(r.partitionKey) + aggregationOverhead
+	}
+
+	var rec proto.Buffer
+	_ = rec.EncodeVarint(tagPartitionKeyIndex)
+	_ = rec.EncodeVarint(idx)
+	_ = rec.EncodeVarint(tagData)
+	_ = rec.EncodeRawBytes(r.data)
+
+	_ = a.records.EncodeVarint(tagRecords)
+	_ = a.records.EncodeRawBytes(rec.Bytes())
+
+	a.nbytes += len(r.data) + aggregationOverhead
+	a.count++
+	a.items += r.items
+	if r.done != nil {
+		a.dones = append(a.dones, r.done)
+	}
+}
+
+// size returns an estimate of the size of the aggregated record.
+func (a *aggregator) size() int {
+	return len(aggregationMagic) + a.nbytes + md5.Size
+}
+
+// drain returns the aggregated record and resets the aggregator. A single
+// record is returned as is, without the aggregation envelope.
+func (a *aggregator) drain() *entry {
+	defer a.reset()
+
+	if a.count == 1 {
+		return newEntry(a.first)
+	}
+
+	var msg proto.Buffer
+	for _, key := range a.keyTable {
+		_ = msg.EncodeVarint(tagPartitionKeyTable)
+		_ = msg.EncodeStringBytes(key)
+	}
+	body := append(msg.Bytes(), a.records.Bytes()...)
+	sum := md5.Sum(body)
+
+	data := make([]byte, 0, len(aggregationMagic)+len(body)+len(sum))
+	data = append(data, aggregationMagic...)
+	data = append(data, body...)
+	data = append(data, sum[:]...)
+
+	return &entry{
+		PutRecordsRequestEntry: &awskinesis.PutRecordsRequestEntry{
+			Data:            data,
+			PartitionKey:    aws.String(a.keyTable[0]),
+			ExplicitHashKey: aws.String(a.explicitHashKey),
+		},
+		items: a.items,
+		dones: a.dones,
+	}
+}
+
+func (a *aggregator) reset() {
+	a.first = nil
+	a.keys = make(map[string]uint64)
+	a.keyTable = nil
+	a.records.Reset()
+	a.nbytes = 0
+	a.count = 0
+	a.items = 0
+	a.dones = nil
+}
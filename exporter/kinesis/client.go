@@ -0,0 +1,46 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awskinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// newKinesisClient creates a Kinesis API client using the region, credentials
+// and endpoint from the AWS section of the exporter config, over the base
+// config if not nil.
+func newKinesisClient(c AWSConfig, base *aws.Config) (kinesisiface.KinesisAPI, error) {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(c.Region), base)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := newCredentials(sess, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfgs []*aws.Config
+	if creds != nil {
+		cfgs = append(cfgs, aws.NewConfig().WithCredentials(creds))
+	}
+	if c.KinesisEndpoint != "" {
+		cfgs = append(cfgs, aws.NewConfig().WithEndpoint(c.KinesisEndpoint))
+	}
+	return awskinesis.New(sess, cfgs...), nil
+}
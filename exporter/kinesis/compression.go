@@ -0,0 +1,95 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionNone   = "none"
+	compressionGzip   = "gzip"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+)
+
+// Codec identifiers written after compressionMagic.
+const (
+	codecGzip   byte = 1
+	codecZstd   byte = 2
+	codecSnappy byte = 3
+)
+
+// compressionMagic prefixes every compressed user record, it is followed by
+// the codec byte and the compressed data. The user records are compressed
+// before being aggregated, so consumers decompress them after de-aggregating.
+// Records without the prefix are not compressed, this happens when
+// compression doesn't make a record smaller.
+var compressionMagic = []byte{0xC0, 0x4D, 0x50, 0x52}
+
+// compressor returns the compressed and marked version of data, or data
+// itself if compressing doesn't make it smaller. It is called concurrently.
+type compressor func(data []byte) []byte
+
+func newCompressor(compression string) (compressor, error) {
+	switch compression {
+	case "", compressionNone:
+		return nil, nil
+	case compressionGzip:
+		pool := sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+		return markedCompressor(codecGzip, func(dst *bytes.Buffer, data []byte) {
+			w := pool.Get().(*gzip.Writer)
+			defer pool.Put(w)
+			w.Reset(dst)
+			// Writes to a bytes.Buffer never fail.
+			_, _ = w.Write(data)
+			_ = w.Close()
+		}), nil
+	case compressionZstd:
+		// A zstd encoder can be used concurrently with EncodeAll.
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		return markedCompressor(codecZstd, func(dst *bytes.Buffer, data []byte) {
+			dst.Write(enc.EncodeAll(data, nil))
+		}), nil
+	case compressionSnappy:
+		return markedCompressor(codecSnappy, func(dst *bytes.Buffer, data []byte) {
+			dst.Write(snappy.Encode(nil, data))
+		}), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", compression)
+}
+
+func markedCompressor(codec byte, compress func(dst *bytes.Buffer, data []byte)) compressor {
+	return func(data []byte) []byte {
+		var buf bytes.Buffer
+		buf.Grow(len(compressionMagic) + 1 + len(data)/2)
+		buf.Write(compressionMagic)
+		buf.WriteByte(codec)
+		compress(&buf, data)
+		if buf.Len() >= len(data) {
+			return data
+		}
+		return buf.Bytes()
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// decompress returns the original data of a record, which is data itself if
+// the record is not compressed.
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, compressionMagic) || len(data) <= len(compressionMagic) {
+		return data, nil
+	}
+	codec, body := data[len(compressionMagic)], data[len(compressionMagic)+1:]
+	switch codec {
+	case codecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case codecZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(body, nil)
+	case codecSnappy:
+		return snappy.Decode(nil, body)
+	}
+	return nil, fmt.Errorf("unknown codec %d", codec)
+}
+
+func TestCompressors(t *testing.T) {
+	data := bytes.Repeat([]byte("GET /api/v1/traces "), 100)
+	random := make([]byte, 1000)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	codecs := map[string]byte{
+		compressionGzip:   codecGzip,
+		compressionZstd:   codecZstd,
+		compressionSnappy: codecSnappy,
+	}
+	for compression, codec := range codecs {
+		t.Run(compression, func(t *testing.T) {
+			compress, err := newCompressor(compression)
+			require.NoError(t, err)
+
+			compressed := compress(data)
+			assert.True(t, len(compressed) < len(data))
+			assert.True(t, bytes.HasPrefix(compressed, append(compressionMagic, codec)))
+			got, err := decompress(compressed)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+
+			// Records that don't get smaller are sent as is.
+			assert.Equal(t, random, compress(random))
+		})
+	}
+}
+
+func TestNoCompression(t *testing.T) {
+	for _, compression := range []string{"", compressionNone} {
+		compress, err := newCompressor(compression)
+		require.NoError(t, err)
+		assert.Nil(t, compress)
+	}
+	_, err := newCompressor("lz4")
+	assert.Error(t, err)
+}
+
+func TestProducerCompressesRecords(t *testing.T) {
+	fk := newFakeKinesis(1)
+	cfg := testProducerConfig()
+	cfg.compress, _ = newCompressor(compressionZstd)
+	p, err := newProducer(fk, cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("data"), 100)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, p.put(data, fmt.Sprintf("key-%d", i), 1))
+	}
+	p.stop()
+
+	// The user records are compressed and aggregated in a record in the KPL
+	// format, which the KCL de-aggregates.
+	fk.mu.Lock()
+	require.Len(t, fk.entries, 1)
+	entry := fk.entries[0]
+	fk.mu.Unlock()
+	assert.True(t, bytes.HasPrefix(entry.Data, aggregationMagic))
+	assert.True(t, len(entry.Data) < 10*len(data))
+
+	records, err := deaggregate(entry.Data, aws.StringValue(entry.PartitionKey))
+	require.NoError(t, err)
+	require.Len(t, records, 10)
+	for i, r := range records {
+		assert.Equal(t, fmt.Sprintf("key-%d", i), r.partitionKey)
+		assert.True(t, bytes.HasPrefix(r.data, append(compressionMagic, codecZstd)))
+		got, err := decompress(r.data)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+}
+
+// BenchmarkCompression reports the bytes put on the stream per span with
+// every compression, as the stream-B/span metric.
+func BenchmarkCompression(b *testing.B) {
+	td := e2eTraceData(20, 10)
+	for _, compression := range []string{compressionNone, compressionGzip, compressionZstd, compressionSnappy} {
+		b.Run(compression, func(b *testing.B) {
+			compress, err := newCompressor(compression)
+			require.NoError(b, err)
+			encode, err := newSpanEncoder(encodingJaegerProtoBatch)
+			require.NoError(b, err)
+			partitioner, err := newSpanPartitioner(partitionKeyTraceID, "")
+			require.NoError(b, err)
+			router, _, err := newSpanRouter("test-stream", nil)
+			require.NoError(b, err)
+
+			fk := newFakeKinesis(4)
+			cfg := testProducerConfig()
+			cfg.compress = compress
+			cfg.queueSize = b.N * len(td.Spans)
+			p, err := newProducer(fk, cfg, zap.NewNop())
+			require.NoError(b, err)
+			e := Exporter{
+				name:             "kinesis",
+				streams:          []*stream{{name: "test-stream", producer: p}},
+				router:           router,
+				encode:           encode,
+				partitioner:      partitioner,
+				maxBytesPerBatch: 100000,
+				maxBytesPerSpan:  900000,
+				logger:           zap.NewNop(),
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Use new trace IDs and timestamps so the records aren't
+				// repeated across iterations.
+				for _, span := range td.Spans {
+					binary.BigEndian.PutUint32(span.TraceId[4:], uint32(i))
+					span.StartTime.Nanos = int32(i)
+				}
+				if err := e.ConsumeTraceData(context.Background(), td); err != nil {
+					b.Fatal(err)
+				}
+			}
+			p.stop()
+			b.StopTimer()
+
+			var sent int
+			for _, entry := range fk.entries {
+				sent += len(entry.Data)
+			}
+			b.ReportMetric(float64(sent)/float64(b.N*len(td.Spans)), "stream-B/span")
+		})
+	}
+}
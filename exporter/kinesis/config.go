@@ -15,15 +15,39 @@
 package kinesis
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
 )
 
 // AWSConfig contains AWS specific configuration such as kinesis stream, region, etc.
 type AWSConfig struct {
-	StreamName      string `mapstructure:"stream-name,omitempty"`
-	KinesisEndpoint string `mapstructure:"kinesis-endpoint,omitempty"`
-	Region          string `mapstructure:"region,omitempty"`
-	Role            string `mapstructure:"role,omitempty"`
+	StreamName      string            `mapstructure:"stream-name,omitempty"`
+	KinesisEndpoint string            `mapstructure:"kinesis-endpoint,omitempty"`
+	Region          string            `mapstructure:"region,omitempty"`
+	Role            string            `mapstructure:"role,omitempty"`
+	ExternalID      string            `mapstructure:"external-id,omitempty"`
+	Credentials     CredentialsConfig `mapstructure:"credentials,omitempty"`
+}
+
+// CredentialsConfig contains the source of the AWS credentials. At most one
+// of static credentials, a shared profile or a web identity token file can be
+// set; the default AWS credential chain is used when none is. The role of
+// AWSConfig, if any, is assumed using these credentials.
+type CredentialsConfig struct {
+	// Static credentials, each read from a file or an environment variable.
+	AccessKeyIDFile     string `mapstructure:"access-key-id-file,omitempty"`
+	AccessKeyIDEnv      string `mapstructure:"access-key-id-env,omitempty"`
+	SecretAccessKeyFile string `mapstructure:"secret-access-key-file,omitempty"`
+	SecretAccessKeyEnv  string `mapstructure:"secret-access-key-env,omitempty"`
+
+	Profile               string `mapstructure:"profile,omitempty"`
+	SharedCredentialsFile string `mapstructure:"shared-credentials-file,omitempty"`
+
+	// WebIdentityTokenFile is the token used to assume the role of AWSConfig,
+	// like the ones mounted for Kubernetes service accounts.
+	WebIdentityTokenFile string `mapstructure:"web-identity-token-file,omitempty"`
 }
 
 // KPLConfig contains kinesis producer library related config to controls things
@@ -40,16 +64,86 @@ type KPLConfig struct {
 	MaxBackoffSeconds    int `mapstructure:"max-backoff-seconds,omitempty"`
 }
 
+// MetricsConfig contains the configuration used when exporting metrics. The
+// stream defaults to the one in AWSConfig when not set.
+type MetricsConfig struct {
+	StreamName   string `mapstructure:"stream-name,omitempty"`
+	Encoding     string `mapstructure:"encoding,omitempty"`
+	PartitionKey string `mapstructure:"partition-key,omitempty"`
+}
+
+// SpillQueueConfig contains the configuration of the on-disk queue spans are
+// written to before being handed to the producer. The queue is disabled when
+// no directory is set.
+type SpillQueueConfig struct {
+	Directory    string `mapstructure:"directory,omitempty"`
+	MaxBytes     int    `mapstructure:"max-bytes,omitempty"`
+	SegmentBytes int    `mapstructure:"segment-bytes,omitempty"`
+}
+
+// RouteConfig writes the spans matching all of its conditions to another
+// stream than the one in AWSConfig. Routes are checked in order, the first
+// matching one is used.
+type RouteConfig struct {
+	StreamName string `mapstructure:"stream-name,omitempty"`
+
+	// ServiceName matches the service name of the node of the spans.
+	ServiceName string `mapstructure:"service-name,omitempty"`
+	// ResourceLabels match the labels of the resource of the spans.
+	ResourceLabels map[string]string `mapstructure:"resource-labels,omitempty"`
+	// SpanAttributes match the attributes of the spans, other types than
+	// strings are compared with their string representation.
+	SpanAttributes map[string]string `mapstructure:"span-attributes,omitempty"`
+}
+
 // Config contains the main configuration options for the kinesis exporter
 type Config struct {
 	configmodels.ExporterSettings `mapstructure:",squash"`
 
-	AWS AWSConfig `mapstructure:"aws,omitempty"`
-	KPL KPLConfig `mapstructure:"kpl,omitempty"`
+	AWS        AWSConfig        `mapstructure:"aws,omitempty"`
+	KPL        KPLConfig        `mapstructure:"kpl,omitempty"`
+	Metrics    MetricsConfig    `mapstructure:"metrics,omitempty"`
+	SpillQueue SpillQueueConfig `mapstructure:"spill-queue,omitempty"`
+	// Routes send some of the spans to other streams than AWS.StreamName,
+	// which gets the spans matching no route. Every stream gets its own
+	// producer and spill queue, in a sub-directory named after the stream.
+	Routes []RouteConfig `mapstructure:"routes,omitempty"`
 
-	QueueSize            int `mapstructure:"queue-size,omitempty"`
+	QueueSize        int `mapstructure:"queue-size,omitempty"`
+	MaxBytesPerBatch int `mapstructure:"max-bytes-per-batch,omitempty"`
+	MaxBytesPerSpan  int `mapstructure:"max-bytes-per-span,omitempty"`
+	// NumWorkers and FlushIntervalSeconds are deprecated and ignored, the
+	// records are flushed and sent as configured by KPL.
 	NumWorkers           int `mapstructure:"num-workers,omitempty"`
-	MaxBytesPerBatch     int `mapstructure:"max-bytes-per-batch,omitempty"`
-	MaxBytesPerSpan      int `mapstructure:"max-bytes-per-span,omitempty"`
 	FlushIntervalSeconds int `mapstructure:"flush-interval-seconds,omitempty"`
+	// ShutdownTimeout is how long stopping the exporter waits for the queued
+	// records to be sent, 0 waits until they are all sent.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown-timeout,omitempty"`
+
+	// Encoding is the format the spans are written to the stream with. One of
+	// jaeger-proto, jaeger-proto-batch, jaeger-json, oc-proto, zipkin-json or
+	// zipkin-proto. The jaeger-proto spans are written by
+	// opencensus-go-exporter-kinesis, which only supports the trace-id
+	// partition key, no compression, no spill queue and the default AWS
+	// credentials.
+	Encoding string `mapstructure:"encoding,omitempty"`
+	// PartitionKey is what the spans are spread across shards by. One of
+	// trace-id, service-name, span-attribute or random.
+	PartitionKey string `mapstructure:"partition-key,omitempty"`
+	// PartitionKeyAttribute is the span attribute used as partition key when
+	// PartitionKey is span-attribute.
+	PartitionKeyAttribute string `mapstructure:"partition-key-attribute,omitempty"`
+	// OversizePolicy is what is done with spans larger than MaxBytesPerSpan.
+	// One of drop, truncate (shorten and drop attributes and annotations
+	// until the span fits) or strip (keep only the span skeleton).
+	OversizePolicy string `mapstructure:"oversize-policy,omitempty"`
+	// Compression is the codec the user records are compressed with, before
+	// being aggregated. One of none, gzip, zstd or snappy. Compressed records
+	// start with a magic prefix and a codec byte so consumers can detect them.
+	Compression string `mapstructure:"compression,omitempty"`
+}
+
+// settingError returns the error of the exporter for an invalid setting.
+func (c *Config) settingError(key string, err error) error {
+	return fmt.Errorf("kinesis exporter %q: invalid %s setting: %v", c.Name(), key, err)
 }
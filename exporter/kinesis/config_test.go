@@ -17,9 +17,11 @@ package kinesis
 import (
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 
 	"github.com/open-telemetry/opentelemetry-service/config"
 	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
@@ -54,13 +56,22 @@ func TestDefaultConfig(t *testing.T) {
 				BacklogCount:         2000,
 				FlushIntervalSeconds: 5,
 				MaxConnections:       24,
+				MaxRetries:           3,
+				MaxBackoffSeconds:    5,
+			},
+			Metrics: MetricsConfig{
+				Encoding:     "oc-proto",
+				PartitionKey: "random",
 			},
 
-			QueueSize:            100000,
-			NumWorkers:           8,
-			FlushIntervalSeconds: 5,
-			MaxBytesPerBatch:     100000,
-			MaxBytesPerSpan:      900000,
+			QueueSize:        100000,
+			ShutdownTimeout:  10 * time.Second,
+			MaxBytesPerBatch: 100000,
+			MaxBytesPerSpan:  900000,
+			Encoding:         "jaeger-proto",
+			PartitionKey:     "trace-id",
+			OversizePolicy:   "drop",
+			Compression:      "none",
 		},
 	)
 }
@@ -91,6 +102,11 @@ func TestConfig(t *testing.T) {
 				KinesisEndpoint: "kinesis.mars-1.aws.galactic",
 				Region:          "mars-1",
 				Role:            "arn:test-role",
+				ExternalID:      "test-external-id",
+				Credentials: CredentialsConfig{
+					Profile:               "test-profile",
+					SharedCredentialsFile: "/etc/aws/credentials",
+				},
 			},
 			KPL: KPLConfig{
 				AggregateBatchCount:  10,
@@ -103,12 +119,119 @@ func TestConfig(t *testing.T) {
 				MaxRetries:           17,
 				MaxBackoffSeconds:    18,
 			},
+			Metrics: MetricsConfig{
+				StreamName:   "test-metrics-stream",
+				Encoding:     "oc-json",
+				PartitionKey: "service-name",
+			},
+			SpillQueue: SpillQueueConfig{
+				Directory:    "/var/lib/kinesis",
+				MaxBytes:     67108864,
+				SegmentBytes: 8388608,
+			},
+			Routes: []RouteConfig{
+				{
+					StreamName:     "tenant-a-stream",
+					ResourceLabels: map[string]string{"tenant": "a"},
+				},
+				{
+					StreamName:     "errors-stream",
+					ServiceName:    "checkout",
+					SpanAttributes: map[string]string{"error": "true"},
+				},
+			},
 
-			QueueSize:            1,
-			NumWorkers:           2,
-			FlushIntervalSeconds: 3,
-			MaxBytesPerBatch:     4,
-			MaxBytesPerSpan:      5,
+			QueueSize:             1,
+			NumWorkers:            2,
+			FlushIntervalSeconds:  3,
+			ShutdownTimeout:       45 * time.Second,
+			MaxBytesPerBatch:      4,
+			MaxBytesPerSpan:       5,
+			Encoding:              "zipkin-json",
+			PartitionKey:          "span-attribute",
+			PartitionKeyAttribute: "tenant",
+			OversizePolicy:        "truncate",
+			Compression:           "zstd",
 		},
 	)
 }
+
+func TestFactoryInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		trace   bool
+		metrics bool
+		wantErr string
+	}{
+		{
+			name:    "encoding",
+			modify:  func(c *Config) { c.Encoding = "avro" },
+			trace:   true,
+			wantErr: `invalid encoding setting: unsupported trace encoding "avro"`,
+		},
+		{
+			name:    "partition-key",
+			modify:  func(c *Config) { c.PartitionKey = partitionKeySpanAttribute },
+			trace:   true,
+			wantErr: "invalid partition-key setting",
+		},
+		{
+			name:    "oversize-policy",
+			modify:  func(c *Config) { c.OversizePolicy = "split" },
+			trace:   true,
+			wantErr: `invalid oversize-policy setting: unsupported oversize policy "split"`,
+		},
+		{
+			name:    "compression",
+			modify:  func(c *Config) { c.Compression = "lz4" },
+			trace:   true,
+			metrics: true,
+			wantErr: `invalid compression setting: unsupported compression "lz4"`,
+		},
+		{
+			name: "routes",
+			modify: func(c *Config) {
+				c.AWS.StreamName = "default-stream"
+				c.Routes = []RouteConfig{{ServiceName: "checkout"}}
+			},
+			trace:   true,
+			wantErr: "invalid routes setting: route 0 has no stream-name",
+		},
+		{
+			name:    "metrics encoding",
+			modify:  func(c *Config) { c.Metrics.Encoding = encodingJaegerProto },
+			metrics: true,
+			wantErr: `invalid metrics.encoding setting: unsupported metrics encoding "jaeger-proto"`,
+		},
+		{
+			name:    "metrics partition key",
+			modify:  func(c *Config) { c.Metrics.PartitionKey = partitionKeyTraceID },
+			metrics: true,
+			wantErr: `invalid metrics.partition-key setting: unsupported metrics partition key "trace-id"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			factory := &Factory{}
+			cfg := factory.CreateDefaultConfig().(*Config)
+			cfg.NameVal = "kinesis/invalid"
+			cfg.Encoding = encodingJaegerProtoBatch
+			tt.modify(cfg)
+
+			// The exporters using the setting are rejected before any client
+			// is created.
+			wantErr := `kinesis exporter "kinesis/invalid": ` + tt.wantErr
+			if tt.trace {
+				_, _, err := factory.CreateTraceExporter(zap.NewNop(), cfg)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), wantErr)
+			}
+			if tt.metrics {
+				_, _, err := factory.CreateMetricsExporter(zap.NewNop(), cfg)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+const (
+	roleSessionName = "omnition-opentelemetry-service"
+
+	webIdentityProviderName = "WebIdentityProvider"
+)
+
+// validateCredentials checks the combination of credential settings in the
+// AWS section of the exporter config, without reading the files or the
+// environment variables they refer to.
+func validateCredentials(c AWSConfig) error {
+	cc := c.Credentials
+
+	sources := 0
+	if cc.hasStatic() {
+		sources++
+		if err := validateCredentialSource("access key id", cc.AccessKeyIDFile, cc.AccessKeyIDEnv); err != nil {
+			return err
+		}
+		if err := validateCredentialSource("secret access key", cc.SecretAccessKeyFile, cc.SecretAccessKeyEnv); err != nil {
+			return err
+		}
+	}
+	if cc.Profile != "" || cc.SharedCredentialsFile != "" {
+		sources++
+	}
+	if cc.WebIdentityTokenFile != "" {
+		sources++
+	}
+	if sources > 1 {
+		return errors.New("only one of static credentials, profile or web-identity-token-file can be set")
+	}
+
+	if c.ExternalID != "" && c.Role == "" {
+		return errors.New("external-id requires a role to assume")
+	}
+	if cc.WebIdentityTokenFile != "" {
+		if c.Role == "" {
+			return errors.New("web-identity-token-file requires a role to assume")
+		}
+		if c.ExternalID != "" {
+			return errors.New("external-id can't be used with web-identity-token-file")
+		}
+	}
+	return nil
+}
+
+// validateCredentialSource checks that a credential is read from exactly one
+// of a file or an environment variable.
+func validateCredentialSource(name, file, env string) error {
+	switch {
+	case file != "" && env != "":
+		return fmt.Errorf("the %s can't be read from both a file and an environment variable", name)
+	case file == "" && env == "":
+		return fmt.Errorf("the %s is not set", name)
+	}
+	return nil
+}
+
+func (cc CredentialsConfig) hasStatic() bool {
+	return cc.AccessKeyIDFile != "" || cc.AccessKeyIDEnv != "" || cc.SecretAccessKeyFile != "" || cc.SecretAccessKeyEnv != ""
+}
+
+// newCredentials returns the credentials configured in the AWS section of the
+// exporter config, or nil to use the default AWS credential chain. The
+// configured sources are read so missing files or variables fail when the
+// exporter is created rather than on the first request.
+func newCredentials(sess client.ConfigProvider, c AWSConfig) (*credentials.Credentials, error) {
+	if err := validateCredentials(c); err != nil {
+		return nil, err
+	}
+	cc := c.Credentials
+
+	var base *credentials.Credentials
+	if cc.hasStatic() {
+		id, err := readCredential("access key id", cc.AccessKeyIDFile, cc.AccessKeyIDEnv)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := readCredential("secret access key", cc.SecretAccessKeyFile, cc.SecretAccessKeyEnv)
+		if err != nil {
+			return nil, err
+		}
+		base = credentials.NewStaticCredentials(id, secret, "")
+	}
+	if cc.Profile != "" || cc.SharedCredentialsFile != "" {
+		base = credentials.NewSharedCredentials(cc.SharedCredentialsFile, cc.Profile)
+		if _, err := base.Get(); err != nil {
+			return nil, fmt.Errorf("invalid shared credentials profile: %v", err)
+		}
+	}
+
+	if cc.WebIdentityTokenFile != "" {
+		if _, err := readToken(cc.WebIdentityTokenFile); err != nil {
+			return nil, err
+		}
+		return credentials.NewCredentials(&webIdentityProvider{
+			client:    sts.New(sess),
+			roleARN:   c.Role,
+			tokenFile: cc.WebIdentityTokenFile,
+		}), nil
+	}
+
+	if c.Role != "" {
+		// The role is assumed using the configured credentials, if any.
+		var cfgs []*aws.Config
+		if base != nil {
+			cfgs = append(cfgs, aws.NewConfig().WithCredentials(base))
+		}
+		return stscreds.NewCredentialsWithClient(sts.New(sess, cfgs...), c.Role, func(p *stscreds.AssumeRoleProvider) {
+			if c.ExternalID != "" {
+				p.ExternalID = aws.String(c.ExternalID)
+			}
+		}), nil
+	}
+	return base, nil
+}
+
+// readCredential reads a credential from its file or its environment
+// variable, validateCredentialSource checked that exactly one is set.
+func readCredential(name, file, env string) (string, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading the %s: %v", name, err)
+		}
+		if value := strings.TrimSpace(string(data)); value != "" {
+			return value, nil
+		}
+		return "", fmt.Errorf("the %s file %q is empty", name, file)
+	}
+	if value := os.Getenv(env); value != "" {
+		return value, nil
+	}
+	return "", fmt.Errorf("the %s environment variable %q is not set", name, env)
+}
+
+func readToken(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("error reading the web identity token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("the web identity token file %q is empty", file)
+	}
+	return token, nil
+}
+
+// webIdentityProvider retrieves credentials by assuming a role with the web
+// identity token of a file, like the tokens Kubernetes mounts for service
+// accounts. The file is read on every retrieval since those tokens are
+// rotated.
+type webIdentityProvider struct {
+	credentials.Expiry
+
+	client    stsiface.STSAPI
+	roleARN   string
+	tokenFile string
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := readToken(p.tokenFile)
+	if err != nil {
+		return credentials.Value{ProviderName: webIdentityProviderName}, err
+	}
+	out, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(roleSessionName),
+		WebIdentityToken: aws.String(token),
+	})
+	if err != nil {
+		return credentials.Value{ProviderName: webIdentityProviderName}, err
+	}
+
+	// Refresh the credentials a bit before they expire.
+	p.SetExpiration(aws.TimeValue(out.Credentials.Expiration), time.Minute)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(out.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(out.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(out.Credentials.SessionToken),
+		ProviderName:    webIdentityProviderName,
+	}, nil
+}
@@ -0,0 +1,297 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestSession(t *testing.T) *session.Session {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion("us-west-2"))
+	require.NoError(t, err)
+	return sess
+}
+
+// writeFiles writes the given files to a temporary directory and returns
+// their paths.
+func writeFiles(t *testing.T, files map[string]string) (string, map[string]string) {
+	dir, err := ioutil.TempDir("", "kinesis-credentials")
+	require.NoError(t, err)
+	paths := map[string]string{}
+	for name, content := range files {
+		paths[name] = filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(paths[name], []byte(content), 0600))
+	}
+	return dir, paths
+}
+
+func TestStaticCredentials(t *testing.T) {
+	dir, paths := writeFiles(t, map[string]string{
+		"id":     "file-id\n",
+		"secret": "file-secret\n",
+	})
+	defer os.RemoveAll(dir)
+	os.Setenv("TEST_KINESIS_SECRET", "env-secret")
+	defer os.Unsetenv("TEST_KINESIS_SECRET")
+
+	creds, err := newCredentials(newTestSession(t), AWSConfig{
+		Credentials: CredentialsConfig{
+			AccessKeyIDFile:    paths["id"],
+			SecretAccessKeyEnv: "TEST_KINESIS_SECRET",
+		},
+	})
+	require.NoError(t, err)
+	value, err := creds.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "file-id", value.AccessKeyID)
+	assert.Equal(t, "env-secret", value.SecretAccessKey)
+}
+
+func TestSharedProfileCredentials(t *testing.T) {
+	dir, paths := writeFiles(t, map[string]string{
+		"credentials": "[test]\naws_access_key_id = profile-id\naws_secret_access_key = profile-secret\n",
+	})
+	defer os.RemoveAll(dir)
+
+	creds, err := newCredentials(newTestSession(t), AWSConfig{
+		Credentials: CredentialsConfig{
+			Profile:               "test",
+			SharedCredentialsFile: paths["credentials"],
+		},
+	})
+	require.NoError(t, err)
+	value, err := creds.Get()
+	require.NoError(t, err)
+	assert.Equal(t, "profile-id", value.AccessKeyID)
+	assert.Equal(t, "profile-secret", value.SecretAccessKey)
+}
+
+func TestDefaultCredentials(t *testing.T) {
+	creds, err := newCredentials(newTestSession(t), AWSConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, creds)
+
+	creds, err = newCredentials(newTestSession(t), AWSConfig{
+		Role:       "arn:aws:iam::123456789012:role/test",
+		ExternalID: "test-external-id",
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, creds)
+}
+
+func TestInvalidCredentials(t *testing.T) {
+	dir, paths := writeFiles(t, map[string]string{
+		"id":          "id",
+		"secret":      "secret",
+		"empty":       "",
+		"token":       "token",
+		"credentials": "[test]\naws_access_key_id = id\naws_secret_access_key = secret\n",
+	})
+	defer os.RemoveAll(dir)
+	role := "arn:aws:iam::123456789012:role/test"
+
+	tests := []struct {
+		name string
+		cfg  AWSConfig
+	}{
+		{
+			name: "empty file",
+			cfg: AWSConfig{Credentials: CredentialsConfig{
+				AccessKeyIDFile:     paths["empty"],
+				SecretAccessKeyFile: paths["secret"],
+			}},
+		},
+		{
+			name: "missing file",
+			cfg: AWSConfig{Credentials: CredentialsConfig{
+				AccessKeyIDFile:     filepath.Join(dir, "missing"),
+				SecretAccessKeyFile: paths["secret"],
+			}},
+		},
+		{
+			name: "unset env",
+			cfg: AWSConfig{Credentials: CredentialsConfig{
+				AccessKeyIDEnv:      "TEST_KINESIS_UNSET",
+				SecretAccessKeyFile: paths["secret"],
+			}},
+		},
+		{
+			name: "unknown profile",
+			cfg: AWSConfig{Credentials: CredentialsConfig{
+				Profile:               "unknown",
+				SharedCredentialsFile: paths["credentials"],
+			}},
+		},
+		{
+			name: "empty web identity token",
+			cfg: AWSConfig{
+				Role:        role,
+				Credentials: CredentialsConfig{WebIdentityTokenFile: paths["empty"]},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newCredentials(newTestSession(t), tt.cfg)
+			assert.Error(t, err)
+
+			// The error is reported when the exporter is created.
+			cfg := (&Factory{}).CreateDefaultConfig().(*Config)
+			cfg.AWS.Credentials = tt.cfg.Credentials
+			cfg.AWS.Role = tt.cfg.Role
+			cfg.AWS.ExternalID = tt.cfg.ExternalID
+			_, err = newKinesisClient(cfg.AWS, nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	role := "arn:aws:iam::123456789012:role/test"
+
+	tests := []struct {
+		name    string
+		cfg     AWSConfig
+		wantErr string
+	}{
+		{
+			name:    "missing secret",
+			cfg:     AWSConfig{Credentials: CredentialsConfig{AccessKeyIDFile: "/etc/aws/id"}},
+			wantErr: "the secret access key is not set",
+		},
+		{
+			name: "file and env",
+			cfg: AWSConfig{Credentials: CredentialsConfig{
+				AccessKeyIDFile:     "/etc/aws/id",
+				AccessKeyIDEnv:      "TEST_KINESIS_ID",
+				SecretAccessKeyFile: "/etc/aws/secret",
+			}},
+			wantErr: "the access key id can't be read from both a file and an environment variable",
+		},
+		{
+			name: "several sources",
+			cfg: AWSConfig{Credentials: CredentialsConfig{
+				AccessKeyIDFile:     "/etc/aws/id",
+				SecretAccessKeyFile: "/etc/aws/secret",
+				Profile:             "test",
+			}},
+			wantErr: "only one of static credentials, profile or web-identity-token-file can be set",
+		},
+		{
+			name:    "web identity without role",
+			cfg:     AWSConfig{Credentials: CredentialsConfig{WebIdentityTokenFile: "/var/run/token"}},
+			wantErr: "web-identity-token-file requires a role to assume",
+		},
+		{
+			name: "web identity with external id",
+			cfg: AWSConfig{
+				Role:        role,
+				ExternalID:  "test-external-id",
+				Credentials: CredentialsConfig{WebIdentityTokenFile: "/var/run/token"},
+			},
+			wantErr: "external-id can't be used with web-identity-token-file",
+		},
+		{
+			name:    "external id without role",
+			cfg:     AWSConfig{ExternalID: "test-external-id"},
+			wantErr: "external-id requires a role to assume",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCredentials(tt.cfg)
+			require.Error(t, err)
+			assert.Equal(t, tt.wantErr, err.Error())
+
+			// The error is reported before the files are read.
+			factory := &Factory{}
+			cfg := factory.CreateDefaultConfig().(*Config)
+			cfg.NameVal = "kinesis"
+			cfg.Encoding = encodingJaegerProtoBatch
+			cfg.AWS = tt.cfg
+			wantErr := `kinesis exporter "kinesis": invalid aws setting: ` + tt.wantErr
+			_, _, err = factory.CreateTraceExporter(zap.NewNop(), cfg)
+			require.Error(t, err)
+			assert.Equal(t, wantErr, err.Error())
+			_, _, err = factory.CreateMetricsExporter(zap.NewNop(), cfg)
+			require.Error(t, err)
+			assert.Equal(t, wantErr, err.Error())
+		})
+	}
+
+	assert.NoError(t, validateCredentials(AWSConfig{}))
+	assert.NoError(t, validateCredentials(AWSConfig{
+		Role:        role,
+		Credentials: CredentialsConfig{WebIdentityTokenFile: "/var/run/token"},
+	}))
+}
+
+// fakeSTS answers AssumeRoleWithWebIdentity calls with static credentials.
+type fakeSTS struct {
+	stsiface.STSAPI
+	inputs []*sts.AssumeRoleWithWebIdentityInput
+}
+
+func (fs *fakeSTS) AssumeRoleWithWebIdentity(in *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	fs.inputs = append(fs.inputs, in)
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("web-id"),
+			SecretAccessKey: aws.String("web-secret"),
+			SessionToken:    aws.String("web-session"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestWebIdentityProvider(t *testing.T) {
+	dir, paths := writeFiles(t, map[string]string{"token": "first-token\n"})
+	defer os.RemoveAll(dir)
+
+	fs := &fakeSTS{}
+	p := &webIdentityProvider{
+		client:    fs,
+		roleARN:   "arn:aws:iam::123456789012:role/test",
+		tokenFile: paths["token"],
+	}
+	value, err := p.Retrieve()
+	require.NoError(t, err)
+	assert.Equal(t, "web-id", value.AccessKeyID)
+	assert.Equal(t, "web-secret", value.SecretAccessKey)
+	assert.Equal(t, "web-session", value.SessionToken)
+	assert.False(t, p.IsExpired())
+
+	// The token is read again on every retrieval.
+	require.NoError(t, ioutil.WriteFile(paths["token"], []byte("second-token"), 0600))
+	_, err = p.Retrieve()
+	require.NoError(t, err)
+
+	require.Len(t, fs.inputs, 2)
+	assert.Equal(t, "first-token", aws.StringValue(fs.inputs[0].WebIdentityToken))
+	assert.Equal(t, "second-token", aws.StringValue(fs.inputs[1].WebIdentityToken))
+	assert.Equal(t, p.roleARN, aws.StringValue(fs.inputs[0].RoleArn))
+}
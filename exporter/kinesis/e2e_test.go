@@ -0,0 +1,519 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	agentmetricspb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/metrics/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/open-telemetry/opentelemetry-service/consumer"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	"github.com/open-telemetry/opentelemetry-service/exporter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/zap"
+)
+
+const e2eStreamName = "e2e-stream"
+
+// newE2EConfig returns an exporter config writing to the e2e stream with the
+// jaeger-proto-batch encoding, jaeger-proto is written by the library. The
+// flush interval is long enough for records to only be sent when batches are
+// full or the exporter is stopped.
+func newE2EConfig() *Config {
+	cfg := (&Factory{}).CreateDefaultConfig().(*Config)
+	cfg.Encoding = encodingJaegerProtoBatch
+	cfg.NameVal = "kinesis/e2e"
+	cfg.AWS.StreamName = e2eStreamName
+	cfg.KPL.FlushIntervalSeconds = 3600
+	return cfg
+}
+
+// newE2EExporter creates the trace exporter for the config writing to the
+// server.
+func newE2EExporter(t *testing.T, ks *kinesisServer, cfg *Config) (consumer.TraceConsumer, exporter.StopFunc) {
+	tc, stopFunc, err := ks.factory().CreateTraceExporter(zap.NewNop(), cfg)
+	require.NoError(t, err)
+	return tc, stopFunc
+}
+
+// e2eTraceData returns a batch with numTraces traces of spansPerTrace spans.
+func e2eTraceData(numTraces, spansPerTrace int) consumerdata.TraceData {
+	td := testTraceData()
+	td.Spans = nil
+	for i := 0; i < numTraces; i++ {
+		traceID := make([]byte, 16)
+		traceID[0], traceID[15] = 0xaa, byte(i+1)
+		for j := 0; j < spansPerTrace; j++ {
+			name := fmt.Sprintf("span-%d-%d", i, j)
+			td.Spans = append(td.Spans, testSpan(traceID, byte(i*spansPerTrace+j+1), name))
+		}
+	}
+	return td
+}
+
+// receivedBatches decodes the Jaeger batches received by the server.
+func receivedBatches(t *testing.T, ks *kinesisServer) []*model.Batch {
+	var batches []*model.Batch
+	for _, r := range ks.userRecords(t) {
+		batch := &model.Batch{}
+		require.NoError(t, batch.Unmarshal(r.data))
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func spanNames(batches []*model.Batch) []string {
+	var names []string
+	for _, batch := range batches {
+		for _, span := range batch.Spans {
+			names = append(names, span.OperationName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func wantSpanNames(td consumerdata.TraceData) []string {
+	var names []string
+	for _, span := range td.Spans {
+		names = append(names, span.Name.Value)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestE2EExportsSpans(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 4)
+	defer ks.Close()
+	tc, stopFunc := newE2EExporter(t, ks, newE2EConfig())
+
+	td := e2eTraceData(10, 3)
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+	require.NoError(t, stopFunc())
+
+	batches := receivedBatches(t, ks)
+	assert.Equal(t, wantSpanNames(td), spanNames(batches))
+	for _, batch := range batches {
+		assert.Equal(t, "test-service", batch.Process.ServiceName)
+		// All the spans of a trace are in the same record.
+		require.Len(t, batch.Spans, 3)
+		for _, span := range batch.Spans {
+			assert.Equal(t, batch.Spans[0].TraceID, span.TraceID)
+		}
+	}
+}
+
+func TestE2EEncodings(t *testing.T) {
+	for _, tt := range spanEncodings {
+		t.Run(tt.encoding, func(t *testing.T) {
+			ks := newKinesisServer(e2eStreamName, 4)
+			defer ks.Close()
+			cfg := newE2EConfig()
+			cfg.Encoding = tt.encoding
+			tc, stopFunc := newE2EExporter(t, ks, cfg)
+
+			td := e2eTraceData(10, 3)
+			require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+			require.NoError(t, stopFunc())
+
+			records := ks.userRecords(t)
+			require.Len(t, records, 10)
+			var names []string
+			for _, r := range records {
+				// All the spans of a trace are in the same record.
+				recordNames := tt.decode(t, r.data)
+				require.Len(t, recordNames, 3)
+				trace := recordNames[0][:strings.LastIndex(recordNames[0], "-")]
+				for _, name := range recordNames {
+					assert.True(t, strings.HasPrefix(name, trace+"-"), name)
+				}
+				names = append(names, recordNames...)
+			}
+			sort.Strings(names)
+			assert.Equal(t, wantSpanNames(td), names)
+		})
+	}
+}
+
+func TestE2ECompressesJaegerProto(t *testing.T) {
+	codecs := map[string]byte{
+		compressionGzip:   codecGzip,
+		compressionZstd:   codecZstd,
+		compressionSnappy: codecSnappy,
+	}
+	for compression, codec := range codecs {
+		t.Run(compression, func(t *testing.T) {
+			ks := newKinesisServer(e2eStreamName, 2)
+			defer ks.Close()
+			cfg := newE2EConfig()
+			cfg.Compression = compression
+			tc, stopFunc := newE2EExporter(t, ks, cfg)
+
+			td := e2eTraceData(4, 20)
+			require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+			require.NoError(t, stopFunc())
+
+			// Every de-aggregated record is a compressed model.Batch.
+			var records []*record
+			ks.mu.Lock()
+			for _, entry := range ks.entries {
+				rs, err := deaggregate(entry.Data, *entry.PartitionKey)
+				require.NoError(t, err)
+				records = append(records, rs...)
+			}
+			ks.mu.Unlock()
+			require.Len(t, records, 4)
+			var batches []*model.Batch
+			for _, r := range records {
+				require.True(t, bytes.HasPrefix(r.data, append(compressionMagic, codec)))
+				data, err := decompress(r.data)
+				require.NoError(t, err)
+				assert.True(t, len(r.data) < len(data))
+				batch := &model.Batch{}
+				require.NoError(t, batch.Unmarshal(data))
+				assert.Equal(t, "test-service", batch.Process.ServiceName)
+				batches = append(batches, batch)
+			}
+			assert.Equal(t, wantSpanNames(td), spanNames(batches))
+		})
+	}
+}
+
+func TestE2EAggregatesRecords(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 2)
+	defer ks.Close()
+	tc, stopFunc := newE2EExporter(t, ks, newE2EConfig())
+
+	td := e2eTraceData(20, 1)
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+	require.NoError(t, stopFunc())
+
+	// Every trace is its own user record but they are aggregated into one
+	// Kinesis record per shard.
+	ks.mu.Lock()
+	assert.Len(t, ks.entries, 2)
+	for _, entry := range ks.entries {
+		assert.True(t, bytes.HasPrefix(entry.Data, aggregationMagic))
+	}
+	ks.mu.Unlock()
+	assert.Len(t, ks.userRecords(t), 20)
+	assert.Equal(t, wantSpanNames(td), spanNames(receivedBatches(t, ks)))
+}
+
+func TestE2EBatchesBySize(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	cfg := newE2EConfig()
+	td := e2eTraceData(1, 10)
+	// Two spans of the trace fit in a batch.
+	cfg.MaxBytesPerBatch = 2*td.Spans[0].Size() + 1
+	tc, stopFunc := newE2EExporter(t, ks, cfg)
+
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+	require.NoError(t, stopFunc())
+
+	batches := receivedBatches(t, ks)
+	require.Len(t, batches, 5)
+	for _, batch := range batches {
+		assert.Len(t, batch.Spans, 2)
+	}
+	assert.Equal(t, wantSpanNames(td), spanNames(batches))
+}
+
+func TestE2EDropsLargeSpans(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	cfg := newE2EConfig()
+	cfg.MaxBytesPerSpan = 1000
+	tc, stopFunc := newE2EExporter(t, ks, cfg)
+
+	td := e2eTraceData(2, 2)
+	large := td.Spans[3]
+	large.Attributes.AttributeMap["payload"] = &tracepb.AttributeValue{
+		Value: &tracepb.AttributeValue_StringValue{
+			StringValue: &tracepb.TruncatableString{Value: strings.Repeat("x", 2000)},
+		},
+	}
+	err := tc.ConsumeTraceData(context.Background(), td)
+	require.NoError(t, stopFunc())
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 spans: "+errSpanTooLarge.Error())
+	want := wantSpanNames(td)[:3]
+	assert.Equal(t, want, spanNames(receivedBatches(t, ks)))
+}
+
+func TestE2EStopFlushes(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 2)
+	defer ks.Close()
+	tc, stopFunc := newE2EExporter(t, ks, newE2EConfig())
+
+	td := e2eTraceData(5, 2)
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+
+	// Nothing is sent before the flush interval unless the exporter stops.
+	ks.mu.Lock()
+	assert.Equal(t, 0, ks.calls)
+	ks.mu.Unlock()
+
+	require.NoError(t, stopFunc())
+	assert.Equal(t, wantSpanNames(td), spanNames(receivedBatches(t, ks)))
+}
+
+func TestE2EShutdownTimeout(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	ks.hold = make(chan struct{})
+	defer close(ks.hold)
+	cfg := newE2EConfig()
+	cfg.ShutdownTimeout = 100 * time.Millisecond
+	tc, stopFunc := newE2EExporter(t, ks, cfg)
+
+	td := e2eTraceData(3, 2)
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+
+	start := time.Now()
+	err := stopFunc()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `kinesis exporter "kinesis/e2e" shutdown timed out with 6 spans not sent to stream "e2e-stream"`)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestE2EShutdownTimeoutRoutedStreams(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	tenant := ks.addStream("tenant-stream", 1)
+	ks.hold = make(chan struct{})
+	defer close(ks.hold)
+	tenant.hold = make(chan struct{})
+	defer close(tenant.hold)
+	cfg := newE2EConfig()
+	cfg.ShutdownTimeout = 100 * time.Millisecond
+	cfg.Routes = []RouteConfig{{StreamName: "tenant-stream", ServiceName: "test-service"}}
+	tc, stopFunc := newE2EExporter(t, ks, cfg)
+
+	td := e2eTraceData(2, 2)
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+	td = e2eTraceData(1, 3)
+	td.Node = nil
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+
+	// The streams are stopped together, each reporting its unsent spans.
+	start := time.Now()
+	err := stopFunc()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `3 spans not sent to stream "e2e-stream"`)
+	assert.Contains(t, err.Error(), `4 spans not sent to stream "tenant-stream"`)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+// streamSpans returns the number of spans queued to each stream by the
+// exporter so far.
+func streamSpans(t *testing.T, exporterName string) map[string]float64 {
+	rows, err := view.RetrieveData(StatStreamSpanCount.Name())
+	require.NoError(t, err)
+	spans := map[string]float64{}
+	for _, row := range rows {
+		var rowExporter, rowStream string
+		for _, tag := range row.Tags {
+			switch tag.Key {
+			case TagExporterNameKey:
+				rowExporter = tag.Value
+			case TagStreamNameKey:
+				rowStream = tag.Value
+			}
+		}
+		if rowExporter == exporterName {
+			spans[rowStream] = row.Data.(*view.SumData).Value
+		}
+	}
+	return spans
+}
+
+func TestE2ERoutesSpans(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	tenant := ks.addStream("tenant-stream", 2)
+
+	cfg := newE2EConfig()
+	cfg.NameVal = "kinesis/routes"
+	cfg.Routes = []RouteConfig{{
+		StreamName:     "tenant-stream",
+		SpanAttributes: map[string]string{"tenant": "a"},
+	}}
+	tc, stopFunc := newE2EExporter(t, ks, cfg)
+	before := streamSpans(t, cfg.Name())
+
+	td := e2eTraceData(4, 1)
+	td.Spans[1].Attributes.AttributeMap["tenant"] = &tracepb.AttributeValue{
+		Value: &tracepb.AttributeValue_StringValue{
+			StringValue: &tracepb.TruncatableString{Value: "a"},
+		},
+	}
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+	require.NoError(t, stopFunc())
+
+	names := wantSpanNames(td)
+	assert.Equal(t, []string{names[0], names[2], names[3]}, spanNames(receivedBatches(t, ks)))
+	records := tenant.userRecords(t)
+	require.Len(t, records, 1)
+	batch := &model.Batch{}
+	require.NoError(t, batch.Unmarshal(records[0].data))
+	assert.Equal(t, []string{names[1]}, spanNames([]*model.Batch{batch}))
+
+	after := streamSpans(t, cfg.Name())
+	assert.Equal(t, float64(3), after[e2eStreamName]-before[e2eStreamName])
+	assert.Equal(t, float64(1), after["tenant-stream"]-before["tenant-stream"])
+}
+
+func TestE2ERoutedSpillQueues(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	ks.addStream("tenant-stream", 1)
+	dir, err := ioutil.TempDir("", "kinesis-routes")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := newE2EConfig()
+	cfg.Routes = []RouteConfig{{StreamName: "tenant-stream", ServiceName: "tenant"}}
+	cfg.SpillQueue.Directory = dir
+	_, stopFunc := newE2EExporter(t, ks, cfg)
+	require.NoError(t, stopFunc())
+
+	// The default stream uses the configured directory and every routed
+	// stream a sub-directory.
+	_, err = os.Stat(filepath.Join(dir, checkpointFile))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "tenant-stream", checkpointFile))
+	assert.NoError(t, err)
+}
+
+func TestE2EStaticCredentials(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	dir, paths := writeFiles(t, map[string]string{
+		"id":     "file-id",
+		"secret": "file-secret",
+	})
+	defer os.RemoveAll(dir)
+
+	// The configured credentials are used over the ones of the factory.
+	cfg := newE2EConfig()
+	cfg.AWS.Credentials = CredentialsConfig{
+		AccessKeyIDFile:     paths["id"],
+		SecretAccessKeyFile: paths["secret"],
+	}
+	tc, stopFunc := newE2EExporter(t, ks, cfg)
+	td := e2eTraceData(1, 1)
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+	require.NoError(t, stopFunc())
+
+	assert.Equal(t, wantSpanNames(td), spanNames(receivedBatches(t, ks)))
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	require.NotEmpty(t, ks.accessKeyIDs)
+	for _, id := range ks.accessKeyIDs {
+		assert.Equal(t, "file-id", id)
+	}
+}
+
+func TestE2EProducerMetrics(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	ks.failures = 1
+	cfg := newE2EConfig()
+	cfg.NameVal = "kinesis/e2e-metrics"
+	tc, stopFunc := newE2EExporter(t, ks, cfg)
+
+	views := []string{
+		StatRecordsSent.Name(),
+		StatBytesSent.Name(),
+		StatRecordsRetried.Name(),
+		StatThrottlingErrors.Name(),
+		"kinesis_batches_flushed",
+		StatPutLatency.Name(),
+		StatStreamSpanCount.Name(),
+	}
+	before := map[string]float64{}
+	for _, name := range views {
+		before[name] = viewValue(t, name, cfg.Name())
+	}
+
+	// The default encoding goes through the producer, which records its
+	// metrics for the spans.
+	td := e2eTraceData(3, 2)
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+	require.NoError(t, stopFunc())
+
+	ks.mu.Lock()
+	require.Len(t, ks.entries, 1)
+	sent := len(ks.entries[0].Data)
+	ks.mu.Unlock()
+	want := map[string]float64{
+		StatRecordsSent.Name():      1,
+		StatBytesSent.Name():        float64(sent),
+		StatRecordsRetried.Name():   1,
+		StatThrottlingErrors.Name(): 1,
+		"kinesis_batches_flushed":   1,
+		StatPutLatency.Name():       2,
+		StatStreamSpanCount.Name():  6,
+	}
+	for _, name := range views {
+		assert.Equal(t, want[name], viewValue(t, name, cfg.Name())-before[name], name)
+	}
+}
+
+func TestE2EUnknownStream(t *testing.T) {
+	ks := newKinesisServer(e2eStreamName, 1)
+	defer ks.Close()
+	cfg := newE2EConfig()
+	cfg.AWS.StreamName = "unknown-stream"
+
+	_, _, err := ks.factory().CreateTraceExporter(zap.NewNop(), cfg)
+	assert.Error(t, err)
+}
+
+func TestE2EExportsMetrics(t *testing.T) {
+	ks := newKinesisServer("e2e-metrics-stream", 1)
+	defer ks.Close()
+	cfg := newE2EConfig()
+	cfg.Metrics.StreamName = "e2e-metrics-stream"
+	mc, stopFunc, err := ks.factory().CreateMetricsExporter(zap.NewNop(), cfg)
+	require.NoError(t, err)
+
+	require.NoError(t, mc.ConsumeMetricsData(context.Background(), testMetricsData()))
+	require.NoError(t, stopFunc())
+
+	records := ks.userRecords(t)
+	require.Len(t, records, 1)
+	got := &agentmetricspb.ExportMetricsServiceRequest{}
+	require.NoError(t, proto.Unmarshal(records[0].data, got))
+	require.Len(t, got.Metrics, 1)
+	assert.Equal(t, "requests", got.Metrics[0].MetricDescriptor.Name)
+}
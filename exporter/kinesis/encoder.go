@@ -0,0 +1,133 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	agentmetricspb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/metrics/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	jaegertranslator "github.com/open-telemetry/opentelemetry-service/translator/trace/jaeger"
+	zipkinproto "github.com/openzipkin/zipkin-go/proto/v2"
+)
+
+const (
+	encodingOCProto          = "oc-proto"
+	encodingOCJSON           = "oc-json"
+	encodingJaegerProto      = "jaeger-proto"
+	encodingJaegerProtoBatch = "jaeger-proto-batch"
+	encodingJaegerJSON       = "jaeger-json"
+	encodingZipkinJSON       = "zipkin-json"
+	encodingZipkinProto      = "zipkin-proto"
+)
+
+// spanEncoder encodes a batch of spans into the payload of a record. The
+// jaeger-proto encoding has none, it is written by the library exporter.
+type spanEncoder func(td consumerdata.TraceData) ([]byte, error)
+
+func newSpanEncoder(encoding string) (spanEncoder, error) {
+	switch encoding {
+	case encodingJaegerProtoBatch:
+		return encodeJaegerProtoBatch, nil
+	case encodingJaegerJSON:
+		return encodeJaegerJSON, nil
+	case encodingOCProto:
+		return encodeOCProtoSpans, nil
+	case encodingZipkinJSON:
+		return encodeZipkinJSON, nil
+	case encodingZipkinProto:
+		return encodeZipkinProto, nil
+	}
+	return nil, fmt.Errorf("unsupported trace encoding %q", encoding)
+}
+
+// encodeJaegerProtoBatch encodes the spans as a Jaeger model.Batch.
+func encodeJaegerProtoBatch(td consumerdata.TraceData) ([]byte, error) {
+	batch, err := jaegertranslator.OCProtoToJaegerProto(td)
+	if err != nil {
+		return nil, err
+	}
+	return batch.Marshal()
+}
+
+// encodeJaegerJSON encodes the spans as a Jaeger model.Batch using the JSON
+// mapping of its protobuf definition, like Jaeger does for its Kafka topics.
+func encodeJaegerJSON(td consumerdata.TraceData) ([]byte, error) {
+	batch, err := jaegertranslator.OCProtoToJaegerProto(td)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, batch); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeOCProtoSpans(td consumerdata.TraceData) ([]byte, error) {
+	return proto.Marshal(&agenttracepb.ExportTraceServiceRequest{
+		Node:     td.Node,
+		Resource: td.Resource,
+		Spans:    td.Spans,
+	})
+}
+
+// encodeZipkinJSON encodes the spans as a Zipkin v2 JSON list.
+func encodeZipkinJSON(td consumerdata.TraceData) ([]byte, error) {
+	return json.Marshal(zipkinSpans(td))
+}
+
+// encodeZipkinProto encodes the spans as a Zipkin v2 ListOfSpans message.
+func encodeZipkinProto(td consumerdata.TraceData) ([]byte, error) {
+	return zipkinproto.SpanSerializer{}.Serialize(zipkinSpans(td))
+}
+
+// metricsEncoder encodes a batch of metrics into the payload of a record.
+type metricsEncoder func(md consumerdata.MetricsData) ([]byte, error)
+
+func newMetricsEncoder(encoding string) (metricsEncoder, error) {
+	switch encoding {
+	case encodingOCProto:
+		return encodeOCProtoMetrics, nil
+	case encodingOCJSON:
+		return encodeOCJSONMetrics, nil
+	}
+	return nil, fmt.Errorf("unsupported metrics encoding %q", encoding)
+}
+
+func encodeOCProtoMetrics(md consumerdata.MetricsData) ([]byte, error) {
+	return proto.Marshal(ocMetricsRequest(md))
+}
+
+func encodeOCJSONMetrics(md consumerdata.MetricsData) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, ocMetricsRequest(md)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func ocMetricsRequest(md consumerdata.MetricsData) *agentmetricspb.ExportMetricsServiceRequest {
+	return &agentmetricspb.ExportMetricsServiceRequest{
+		Node:     md.Node,
+		Resource: md.Resource,
+		Metrics:  md.Metrics,
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errSpanTooLarge = errors.New("span is too large to be exported to kinesis")
+
+// exportError is the error returned when some of the spans of a batch could
+// not be exported. The failed spans are counted by cause so a partial failure
+// can be told apart from a total one.
+type exportError struct {
+	spans  int
+	failed int
+	// causes keeps the error messages in the order they first happened.
+	causes []string
+	counts map[string]int
+}
+
+func newExportError(spans int) *exportError {
+	return &exportError{spans: spans, counts: map[string]int{}}
+}
+
+// add records that n spans failed to be exported because of err.
+func (e *exportError) add(err error, n int) {
+	cause := err.Error()
+	if _, ok := e.counts[cause]; !ok {
+		e.causes = append(e.causes, cause)
+	}
+	e.counts[cause] += n
+	e.failed += n
+}
+
+// sent returns the number of spans that were exported.
+func (e *exportError) sent() int {
+	return e.spans - e.failed
+}
+
+// err returns e as an error, or nil if no span failed.
+func (e *exportError) err() error {
+	if e.failed == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *exportError) Error() string {
+	causes := make([]string, 0, len(e.causes))
+	for _, cause := range e.causes {
+		causes = append(causes, fmt.Sprintf("%d spans: %s", e.counts[cause], cause))
+	}
+	return fmt.Sprintf("failed to export %d spans (%d sent): %s",
+		e.failed, e.sent(), strings.Join(causes, "; "))
+}
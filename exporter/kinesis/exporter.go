@@ -17,36 +17,175 @@ package kinesis
 import (
 	"context"
 
-	kinesis "github.com/omnition/opencensus-go-exporter-kinesis"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
 	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
-	jaegertranslator "github.com/open-telemetry/opentelemetry-service/translator/trace/jaeger"
+	"github.com/open-telemetry/opentelemetry-service/observability"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
 	"go.uber.org/zap"
 )
 
 // Exporter implements an OpenTelemetry trace exporter that exports all spans to AWS Kinesis
 type Exporter struct {
-	kinesis *kinesis.Exporter
-	logger  *zap.Logger
+	name string
+	// streams are the streams the spans are routed to, the first one is the
+	// default stream.
+	streams          []*stream
+	router           spanRouter
+	encode           spanEncoder
+	partitioner      spanPartitioner
+	oversize         oversizeHandler
+	maxBytesPerBatch int
+	maxBytesPerSpan  int
+	logger           *zap.Logger
 }
 
-// ConsumeTraceData receives a span batch and exports it to AWS Kinesis
+// stream is a Kinesis stream spans are written to.
+type stream struct {
+	name     string
+	producer asyncRecordPutter
+}
+
+// group identifies the spans written to the same stream with the same
+// partition key.
+type group struct {
+	stream int
+	key    string
+}
+
+// ConsumeTraceData receives a span batch and exports it to AWS Kinesis. The
+// returned error only counts the spans that could not be queued, the ones
+// the producer fails to send later are recorded as dropped when it gives up.
 func (e Exporter) ConsumeTraceData(c context.Context, td consumerdata.TraceData) error {
-	pBatch, err := jaegertranslator.OCProtoToJaegerProto(td)
-	if err != nil {
-		e.logger.Error("error translating span batch", zap.Error(err))
+	c = observability.ContextWithExporterName(c, e.name)
+	spans := 0
+	for _, span := range td.Spans {
+		if span != nil {
+			spans++
+		}
+	}
+	errs := newExportError(spans)
+
+	// Spans sharing a stream and a partition key are encoded together in the
+	// same records.
+	route := e.router(td)
+	partitionKey := e.partitioner(td)
+	var keys []group
+	groups := map[group][]*tracepb.Span{}
+	for _, span := range td.Spans {
+		if span == nil {
+			continue
+		}
+		// The span is routed before being truncated, which could drop the
+		// attributes it is routed by.
+		key := group{stream: route(span), key: partitionKey(span)}
+		span = fitSpan(c, span, e.maxBytesPerSpan, e.oversize, statsTags(e.name, e.streams[key.stream].name), e.logger)
+		if span == nil {
+			errs.add(errSpanTooLarge, 1)
+			continue
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], span)
+	}
+
+	for _, key := range keys {
+		for spans := groups[key]; len(spans) > 0; {
+			n := e.batchLen(spans)
+			batch := td
+			batch.Spans = spans[:n]
+			e.export(c, batch, e.streams[key.stream], key.key, errs)
+			spans = spans[n:]
+		}
+	}
+
+	observability.RecordTraceExporterMetrics(c, spans, errs.failed)
+
+	if err := errs.err(); err != nil {
+		e.logger.Error("error exporting spans to kinesis", zap.Error(err))
 		return err
 	}
-	// TODO: Use a multi error type
-	var exportErr error
-	for _, span := range pBatch.GetSpans() {
-		if span.Process == nil {
-			span.Process = pBatch.Process
+	return nil
+}
+
+// fitSpan applies the oversize policy to a span larger than maxBytesPerSpan.
+// It returns the span, the smaller copy of it, or nil if it is dropped.
+func fitSpan(
+	c context.Context,
+	span *tracepb.Span,
+	maxBytesPerSpan int,
+	oversize oversizeHandler,
+	tags []tag.Mutator,
+	logger *zap.Logger,
+) *tracepb.Span {
+	size := span.Size()
+	if maxBytesPerSpan <= 0 || size <= maxBytesPerSpan {
+		return span
+	}
+	fitted := oversize(span, maxBytesPerSpan)
+	if fitted == nil {
+		logger.Debug("dropping span larger than max-bytes-per-span",
+			zap.Binary("span_id", span.SpanId), zap.Int("size", size))
+		return nil
+	}
+	stats.RecordWithTags(c, tags, StatTruncatedSpanCount.M(1))
+	return fitted
+}
+
+// batchLen returns the number of spans at the start of spans that fit in
+// maxBytesPerBatch. The first span is always part of the batch.
+func (e Exporter) batchLen(spans []*tracepb.Span) int {
+	if e.maxBytesPerBatch <= 0 {
+		return len(spans)
+	}
+	n, size := 1, spans[0].Size()
+	for ; n < len(spans); n++ {
+		size += spans[n].Size()
+		if size > e.maxBytesPerBatch {
+			break
 		}
-		err := e.kinesis.ExportSpan(span)
+	}
+	return n
+}
+
+// export encodes the batch into a single record, splitting it in halves
+// until each part fits in a Kinesis record. The spans that can't be exported
+// are added to errs.
+func (e Exporter) export(c context.Context, td consumerdata.TraceData, s *stream, key string, errs *exportError) {
+	data, err := e.encode(td)
+	if err != nil {
+		errs.add(err, len(td.Spans))
+		return
+	}
+
+	if len(data)+len(key) > maxRecordSize {
+		if len(td.Spans) == 1 {
+			e.logger.Debug("dropping span larger than a kinesis record",
+				zap.Binary("span_id", td.Spans[0].SpanId), zap.Int("size", len(data)))
+			errs.add(errSpanTooLarge, 1)
+			return
+		}
+		half := len(td.Spans) / 2
+		first, second := td, td
+		first.Spans = td.Spans[:half]
+		second.Spans = td.Spans[half:]
+		e.export(c, first, s, key, errs)
+		e.export(c, second, s, key, errs)
+		return
+	}
+
+	n := len(td.Spans)
+	err = s.producer.putAsync(data, key, n, func(err error) {
 		if err != nil {
-			e.logger.Error("error exporting span to kinesis", zap.Error(err))
-			exportErr = err
+			e.logger.Error("error sending spans to kinesis",
+				zap.String("stream", s.name), zap.Int("spans", n), zap.Error(err))
+			observability.RecordTraceExporterMetrics(c, 0, n)
+			return
 		}
+		stats.RecordWithTags(c, statsTags(e.name, s.name), StatStreamSpanCount.M(int64(n)))
+	})
+	if err != nil {
+		errs.add(err, n)
 	}
-	return exportErr
 }
@@ -0,0 +1,376 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/proto"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	"github.com/open-telemetry/opentelemetry-service/observability"
+	"github.com/open-telemetry/opentelemetry-service/observability/observabilitytest"
+	zipkinmodel "github.com/openzipkin/zipkin-go/model"
+	zipkinproto "github.com/openzipkin/zipkin-go/proto/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var (
+	testTraceID1 = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10}
+	testTraceID2 = []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f, 0x20}
+)
+
+func testSpan(traceID []byte, spanID byte, name string) *tracepb.Span {
+	return &tracepb.Span{
+		TraceId:   traceID,
+		SpanId:    []byte{0, 0, 0, 0, 0, 0, 0, spanID},
+		Name:      &tracepb.TruncatableString{Value: name},
+		Kind:      tracepb.Span_SERVER,
+		StartTime: &types.Timestamp{Seconds: 1500000000},
+		EndTime:   &types.Timestamp{Seconds: 1500000001},
+		Attributes: &tracepb.Span_Attributes{
+			AttributeMap: map[string]*tracepb.AttributeValue{
+				"http.method": {Value: &tracepb.AttributeValue_StringValue{
+					StringValue: &tracepb.TruncatableString{Value: "GET"},
+				}},
+			},
+		},
+	}
+}
+
+func testTraceData() consumerdata.TraceData {
+	return consumerdata.TraceData{
+		Node: &commonpb.Node{
+			ServiceInfo: &commonpb.ServiceInfo{Name: "test-service"},
+			Identifier:  &commonpb.ProcessIdentifier{HostName: "test-host"},
+		},
+		Spans: []*tracepb.Span{
+			testSpan(testTraceID1, 1, "first"),
+			testSpan(testTraceID2, 2, "second"),
+			testSpan(testTraceID1, 3, "third"),
+		},
+	}
+}
+
+func newTestExporter(t *testing.T, fk *fakeKinesis, encoding string) (Exporter, *producer) {
+	encode, err := newSpanEncoder(encoding)
+	require.NoError(t, err)
+	partitioner, err := newSpanPartitioner(partitionKeyTraceID, "")
+	require.NoError(t, err)
+	oversize, err := newOversizeHandler(oversizePolicyDrop)
+	require.NoError(t, err)
+	router, _, err := newSpanRouter("test-stream", nil)
+	require.NoError(t, err)
+	p, err := newProducer(fk, testProducerConfig(), zap.NewNop())
+	require.NoError(t, err)
+	return Exporter{
+		name:             "kinesis",
+		streams:          []*stream{{name: "test-stream", producer: p}},
+		router:           router,
+		encode:           encode,
+		partitioner:      partitioner,
+		oversize:         oversize,
+		maxBytesPerBatch: 100000,
+		maxBytesPerSpan:  900000,
+		logger:           zap.NewNop(),
+	}, p
+}
+
+// exportedSpanNames exports the test batch with the given encoding and
+// returns the names of the spans of every trace decoded with decode.
+func exportedSpanNames(t *testing.T, encoding string, decode func(data []byte) []string) map[string][]string {
+	fk := newFakeKinesis(2)
+	e, p := newTestExporter(t, fk, encoding)
+	require.NoError(t, e.ConsumeTraceData(context.Background(), testTraceData()))
+	p.stop()
+
+	names := map[string][]string{}
+	for _, r := range fk.userRecords(t) {
+		names[r.partitionKey] = append(names[r.partitionKey], decode(r.data)...)
+	}
+	return names
+}
+
+// spanEncodings are the trace encodings, with the function decoding the names
+// of the spans of a record payload.
+var spanEncodings = []struct {
+	encoding string
+	decode   func(t *testing.T, data []byte) []string
+}{
+	{
+		encoding: encodingJaegerProtoBatch,
+		decode: func(t *testing.T, data []byte) []string {
+			batch := &model.Batch{}
+			require.NoError(t, batch.Unmarshal(data))
+			assert.Equal(t, "test-service", batch.Process.ServiceName)
+			var names []string
+			for _, span := range batch.Spans {
+				names = append(names, span.OperationName)
+			}
+			return names
+		},
+	},
+	{
+		encoding: encodingJaegerJSON,
+		decode: func(t *testing.T, data []byte) []string {
+			batch := &model.Batch{}
+			require.NoError(t, jsonpb.Unmarshal(bytes.NewReader(data), batch))
+			assert.Equal(t, "test-service", batch.Process.ServiceName)
+			var names []string
+			for _, span := range batch.Spans {
+				names = append(names, span.OperationName)
+			}
+			return names
+		},
+	},
+	{
+		encoding: encodingOCProto,
+		decode: func(t *testing.T, data []byte) []string {
+			req := &agenttracepb.ExportTraceServiceRequest{}
+			require.NoError(t, proto.Unmarshal(data, req))
+			assert.Equal(t, "test-service", req.Node.ServiceInfo.Name)
+			var names []string
+			for _, span := range req.Spans {
+				names = append(names, span.Name.Value)
+			}
+			return names
+		},
+	},
+	{
+		encoding: encodingZipkinJSON,
+		decode: func(t *testing.T, data []byte) []string {
+			var spans []*zipkinmodel.SpanModel
+			require.NoError(t, json.Unmarshal(data, &spans))
+			var names []string
+			for _, span := range spans {
+				assert.Equal(t, "test-service", span.LocalEndpoint.ServiceName)
+				assert.Equal(t, "GET", span.Tags["http.method"])
+				names = append(names, span.Name)
+			}
+			return names
+		},
+	},
+	{
+		encoding: encodingZipkinProto,
+		decode: func(t *testing.T, data []byte) []string {
+			spans, err := zipkinproto.ParseSpans(data, false)
+			require.NoError(t, err)
+			var names []string
+			for _, span := range spans {
+				assert.Equal(t, "test-service", span.LocalEndpoint.ServiceName)
+				assert.Equal(t, zipkinmodel.Server, span.Kind)
+				names = append(names, span.Name)
+			}
+			return names
+		},
+	},
+}
+
+func TestExporterEncodings(t *testing.T) {
+	want := map[string][]string{
+		"0102030405060708090a0b0c0d0e0f10": {"first", "third"},
+		"1112131415161718191a1b1c1d1e1f20": {"second"},
+	}
+
+	for _, tt := range spanEncodings {
+		t.Run(tt.encoding, func(t *testing.T) {
+			got := exportedSpanNames(t, tt.encoding, func(data []byte) []string {
+				return tt.decode(t, data)
+			})
+			assert.Equal(t, want, got)
+		})
+	}
+}
+
+func TestExporterSplitsBatches(t *testing.T) {
+	fk := newFakeKinesis(1)
+	e, p := newTestExporter(t, fk, encodingOCProto)
+	td := testTraceData()
+	e.maxBytesPerBatch = td.Spans[0].Size()
+
+	require.NoError(t, e.ConsumeTraceData(context.Background(), td))
+	p.stop()
+
+	records := fk.userRecords(t)
+	require.Len(t, records, 3)
+	for _, r := range records {
+		req := &agenttracepb.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(r.data, req))
+		assert.Len(t, req.Spans, 1)
+	}
+}
+
+func TestExporterDropsLargeSpans(t *testing.T) {
+	fk := newFakeKinesis(1)
+	e, p := newTestExporter(t, fk, encodingOCProto)
+	td := testTraceData()
+	td.Spans[1].Name.Value = strings.Repeat("x", 1000)
+	e.maxBytesPerSpan = 500
+
+	err := e.ConsumeTraceData(context.Background(), td)
+	p.stop()
+	require.Error(t, err)
+	exportErr, ok := err.(*exportError)
+	require.True(t, ok)
+	assert.Equal(t, 1, exportErr.failed)
+	assert.Equal(t, 2, exportErr.sent())
+
+	records := fk.userRecords(t)
+	require.Len(t, records, 1)
+	req := &agenttracepb.ExportTraceServiceRequest{}
+	require.NoError(t, proto.Unmarshal(records[0].data, req))
+	assert.Len(t, req.Spans, 2)
+}
+
+func TestExporterErrorsAndMetrics(t *testing.T) {
+	doneFn := observabilitytest.SetupRecordedMetricsTest()
+	defer doneFn()
+
+	fk := newFakeKinesis(1)
+	e, p := newTestExporter(t, fk, encodingOCProto)
+	td := testTraceData()
+	td.Spans = append(td.Spans, testSpan(testTraceID2, 4, strings.Repeat("x", 1000)))
+	e.maxBytesPerSpan = 500
+	// Stopping the producer makes the remaining spans fail.
+	p.stop()
+
+	ctx := observability.ContextWithReceiverName(context.Background(), "test-receiver")
+	err := e.ConsumeTraceData(ctx, td)
+	require.Error(t, err)
+	assert.Equal(t, "failed to export 4 spans (0 sent): "+
+		"1 spans: span is too large to be exported to kinesis; "+
+		"3 spans: kinesis producer is stopped", err.Error())
+
+	require.NoError(t, observabilitytest.CheckValueViewExporterReceivedSpans("test-receiver", "kinesis", 4))
+	require.NoError(t, observabilitytest.CheckValueViewExporterDroppedSpans("test-receiver", "kinesis", 4))
+}
+
+func TestExporterRecordsProducerFailures(t *testing.T) {
+	doneFn := observabilitytest.SetupRecordedMetricsTest()
+	defer doneFn()
+
+	fk := newFakeKinesis(1)
+	fk.failures = 1
+	e, p := newTestExporter(t, fk, encodingOCProto)
+	td := testTraceData()
+	td.Spans = append(td.Spans, nil)
+
+	// The spans are queued, the producer gives up on them once stopped as
+	// the test config has no retries.
+	ctx := observability.ContextWithReceiverName(context.Background(), "test-receiver")
+	require.NoError(t, e.ConsumeTraceData(ctx, td))
+	p.stop()
+	assert.Equal(t, 1, fk.calls)
+
+	require.NoError(t, observabilitytest.CheckValueViewExporterReceivedSpans("test-receiver", "kinesis", 3))
+	require.NoError(t, observabilitytest.CheckValueViewExporterDroppedSpans("test-receiver", "kinesis", 3))
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	_, err := newSpanEncoder("thrift")
+	assert.Error(t, err)
+
+	factory := &Factory{}
+	cfg := factory.CreateDefaultConfig().(*Config)
+	cfg.Encoding = "thrift"
+	_, _, err = factory.CreateTraceExporter(zap.NewNop(), cfg)
+	assert.Error(t, err)
+}
+
+func TestExporterPartitionKeys(t *testing.T) {
+	tests := []struct {
+		partitionKey string
+		attribute    string
+		want         []string
+	}{
+		{
+			partitionKey: partitionKeyTraceID,
+			want:         []string{"0102030405060708090a0b0c0d0e0f10", "1112131415161718191a1b1c1d1e1f20"},
+		},
+		{
+			partitionKey: partitionKeyServiceName,
+			want:         []string{"test-service"},
+		},
+		{
+			partitionKey: partitionKeySpanAttribute,
+			attribute:    "http.method",
+			want:         []string{"GET"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.partitionKey, func(t *testing.T) {
+			fk := newFakeKinesis(2)
+			e, p := newTestExporter(t, fk, encodingOCProto)
+			partitioner, err := newSpanPartitioner(tt.partitionKey, tt.attribute)
+			require.NoError(t, err)
+			e.partitioner = partitioner
+
+			require.NoError(t, e.ConsumeTraceData(context.Background(), testTraceData()))
+			p.stop()
+
+			var keys []string
+			for _, r := range fk.userRecords(t) {
+				keys = append(keys, r.partitionKey)
+			}
+			assert.ElementsMatch(t, tt.want, keys)
+		})
+	}
+}
+
+func TestExporterRandomPartitionKey(t *testing.T) {
+	fk := newFakeKinesis(2)
+	e, p := newTestExporter(t, fk, encodingOCProto)
+	partitioner, err := newSpanPartitioner(partitionKeyRandom, "")
+	require.NoError(t, err)
+	e.partitioner = partitioner
+
+	// All the spans of a batch share the same random key.
+	require.NoError(t, e.ConsumeTraceData(context.Background(), testTraceData()))
+	require.NoError(t, e.ConsumeTraceData(context.Background(), testTraceData()))
+	p.stop()
+
+	records := fk.userRecords(t)
+	require.Len(t, records, 2)
+	assert.NotEqual(t, records[0].partitionKey, records[1].partitionKey)
+}
+
+func TestSpanAttributePartitionKeyFallback(t *testing.T) {
+	partitioner, err := newSpanPartitioner(partitionKeySpanAttribute, "tenant")
+	require.NoError(t, err)
+
+	td := testTraceData()
+	partitionKey := partitioner(td)
+	key := partitionKey(td.Spans[0])
+	assert.NotEmpty(t, key)
+	assert.Equal(t, key, partitionKey(td.Spans[1]))
+}
+
+func TestInvalidSpanPartitionKey(t *testing.T) {
+	_, err := newSpanPartitioner("host-name", "")
+	assert.Error(t, err)
+	_, err = newSpanPartitioner(partitionKeySpanAttribute, "")
+	assert.Error(t, err)
+}
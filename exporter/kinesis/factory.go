@@ -15,8 +15,16 @@
 package kinesis
 
 import (
-	kinesis "github.com/omnition/opencensus-go-exporter-kinesis"
-	"github.com/open-telemetry/opentelemetry-service/config/configerror"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+
 	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
 	"github.com/open-telemetry/opentelemetry-service/consumer"
 	"github.com/open-telemetry/opentelemetry-service/exporter"
@@ -25,12 +33,16 @@ import (
 
 const (
 	// The value of "type" key in configuration.
-	typeStr      = "kinesis"
-	exportFormat = "jaeger-proto"
+	typeStr = "kinesis"
+
+	defaultShutdownTimeout = 10 * time.Second
 )
 
 // Factory is the factory for Kinesis exporter.
 type Factory struct {
+	// awsConfig is the base AWS config of the Kinesis clients, the tests set
+	// it to use a local endpoint.
+	awsConfig *aws.Config
 }
 
 // Type gets the type of the Exporter config created by this factory.
@@ -50,54 +62,246 @@ func (f *Factory) CreateDefaultConfig() configmodels.Exporter {
 			BacklogCount:         2000,
 			FlushIntervalSeconds: 5,
 			MaxConnections:       24,
+			MaxRetries:           3,
+			MaxBackoffSeconds:    5,
+		},
+		Metrics: MetricsConfig{
+			Encoding:     encodingOCProto,
+			PartitionKey: partitionKeyRandom,
 		},
 
-		QueueSize:            100000,
-		NumWorkers:           8,
-		FlushIntervalSeconds: 5,
-		MaxBytesPerBatch:     100000,
-		MaxBytesPerSpan:      900000,
+		QueueSize:        100000,
+		ShutdownTimeout:  defaultShutdownTimeout,
+		MaxBytesPerBatch: 100000,
+		MaxBytesPerSpan:  900000,
+		Encoding:         encodingJaegerProto,
+		PartitionKey:     partitionKeyTraceID,
+		OversizePolicy:   oversizePolicyDrop,
+		Compression:      compressionNone,
 	}
 }
 
 // CreateTraceExporter initializes and returns a new trace exporter
 func (f *Factory) CreateTraceExporter(logger *zap.Logger, cfg configmodels.Exporter) (consumer.TraceConsumer, exporter.StopFunc, error) {
 	c := cfg.(*Config)
-	k, err := kinesis.NewExporter(kinesis.Options{
-		Name:               c.Name(),
-		StreamName:         c.AWS.StreamName,
-		AWSRegion:          c.AWS.Region,
-		AWSRole:            c.AWS.Role,
-		AWSKinesisEndpoint: c.AWS.KinesisEndpoint,
-
-		KPLAggregateBatchSize:   c.KPL.AggregateBatchSize,
-		KPLAggregateBatchCount:  c.KPL.AggregateBatchCount,
-		KPLBatchSize:            c.KPL.BatchSize,
-		KPLBatchCount:           c.KPL.BatchCount,
-		KPLBacklogCount:         c.KPL.BacklogCount,
-		KPLFlushIntervalSeconds: c.KPL.FlushIntervalSeconds,
-		KPLMaxConnections:       c.KPL.MaxConnections,
-		KPLMaxRetries:           c.KPL.MaxRetries,
-		KPLMaxBackoffSeconds:    c.KPL.MaxBackoffSeconds,
-
-		QueueSize:             c.QueueSize,
-		NumWorkers:            c.NumWorkers,
-		MaxAllowedSizePerSpan: c.MaxBytesPerSpan,
-		MaxListSize:           c.MaxBytesPerBatch,
-		ListFlushInterval:     c.FlushIntervalSeconds,
-		Encoding:              exportFormat,
-	}, logger)
+	// The service decodes the exporter configs without calling back into the
+	// factory, the errors name the invalid setting so that the service fails
+	// to start with it.
+	if c.Encoding == encodingJaegerProto {
+		return createLibraryExporter(c, logger)
+	}
+	encode, err := newSpanEncoder(c.Encoding)
+	if err != nil {
+		return nil, nil, c.settingError("encoding", err)
+	}
+	partitioner, err := newSpanPartitioner(c.PartitionKey, c.PartitionKeyAttribute)
+	if err != nil {
+		return nil, nil, c.settingError("partition-key", err)
+	}
+	oversize, err := newOversizeHandler(c.OversizePolicy)
+	if err != nil {
+		return nil, nil, c.settingError("oversize-policy", err)
+	}
+	compress, err := newCompressor(c.Compression)
+	if err != nil {
+		return nil, nil, c.settingError("compression", err)
+	}
+	router, streamNames, err := newSpanRouter(c.AWS.StreamName, c.Routes)
+	if err != nil {
+		return nil, nil, c.settingError("routes", err)
+	}
+	initMetrics()
+
+	client, err := newKinesisClient(c.AWS, f.awsConfig)
 	if err != nil {
+		return nil, nil, c.settingError("aws", err)
+	}
+	var streams []*stream
+	var stops []func() error
+	for _, name := range streamNames {
+		s, stop, err := newStream(c, client, compress, name, logger)
+		if err != nil {
+			stopStreams(stops)
+			return nil, nil, err
+		}
+		streams = append(streams, s)
+		stops = append(stops, stop)
+	}
+	stopFunc := func() error {
+		return stopStreams(stops)
+	}
+	return Exporter{
+		name:             c.Name(),
+		streams:          streams,
+		router:           router,
+		encode:           encode,
+		partitioner:      partitioner,
+		oversize:         oversize,
+		maxBytesPerBatch: c.MaxBytesPerBatch,
+		maxBytesPerSpan:  c.MaxBytesPerSpan,
+		logger:           logger,
+	}, stopFunc, nil
+}
+
+// createLibraryExporter creates the exporter writing the jaeger-proto spans
+// with opencensus-go-exporter-kinesis.
+func createLibraryExporter(c *Config, logger *zap.Logger) (consumer.TraceConsumer, exporter.StopFunc, error) {
+	if err := validateLibraryConfig(c); err != nil {
 		return nil, nil, err
 	}
+	oversize, err := newOversizeHandler(c.OversizePolicy)
+	if err != nil {
+		return nil, nil, c.settingError("oversize-policy", err)
+	}
+	router, streamNames, err := newSpanRouter(c.AWS.StreamName, c.Routes)
+	if err != nil {
+		return nil, nil, c.settingError("routes", err)
+	}
+	initMetrics()
+
+	var streams []*libraryStream
+	for _, name := range streamNames {
+		k, err := newSpanExporter(c, name, logger)
+		if err != nil {
+			stopLibraryStreams(c, streams)
+			return nil, nil, err
+		}
+		streams = append(streams, &libraryStream{name: name, exporter: k})
+	}
 	stopFunc := func() error {
-		k.Flush()
-		return nil
+		return stopLibraryStreams(c, streams)
 	}
-	return Exporter{k, logger}, stopFunc, nil
+	return libraryExporter{
+		name:            c.Name(),
+		streams:         streams,
+		router:          router,
+		oversize:        oversize,
+		maxBytesPerSpan: c.MaxBytesPerSpan,
+		logger:          logger,
+	}, stopFunc, nil
 }
 
 // CreateMetricsExporter creates a metrics exporter based on this config.
 func (f *Factory) CreateMetricsExporter(logger *zap.Logger, cfg configmodels.Exporter) (consumer.MetricsConsumer, exporter.StopFunc, error) {
-	return nil, nil, configerror.ErrDataTypeIsNotSupported
+	c := cfg.(*Config)
+	encode, err := newMetricsEncoder(c.Metrics.Encoding)
+	if err != nil {
+		return nil, nil, c.settingError("metrics.encoding", err)
+	}
+	partitioner, err := newMetricsPartitioner(c.Metrics.PartitionKey)
+	if err != nil {
+		return nil, nil, c.settingError("metrics.partition-key", err)
+	}
+	compress, err := newCompressor(c.Compression)
+	if err != nil {
+		return nil, nil, c.settingError("compression", err)
+	}
+
+	streamName := c.Metrics.StreamName
+	if streamName == "" {
+		streamName = c.AWS.StreamName
+	}
+	client, err := newKinesisClient(c.AWS, f.awsConfig)
+	if err != nil {
+		return nil, nil, c.settingError("aws", err)
+	}
+	pc := newProducerConfig(c, streamName)
+	pc.compress = compress
+	p, err := newProducer(client, pc, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	stopFunc := func() error {
+		return stopProducer(p, c, streamName, "metrics", logger)
+	}
+	return MetricsExporter{p, encode, partitioner, logger}, stopFunc, nil
+}
+
+// newStream creates the producer of a stream spans are routed to, with its
+// spill queue if enabled, and the function stopping them.
+func newStream(
+	c *Config,
+	client kinesisiface.KinesisAPI,
+	compress compressor,
+	streamName string,
+	logger *zap.Logger,
+) (*stream, func() error, error) {
+	pc := newProducerConfig(c, streamName)
+	pc.compress = compress
+	p, err := newProducer(client, pc, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &stream{name: streamName, producer: p}
+	stop := func() error {
+		return stopProducer(p, c, streamName, "spans", logger)
+	}
+	if c.SpillQueue.Directory != "" {
+		qc := c.SpillQueue
+		if streamName != c.AWS.StreamName {
+			// The default stream uses the configured directory, the routed
+			// streams use a sub-directory each.
+			qc.Directory = filepath.Join(qc.Directory, streamName)
+		}
+		q, err := newSpillQueue(qc, c.Name(), streamName, p, logger)
+		if err != nil {
+			p.stop()
+			return nil, nil, err
+		}
+		s.producer = q
+		stop = func() error {
+			// The queue is only closed once the producer sent or gave up
+			// on the forwarded records, the records left are kept on disk
+			// and replayed on the next start.
+			q.stopForwarding()
+			err := stopProducer(p, c, streamName, "spans", logger)
+			q.stop()
+			return err
+		}
+	}
+	return s, stop, nil
+}
+
+// stopStreams stops the streams concurrently so that the shutdown timeout
+// applies to all of them at once.
+func stopStreams(stops []func() error) error {
+	errs := make([]error, len(stops))
+	var wg sync.WaitGroup
+	wg.Add(len(stops))
+	for i, stop := range stops {
+		go func(i int, stop func() error) {
+			defer wg.Done()
+			errs[i] = stop()
+		}(i, stop)
+	}
+	wg.Wait()
+
+	var msgs []string
+	for _, err := range errs {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, "; "))
+	}
+	return nil
+}
+
+// stopProducer stops p waiting at most the configured shutdown timeout for
+// the queued records to be sent. The number of items (spans or metrics) that
+// were still not sent when the timeout expired is logged and returned in the
+// error.
+func stopProducer(p *producer, c *Config, streamName, items string, logger *zap.Logger) error {
+	unsent := p.stopWithTimeout(c.ShutdownTimeout)
+	if unsent == 0 {
+		return nil
+	}
+	logger.Error("kinesis exporter shutdown timed out before all records were sent",
+		zap.String("exporter", c.Name()),
+		zap.String("stream", streamName),
+		zap.Duration("shutdown_timeout", c.ShutdownTimeout),
+		zap.Int64("unsent_"+items, unsent))
+	return fmt.Errorf("kinesis exporter %q shutdown timed out with %d %s not sent to stream %q",
+		c.Name(), unsent, items, streamName)
 }
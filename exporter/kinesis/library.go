@@ -0,0 +1,209 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/jaegertracing/jaeger/model"
+	kinesis "github.com/omnition/opencensus-go-exporter-kinesis"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	"github.com/open-telemetry/opentelemetry-service/observability"
+	jaegertranslator "github.com/open-telemetry/opentelemetry-service/translator/trace/jaeger"
+	"go.uber.org/zap"
+)
+
+const (
+	// libraryNumWorkers and libraryFlushIntervalSeconds are the number of
+	// workers and the flush interval of the span lists of the library, the
+	// former defaults of the deprecated num-workers and flush-interval-seconds
+	// settings.
+	libraryNumWorkers           = 8
+	libraryFlushIntervalSeconds = 5
+)
+
+// spanExporter writes Jaeger spans to a Kinesis stream, it is implemented by
+// the exporter of opencensus-go-exporter-kinesis.
+type spanExporter interface {
+	ExportSpan(span *model.Span) error
+	Flush()
+}
+
+// newSpanExporter creates the library exporter writing to streamName, it is
+// replaced in tests.
+var newSpanExporter = func(c *Config, streamName string, logger *zap.Logger) (spanExporter, error) {
+	return kinesis.NewExporter(kinesis.Options{
+		Name:               c.Name(),
+		StreamName:         streamName,
+		AWSRegion:          c.AWS.Region,
+		AWSRole:            c.AWS.Role,
+		AWSKinesisEndpoint: c.AWS.KinesisEndpoint,
+
+		KPLAggregateBatchSize:   c.KPL.AggregateBatchSize,
+		KPLAggregateBatchCount:  c.KPL.AggregateBatchCount,
+		KPLBatchSize:            c.KPL.BatchSize,
+		KPLBatchCount:           c.KPL.BatchCount,
+		KPLBacklogCount:         c.KPL.BacklogCount,
+		KPLFlushIntervalSeconds: c.KPL.FlushIntervalSeconds,
+		KPLMaxConnections:       c.KPL.MaxConnections,
+		KPLMaxRetries:           c.KPL.MaxRetries,
+		KPLMaxBackoffSeconds:    c.KPL.MaxBackoffSeconds,
+
+		QueueSize:             c.QueueSize,
+		NumWorkers:            libraryNumWorkers,
+		MaxAllowedSizePerSpan: c.MaxBytesPerSpan,
+		MaxListSize:           c.MaxBytesPerBatch,
+		ListFlushInterval:     libraryFlushIntervalSeconds,
+		Encoding:              encodingJaegerProto,
+	}, logger)
+}
+
+// libraryExporter exports the spans with the jaeger-proto encoding through
+// opencensus-go-exporter-kinesis, which keeps the record layout consumers of
+// that encoding already read.
+type libraryExporter struct {
+	name string
+	// streams are the streams the spans are routed to, the first one is the
+	// default stream.
+	streams         []*libraryStream
+	router          spanRouter
+	oversize        oversizeHandler
+	maxBytesPerSpan int
+	logger          *zap.Logger
+}
+
+// libraryStream is a Kinesis stream spans are written to by the library.
+type libraryStream struct {
+	name     string
+	exporter spanExporter
+}
+
+// ConsumeTraceData receives a span batch and exports it to AWS Kinesis
+func (e libraryExporter) ConsumeTraceData(c context.Context, td consumerdata.TraceData) error {
+	c = observability.ContextWithExporterName(c, e.name)
+	route := e.router(td)
+	spans := make([][]*tracepb.Span, len(e.streams))
+	n := 0
+	for _, span := range td.Spans {
+		if span == nil {
+			continue
+		}
+		n++
+		i := route(span)
+		spans[i] = append(spans[i], span)
+	}
+	errs := newExportError(n)
+
+	for i, s := range e.streams {
+		if len(spans[i]) == 0 {
+			continue
+		}
+		tags := statsTags(e.name, s.name)
+		fitted := make([]*tracepb.Span, 0, len(spans[i]))
+		for _, span := range spans[i] {
+			span = fitSpan(c, span, e.maxBytesPerSpan, e.oversize, tags, e.logger)
+			if span == nil {
+				errs.add(errSpanTooLarge, 1)
+				continue
+			}
+			fitted = append(fitted, span)
+		}
+		if len(fitted) == 0 {
+			continue
+		}
+		pBatch, err := jaegertranslator.OCProtoToJaegerProto(consumerdata.TraceData{
+			Node:         td.Node,
+			Resource:     td.Resource,
+			Spans:        fitted,
+			SourceFormat: td.SourceFormat,
+		})
+		if err != nil {
+			errs.add(err, len(fitted))
+			continue
+		}
+		for _, span := range pBatch.GetSpans() {
+			if span.Process == nil {
+				span.Process = pBatch.Process
+			}
+			if err := s.exporter.ExportSpan(span); err != nil {
+				errs.add(err, 1)
+			}
+		}
+	}
+
+	observability.RecordTraceExporterMetrics(c, n, errs.failed)
+
+	if err := errs.err(); err != nil {
+		e.logger.Error("error exporting spans to kinesis", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// stopLibraryStreams flushes the streams, returning an error if they are not
+// all flushed within the shutdown timeout.
+func stopLibraryStreams(c *Config, streams []*libraryStream) error {
+	stops := make([]func() error, 0, len(streams))
+	for _, s := range streams {
+		s := s
+		stops = append(stops, func() error {
+			return flushWithTimeout(c, s)
+		})
+	}
+	return stopStreams(stops)
+}
+
+func flushWithTimeout(c *Config, s *libraryStream) error {
+	done := make(chan struct{})
+	go func() {
+		s.exporter.Flush()
+		close(done)
+	}()
+	if c.ShutdownTimeout <= 0 {
+		<-done
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-time.After(c.ShutdownTimeout):
+		return fmt.Errorf("kinesis exporter %q shutdown timed out before stream %q was flushed",
+			c.Name(), s.name)
+	}
+}
+
+// validateLibraryConfig rejects the settings the library does not support.
+func validateLibraryConfig(c *Config) error {
+	unsupported := ""
+	switch {
+	case c.PartitionKey != partitionKeyTraceID:
+		unsupported = "partition-key"
+	case c.Compression != compressionNone:
+		unsupported = "compression"
+	case c.SpillQueue.Directory != "":
+		unsupported = "spill-queue"
+	case c.AWS.ExternalID != "":
+		unsupported = "aws.external-id"
+	case c.AWS.Credentials != (CredentialsConfig{}):
+		unsupported = "aws.credentials"
+	}
+	if unsupported != "" {
+		return c.settingError(unsupported, fmt.Errorf("not supported with the %s encoding", encodingJaegerProto))
+	}
+	return nil
+}
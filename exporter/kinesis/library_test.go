@@ -0,0 +1,177 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeSpanExporter records the spans exported by the library exporter.
+type fakeSpanExporter struct {
+	mu      sync.Mutex
+	spans   []*model.Span
+	err     error
+	flushed bool
+}
+
+func (f *fakeSpanExporter) ExportSpan(span *model.Span) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.spans = append(f.spans, span)
+	return nil
+}
+
+func (f *fakeSpanExporter) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushed = true
+}
+
+func (f *fakeSpanExporter) spanNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for _, span := range f.spans {
+		names = append(names, span.OperationName)
+	}
+	return names
+}
+
+// withFakeSpanExporters replaces the library exporters created by the factory
+// with fakes, keyed by stream name, until the returned function is called.
+func withFakeSpanExporters() (map[string]*fakeSpanExporter, func()) {
+	exporters := map[string]*fakeSpanExporter{}
+	orig := newSpanExporter
+	newSpanExporter = func(c *Config, streamName string, logger *zap.Logger) (spanExporter, error) {
+		f := &fakeSpanExporter{}
+		exporters[streamName] = f
+		return f, nil
+	}
+	return exporters, func() { newSpanExporter = orig }
+}
+
+func TestLibraryExporter(t *testing.T) {
+	exporters, restore := withFakeSpanExporters()
+	defer restore()
+
+	factory := &Factory{}
+	cfg := factory.CreateDefaultConfig().(*Config)
+	cfg.AWS.StreamName = "test-stream"
+	cfg.Routes = []RouteConfig{{
+		StreamName:     "tenant-stream",
+		SpanAttributes: map[string]string{"tenant": "a"},
+	}}
+	tc, stopFunc, err := factory.CreateTraceExporter(zap.NewNop(), cfg)
+	require.NoError(t, err)
+	require.Len(t, exporters, 2)
+
+	td := testTraceData()
+	td.Spans[1].Attributes.AttributeMap["tenant"] = &tracepb.AttributeValue{
+		Value: &tracepb.AttributeValue_StringValue{
+			StringValue: &tracepb.TruncatableString{Value: "a"},
+		},
+	}
+	td.Spans = append(td.Spans, nil)
+	require.NoError(t, tc.ConsumeTraceData(context.Background(), td))
+
+	assert.Equal(t, []string{"first", "third"}, exporters["test-stream"].spanNames())
+	assert.Equal(t, []string{"second"}, exporters["tenant-stream"].spanNames())
+	for _, span := range exporters["test-stream"].spans {
+		require.NotNil(t, span.Process)
+		assert.Equal(t, "test-service", span.Process.ServiceName)
+	}
+
+	require.NoError(t, stopFunc())
+	assert.True(t, exporters["test-stream"].flushed)
+	assert.True(t, exporters["tenant-stream"].flushed)
+}
+
+func TestLibraryExporterErrors(t *testing.T) {
+	exporters, restore := withFakeSpanExporters()
+	defer restore()
+
+	factory := &Factory{}
+	cfg := factory.CreateDefaultConfig().(*Config)
+	cfg.AWS.StreamName = "test-stream"
+	td := testTraceData()
+	cfg.MaxBytesPerSpan = td.Spans[1].Size()
+	td.Spans[0].Name.Value = string(make([]byte, 100))
+	tc, _, err := factory.CreateTraceExporter(zap.NewNop(), cfg)
+	require.NoError(t, err)
+	exporters["test-stream"].err = errors.New("queue is full")
+
+	err = tc.ConsumeTraceData(context.Background(), td)
+	require.Error(t, err)
+	assert.Equal(t, "failed to export 3 spans (0 sent): 1 spans: "+errSpanTooLarge.Error()+"; 2 spans: queue is full", err.Error())
+}
+
+func TestLibraryExporterUnsupportedSettings(t *testing.T) {
+	_, restore := withFakeSpanExporters()
+	defer restore()
+
+	tests := []struct {
+		name    string
+		setting string
+		modify  func(cfg *Config)
+	}{
+		{
+			name:    "partition key",
+			setting: "partition-key",
+			modify:  func(cfg *Config) { cfg.PartitionKey = partitionKeyRandom },
+		},
+		{
+			name:    "compression",
+			setting: "compression",
+			modify:  func(cfg *Config) { cfg.Compression = compressionGzip },
+		},
+		{
+			name:    "spill queue",
+			setting: "spill-queue",
+			modify:  func(cfg *Config) { cfg.SpillQueue.Directory = "/var/lib/kinesis" },
+		},
+		{
+			name:    "external id",
+			setting: "aws.external-id",
+			modify:  func(cfg *Config) { cfg.AWS.ExternalID = "test-external-id" },
+		},
+		{
+			name:    "credentials",
+			setting: "aws.credentials",
+			modify:  func(cfg *Config) { cfg.AWS.Credentials.Profile = "test" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			factory := &Factory{}
+			cfg := factory.CreateDefaultConfig().(*Config)
+			tt.modify(cfg)
+			_, _, err := factory.CreateTraceExporter(zap.NewNop(), cfg)
+			require.Error(t, err)
+			assert.Equal(t, `kinesis exporter "": invalid `+tt.setting+" setting: not supported with the jaeger-proto encoding", err.Error())
+		})
+	}
+}
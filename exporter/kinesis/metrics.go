@@ -0,0 +1,210 @@
+// Copyright 2019, OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file contains the metrics recorded by the kinesis exporter.
+
+package kinesis
+
+import (
+	"sync"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Keys and stats for telemetry.
+var (
+	TagExporterNameKey, _ = tag.NewKey("exporter")
+	TagStreamNameKey, _   = tag.NewKey("stream")
+
+	StatRecordsSent = stats.Int64(
+		"kinesis_records_sent",
+		"counts the number of records written to the stream",
+		stats.UnitDimensionless)
+
+	StatBytesSent = stats.Int64(
+		"kinesis_bytes_sent",
+		"counts the bytes of the records written to the stream",
+		stats.UnitBytes)
+
+	StatBatchRecordCount = stats.Int64(
+		"kinesis_batch_records",
+		"number of records of the batches flushed by the producer",
+		stats.UnitDimensionless)
+
+	StatRecordsRetried = stats.Int64(
+		"kinesis_records_retried",
+		"counts the number of records put again after failing",
+		stats.UnitDimensionless)
+
+	StatThrottlingErrors = stats.Int64(
+		"kinesis_throttling_errors",
+		"counts the number of records rejected because the stream throughput was exceeded",
+		stats.UnitDimensionless)
+
+	StatProducerQueueDepth = stats.Int64(
+		"kinesis_producer_queue_depth",
+		"number of records waiting in the producer queue",
+		stats.UnitDimensionless)
+
+	StatPutLatency = stats.Float64(
+		"kinesis_put_latency",
+		"latency of the PutRecords calls",
+		stats.UnitMilliseconds)
+
+	StatStreamSpanCount = stats.Int64(
+		"kinesis_stream_spans",
+		"counts the number of spans written to each stream",
+		stats.UnitDimensionless)
+
+	StatTruncatedSpanCount = stats.Int64(
+		"kinesis_spans_truncated",
+		"counts the number of spans changed to fit in max-bytes-per-span",
+		stats.UnitDimensionless)
+
+	StatSpilledSpanCount = stats.Int64(
+		"kinesis_spans_spilled",
+		"counts the number of spans written to the spill queue",
+		stats.UnitDimensionless)
+
+	StatSpillQueueDepth = stats.Int64(
+		"kinesis_spill_queue_depth",
+		"number of records waiting in the spill queue",
+		stats.UnitDimensionless)
+
+	StatSpillQueueBytes = stats.Int64(
+		"kinesis_spill_queue_bytes",
+		"size of the spill queue segments on disk",
+		stats.UnitBytes)
+)
+
+var initOnce sync.Once
+
+func initMetrics() {
+	initOnce.Do(func() {
+		tagKeys := []tag.Key{
+			TagExporterNameKey,
+			TagStreamNameKey,
+		}
+		recordsSentView := &view.View{
+			Name:        StatRecordsSent.Name(),
+			Measure:     StatRecordsSent,
+			Description: "The number of records written to the stream.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		bytesSentView := &view.View{
+			Name:        StatBytesSent.Name(),
+			Measure:     StatBytesSent,
+			Description: "The bytes of the records written to the stream.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		batchesFlushedView := &view.View{
+			Name:        "kinesis_batches_flushed",
+			Measure:     StatBatchRecordCount,
+			Description: "The number of batches flushed by the producer.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Count(),
+		}
+		recordsRetriedView := &view.View{
+			Name:        StatRecordsRetried.Name(),
+			Measure:     StatRecordsRetried,
+			Description: "The number of records put again after failing.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		throttlingErrorsView := &view.View{
+			Name:        StatThrottlingErrors.Name(),
+			Measure:     StatThrottlingErrors,
+			Description: "The number of records rejected because the stream throughput was exceeded.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		producerQueueDepthView := &view.View{
+			Name:        StatProducerQueueDepth.Name(),
+			Measure:     StatProducerQueueDepth,
+			Description: "The number of records waiting in the producer queue.",
+			TagKeys:     tagKeys,
+			Aggregation: view.LastValue(),
+		}
+		putLatencyView := &view.View{
+			Name:        StatPutLatency.Name(),
+			Measure:     StatPutLatency,
+			Description: "The latency in milliseconds of the PutRecords calls.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Distribution(10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000),
+		}
+		streamSpansView := &view.View{
+			Name:        StatStreamSpanCount.Name(),
+			Measure:     StatStreamSpanCount,
+			Description: "The number of spans written to each stream.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		truncatedSpansView := &view.View{
+			Name:        StatTruncatedSpanCount.Name(),
+			Measure:     StatTruncatedSpanCount,
+			Description: "The number of spans changed to fit in max-bytes-per-span.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		spilledSpansView := &view.View{
+			Name:        StatSpilledSpanCount.Name(),
+			Measure:     StatSpilledSpanCount,
+			Description: "The number of spans written to the spill queue.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		spillQueueDepthView := &view.View{
+			Name:        StatSpillQueueDepth.Name(),
+			Measure:     StatSpillQueueDepth,
+			Description: "The number of records waiting in the spill queue.",
+			TagKeys:     tagKeys,
+			Aggregation: view.LastValue(),
+		}
+		spillQueueBytesView := &view.View{
+			Name:        StatSpillQueueBytes.Name(),
+			Measure:     StatSpillQueueBytes,
+			Description: "The size in bytes of the spill queue segments on disk.",
+			TagKeys:     tagKeys,
+			Aggregation: view.LastValue(),
+		}
+
+		view.Register(
+			recordsSentView,
+			bytesSentView,
+			batchesFlushedView,
+			recordsRetriedView,
+			throttlingErrorsView,
+			producerQueueDepthView,
+			putLatencyView,
+			streamSpansView,
+			truncatedSpansView,
+			spilledSpansView,
+			spillQueueDepthView,
+			spillQueueBytesView)
+	})
+}
+
+// statsTags creates the tag.Mutators that add metric labels with the
+// exporterName and streamName via stats.RecordWithTags. This ensures
+// uniformity of labels for the metrics.
+func statsTags(exporterName, streamName string) []tag.Mutator {
+	return []tag.Mutator{
+		tag.Upsert(TagExporterNameKey, exporterName),
+		tag.Upsert(TagStreamNameKey, streamName),
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	"go.uber.org/zap"
+)
+
+// MetricsExporter implements an OpenTelemetry metrics exporter that exports
+// all metrics to AWS Kinesis
+type MetricsExporter struct {
+	producer    *producer
+	encode      metricsEncoder
+	partitioner metricsPartitioner
+	logger      *zap.Logger
+}
+
+// ConsumeMetricsData receives a metrics batch and exports it to AWS Kinesis
+func (e MetricsExporter) ConsumeMetricsData(c context.Context, md consumerdata.MetricsData) error {
+	if len(md.Metrics) == 0 {
+		return nil
+	}
+	key := e.partitioner(md)
+	return e.export(md, key)
+}
+
+// export encodes the batch into a single record, splitting it in halves
+// until each part fits in a Kinesis record.
+func (e MetricsExporter) export(md consumerdata.MetricsData, key string) error {
+	data, err := e.encode(md)
+	if err != nil {
+		e.logger.Error("error encoding metrics batch", zap.Error(err))
+		return err
+	}
+
+	if len(data)+len(key) > maxRecordSize {
+		if len(md.Metrics) == 1 {
+			err := fmt.Errorf("metric %q is too large to be exported to kinesis (%d bytes)",
+				md.Metrics[0].GetMetricDescriptor().GetName(), len(data))
+			e.logger.Error("error exporting metrics to kinesis", zap.Error(err))
+			return err
+		}
+		half := len(md.Metrics) / 2
+		first, second := md, md
+		first.Metrics = md.Metrics[:half]
+		second.Metrics = md.Metrics[half:]
+		err = e.export(first, key)
+		if serr := e.export(second, key); err == nil {
+			err = serr
+		}
+		return err
+	}
+
+	if err := e.producer.put(data, key, len(md.Metrics)); err != nil {
+		e.logger.Error("error exporting metrics to kinesis", zap.Error(err))
+		return err
+	}
+	return nil
+}
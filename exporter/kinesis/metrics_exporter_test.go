@@ -0,0 +1,125 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agentmetricspb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/metrics/v1"
+	metricspb "github.com/census-instrumentation/opencensus-proto/gen-go/metrics/v1"
+	"github.com/gogo/protobuf/types"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func testMetricsData() consumerdata.MetricsData {
+	return consumerdata.MetricsData{
+		Node: &commonpb.Node{
+			ServiceInfo: &commonpb.ServiceInfo{Name: "test-service"},
+			Identifier:  &commonpb.ProcessIdentifier{HostName: "test-host"},
+		},
+		Metrics: []*metricspb.Metric{
+			{
+				MetricDescriptor: &metricspb.MetricDescriptor{
+					Name: "requests",
+					Type: metricspb.MetricDescriptor_CUMULATIVE_INT64,
+				},
+				Timeseries: []*metricspb.TimeSeries{
+					{
+						Points: []*metricspb.Point{
+							{
+								Timestamp: &types.Timestamp{Seconds: 1544712660},
+								Value:     &metricspb.Point_Int64Value{Int64Value: 42},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newTestMetricsExporter(t *testing.T, fk *fakeKinesis, encoding, partitionKey string) (MetricsExporter, *producer) {
+	encode, err := newMetricsEncoder(encoding)
+	require.NoError(t, err)
+	partitioner, err := newMetricsPartitioner(partitionKey)
+	require.NoError(t, err)
+	p, err := newProducer(fk, testProducerConfig(), zap.NewNop())
+	require.NoError(t, err)
+	return MetricsExporter{p, encode, partitioner, zap.NewNop()}, p
+}
+
+func TestMetricsExporterOCProto(t *testing.T) {
+	fk := newFakeKinesis(2)
+	e, p := newTestMetricsExporter(t, fk, encodingOCProto, partitionKeyServiceName)
+
+	md := testMetricsData()
+	require.NoError(t, e.ConsumeMetricsData(context.Background(), md))
+	p.stop()
+
+	records := fk.userRecords(t)
+	require.Len(t, records, 1)
+	assert.Equal(t, "test-service", records[0].partitionKey)
+
+	got := &agentmetricspb.ExportMetricsServiceRequest{}
+	require.NoError(t, proto.Unmarshal(records[0].data, got))
+	assert.Equal(t, md.Node.ServiceInfo.Name, got.Node.ServiceInfo.Name)
+	require.Len(t, got.Metrics, 1)
+	assert.Equal(t, "requests", got.Metrics[0].MetricDescriptor.Name)
+}
+
+func TestMetricsExporterOCJSON(t *testing.T) {
+	fk := newFakeKinesis(1)
+	e, p := newTestMetricsExporter(t, fk, encodingOCJSON, partitionKeyHostName)
+
+	require.NoError(t, e.ConsumeMetricsData(context.Background(), testMetricsData()))
+	p.stop()
+
+	records := fk.userRecords(t)
+	require.Len(t, records, 1)
+	assert.Equal(t, "test-host", records[0].partitionKey)
+	// The timestamps use the JSON mapping of the well-known types.
+	assert.Contains(t, string(records[0].data), `"timestamp":"2018-12-13T14:51:00Z"`)
+
+	// The OpenCensus enums are only registered with golang/protobuf, which
+	// the consumers decode them with.
+	got := &agentmetricspb.ExportMetricsServiceRequest{}
+	require.NoError(t, jsonpb.Unmarshal(bytes.NewReader(records[0].data), got))
+	require.Len(t, got.Metrics, 1)
+	assert.Equal(t, "requests", got.Metrics[0].MetricDescriptor.Name)
+}
+
+func TestMetricsExporterEmptyBatch(t *testing.T) {
+	fk := newFakeKinesis(1)
+	e, p := newTestMetricsExporter(t, fk, encodingOCProto, partitionKeyRandom)
+
+	require.NoError(t, e.ConsumeMetricsData(context.Background(), consumerdata.MetricsData{}))
+	p.stop()
+	assert.Empty(t, fk.userRecords(t))
+}
+
+func TestMetricsExporterInvalidConfig(t *testing.T) {
+	_, err := newMetricsEncoder("jaeger-proto")
+	assert.Error(t, err)
+	_, err = newMetricsPartitioner("trace-id")
+	assert.Error(t, err)
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/zap"
+)
+
+// viewData returns the data recorded by the view for the exporter, or nil if
+// there is none.
+func viewData(t *testing.T, viewName, exporterName string) view.AggregationData {
+	rows, err := view.RetrieveData(viewName)
+	require.NoError(t, err)
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key == TagExporterNameKey && tag.Value == exporterName {
+				return row.Data
+			}
+		}
+	}
+	return nil
+}
+
+// viewValue returns the value of a Sum or Count view, or the count of a
+// Distribution view, for the exporter.
+func viewValue(t *testing.T, viewName, exporterName string) float64 {
+	switch data := viewData(t, viewName, exporterName).(type) {
+	case *view.SumData:
+		return data.Value
+	case *view.CountData:
+		return float64(data.Value)
+	case *view.DistributionData:
+		return float64(data.Count)
+	}
+	return 0
+}
+
+func TestProducerMetrics(t *testing.T) {
+	fk := newFakeKinesis(1)
+	fk.failures = 1
+	cfg := testProducerConfig()
+	cfg.exporterName = "kinesis/producer-metrics"
+	cfg.maxRetries = 2
+	cfg.maxBackoff = time.Millisecond
+	p, err := newProducer(fk, cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	views := []string{
+		StatRecordsSent.Name(),
+		StatBytesSent.Name(),
+		StatRecordsRetried.Name(),
+		StatThrottlingErrors.Name(),
+		"kinesis_batches_flushed",
+		StatPutLatency.Name(),
+	}
+	before := map[string]float64{}
+	for _, name := range views {
+		before[name] = viewValue(t, name, cfg.exporterName)
+	}
+
+	require.NoError(t, p.put([]byte("a"), "a", 1))
+	require.NoError(t, p.put([]byte("b"), "b", 1))
+	p.stop()
+
+	// The two records are aggregated, throttled once and sent on the retry.
+	require.Len(t, fk.entries, 1)
+	want := map[string]float64{
+		StatRecordsSent.Name():      1,
+		StatBytesSent.Name():        float64(len(fk.entries[0].Data)),
+		StatRecordsRetried.Name():   1,
+		StatThrottlingErrors.Name(): 1,
+		"kinesis_batches_flushed":   1,
+		// Both attempts are timed.
+		StatPutLatency.Name(): 2,
+	}
+	for _, name := range views {
+		assert.Equal(t, want[name], viewValue(t, name, cfg.exporterName)-before[name], name)
+	}
+}
+
+func TestProducerQueueDepthMetric(t *testing.T) {
+	cfg := testProducerConfig()
+	cfg.exporterName = "kinesis/queue-depth"
+	cfg.flushInterval = time.Millisecond
+	p, err := newProducer(newFakeKinesis(1), cfg, zap.NewNop())
+	require.NoError(t, err)
+	defer p.stop()
+
+	// The depth is recorded on every flush interval.
+	for i := 0; viewData(t, StatProducerQueueDepth.Name(), cfg.exporterName) == nil; i++ {
+		require.True(t, i < 1000, "queue depth not recorded")
+		time.Sleep(time.Millisecond)
+	}
+}
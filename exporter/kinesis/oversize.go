@@ -0,0 +1,200 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+)
+
+const (
+	oversizePolicyDrop     = "drop"
+	oversizePolicyTruncate = "truncate"
+	oversizePolicyStrip    = "strip"
+
+	// originalSizeAttribute is added to the spans changed to fit in
+	// max-bytes-per-span, with the size of the span before the change.
+	originalSizeAttribute = "kinesis.original_size"
+
+	// String attributes are not truncated below this length, it is better
+	// to drop other attributes and annotations first.
+	minTruncatedStringLength = 128
+)
+
+// oversizeHandler returns a copy of a span larger than maxSize changed so it
+// fits in maxSize, or nil if the span has to be dropped. The span passed in
+// is never modified since it can be shared with other exporters.
+type oversizeHandler func(span *tracepb.Span, maxSize int) *tracepb.Span
+
+func newOversizeHandler(policy string) (oversizeHandler, error) {
+	switch policy {
+	case oversizePolicyDrop:
+		return func(*tracepb.Span, int) *tracepb.Span {
+			return nil
+		}, nil
+	case oversizePolicyTruncate:
+		return truncateSpan, nil
+	case oversizePolicyStrip:
+		return stripSpan, nil
+	}
+	return nil, fmt.Errorf("unsupported oversize policy %q", policy)
+}
+
+// truncateSpan shortens the longest string attributes, then drops the time
+// events, newest first, and finally the largest attributes until the span
+// fits.
+func truncateSpan(span *tracepb.Span, maxSize int) *tracepb.Span {
+	s := *span
+	attrs := copyAttributes(span.Attributes)
+	s.Attributes = attrs
+	if span.TimeEvents != nil {
+		events := *span.TimeEvents
+		events.TimeEvent = append([]*tracepb.Span_TimeEvent(nil), span.TimeEvents.TimeEvent...)
+		s.TimeEvents = &events
+	}
+	attrs.AttributeMap[originalSizeAttribute] = &tracepb.AttributeValue{
+		Value: &tracepb.AttributeValue_IntValue{IntValue: int64(span.Size())},
+	}
+
+	for size := s.Size(); size > maxSize; size = s.Size() {
+		if key, value := longestString(attrs); value != nil && len(value.Value) > minTruncatedStringLength {
+			keep := len(value.Value) - (size - maxSize)
+			if keep < minTruncatedStringLength {
+				keep = minTruncatedStringLength
+			}
+			attrs.AttributeMap[key] = truncateString(value, keep)
+			continue
+		}
+		if s.TimeEvents != nil && len(s.TimeEvents.TimeEvent) > 0 {
+			dropLastTimeEvent(s.TimeEvents)
+			continue
+		}
+		if key := largestAttribute(attrs); key != "" {
+			delete(attrs.AttributeMap, key)
+			attrs.DroppedAttributesCount++
+			continue
+		}
+		return nil
+	}
+	return &s
+}
+
+// stripSpan keeps the skeleton of the span, dropping its attributes, time
+// events, links and stack trace.
+func stripSpan(span *tracepb.Span, maxSize int) *tracepb.Span {
+	s := *span
+	s.Attributes = &tracepb.Span_Attributes{
+		AttributeMap: map[string]*tracepb.AttributeValue{
+			originalSizeAttribute: {
+				Value: &tracepb.AttributeValue_IntValue{IntValue: int64(span.Size())},
+			},
+		},
+		DroppedAttributesCount: int32(len(span.GetAttributes().GetAttributeMap())) +
+			span.GetAttributes().GetDroppedAttributesCount(),
+	}
+	if span.TimeEvents != nil {
+		s.TimeEvents = &tracepb.Span_TimeEvents{
+			DroppedAnnotationsCount:   span.TimeEvents.DroppedAnnotationsCount,
+			DroppedMessageEventsCount: span.TimeEvents.DroppedMessageEventsCount,
+		}
+		for _, event := range span.TimeEvents.TimeEvent {
+			countDroppedTimeEvent(s.TimeEvents, event)
+		}
+	}
+	if span.Links != nil {
+		s.Links = &tracepb.Span_Links{
+			DroppedLinksCount: int32(len(span.Links.Link)) + span.Links.DroppedLinksCount,
+		}
+	}
+	s.StackTrace = nil
+
+	if s.Size() > maxSize {
+		return nil
+	}
+	return &s
+}
+
+func copyAttributes(attrs *tracepb.Span_Attributes) *tracepb.Span_Attributes {
+	c := &tracepb.Span_Attributes{
+		AttributeMap: make(map[string]*tracepb.AttributeValue, len(attrs.GetAttributeMap())+1),
+	}
+	if attrs != nil {
+		c.DroppedAttributesCount = attrs.DroppedAttributesCount
+		for k, v := range attrs.AttributeMap {
+			c.AttributeMap[k] = v
+		}
+	}
+	return c
+}
+
+// longestString returns the string attribute with the longest value.
+func longestString(attrs *tracepb.Span_Attributes) (string, *tracepb.TruncatableString) {
+	var longestKey string
+	var longest *tracepb.TruncatableString
+	for key, value := range attrs.AttributeMap {
+		if s := value.GetStringValue(); s != nil && (longest == nil || len(s.Value) > len(longest.Value)) {
+			longestKey, longest = key, s
+		}
+	}
+	return longestKey, longest
+}
+
+// largestAttribute returns the key of the largest attribute, not counting
+// the original size one.
+func largestAttribute(attrs *tracepb.Span_Attributes) string {
+	var largestKey string
+	largestSize := -1
+	for key, value := range attrs.AttributeMap {
+		if key == originalSizeAttribute {
+			continue
+		}
+		if size := len(key) + value.Size(); size > largestSize {
+			largestKey, largestSize = key, size
+		}
+	}
+	return largestKey
+}
+
+// truncateString returns a string attribute with the value cut to at most
+// n bytes, without splitting UTF-8 characters.
+func truncateString(s *tracepb.TruncatableString, n int) *tracepb.AttributeValue {
+	for n > 0 && !utf8.RuneStart(s.Value[n]) {
+		n--
+	}
+	return &tracepb.AttributeValue{
+		Value: &tracepb.AttributeValue_StringValue{
+			StringValue: &tracepb.TruncatableString{
+				Value:              s.Value[:n],
+				TruncatedByteCount: s.TruncatedByteCount + int32(len(s.Value)-n),
+			},
+		},
+	}
+}
+
+func dropLastTimeEvent(events *tracepb.Span_TimeEvents) {
+	last := events.TimeEvent[len(events.TimeEvent)-1]
+	events.TimeEvent = events.TimeEvent[:len(events.TimeEvent)-1]
+	countDroppedTimeEvent(events, last)
+}
+
+func countDroppedTimeEvent(events *tracepb.Span_TimeEvents, event *tracepb.Span_TimeEvent) {
+	if event.GetMessageEvent() != nil {
+		events.DroppedMessageEventsCount++
+	} else {
+		events.DroppedAnnotationsCount++
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func stringAttribute(value string) *tracepb.AttributeValue {
+	return &tracepb.AttributeValue{
+		Value: &tracepb.AttributeValue_StringValue{
+			StringValue: &tracepb.TruncatableString{Value: value},
+		},
+	}
+}
+
+func annotations(n int, description string) *tracepb.Span_TimeEvents {
+	events := &tracepb.Span_TimeEvents{}
+	for i := 0; i < n; i++ {
+		events.TimeEvent = append(events.TimeEvent, &tracepb.Span_TimeEvent{
+			Value: &tracepb.Span_TimeEvent_Annotation_{
+				Annotation: &tracepb.Span_TimeEvent_Annotation{
+					Description: &tracepb.TruncatableString{Value: description},
+				},
+			},
+		})
+	}
+	return events
+}
+
+// largeSpan returns a span with a large DB statement attribute and many
+// annotations.
+func largeSpan() *tracepb.Span {
+	span := testSpan(testTraceID1, 1, "query")
+	span.Attributes.AttributeMap["db.statement"] = stringAttribute(strings.Repeat("SELECT 1; ", 500))
+	span.TimeEvents = annotations(20, "row fetched")
+	span.Links = &tracepb.Span_Links{
+		Link: []*tracepb.Span_Link{{TraceId: testTraceID2, SpanId: []byte{0, 0, 0, 0, 0, 0, 0, 9}}},
+	}
+	return span
+}
+
+func TestTruncateSpanShortensStrings(t *testing.T) {
+	span := largeSpan()
+	size := span.Size()
+
+	got := truncateSpan(span, 1000)
+	require.NotNil(t, got)
+	assert.True(t, got.Size() <= 1000)
+
+	statement := got.Attributes.AttributeMap["db.statement"].GetStringValue()
+	assert.True(t, strings.HasPrefix(strings.Repeat("SELECT 1; ", 500), statement.Value))
+	assert.Equal(t, int32(5000-len(statement.Value)), statement.TruncatedByteCount)
+	assert.Equal(t, int64(size), got.Attributes.AttributeMap[originalSizeAttribute].GetIntValue())
+	// The annotations are kept when shortening strings is enough.
+	assert.Len(t, got.TimeEvents.TimeEvent, 20)
+
+	// The original span is not changed.
+	assert.Equal(t, size, span.Size())
+	assert.NotContains(t, span.Attributes.AttributeMap, originalSizeAttribute)
+}
+
+func TestTruncateSpanDropsAnnotationsAndAttributes(t *testing.T) {
+	span := largeSpan()
+
+	// The statement alone can't be shortened enough.
+	got := truncateSpan(span, 400)
+	require.NotNil(t, got)
+	assert.True(t, got.Size() <= 400)
+	assert.Equal(t, minTruncatedStringLength, len(got.Attributes.AttributeMap["db.statement"].GetStringValue().Value))
+	assert.True(t, got.TimeEvents.DroppedAnnotationsCount > 0)
+	assert.Equal(t, 20, len(got.TimeEvents.TimeEvent)+int(got.TimeEvents.DroppedAnnotationsCount))
+	assert.Equal(t, int32(0), got.Attributes.DroppedAttributesCount)
+	assert.Len(t, span.TimeEvents.TimeEvent, 20)
+
+	// Attributes are dropped last, largest first.
+	got = truncateSpan(span, 150)
+	require.NotNil(t, got)
+	assert.True(t, got.Size() <= 150)
+	assert.Empty(t, got.TimeEvents.TimeEvent)
+	assert.NotContains(t, got.Attributes.AttributeMap, "db.statement")
+	assert.True(t, got.Attributes.DroppedAttributesCount > 0)
+	assert.Contains(t, got.Attributes.AttributeMap, originalSizeAttribute)
+}
+
+func TestTruncateSpanTooLarge(t *testing.T) {
+	span := largeSpan()
+	span.Name.Value = strings.Repeat("x", 2000)
+	assert.Nil(t, truncateSpan(span, 1000))
+}
+
+func TestStripSpan(t *testing.T) {
+	span := largeSpan()
+	size := span.Size()
+
+	got := stripSpan(span, 1000)
+	require.NotNil(t, got)
+	assert.Equal(t, span.TraceId, got.TraceId)
+	assert.Equal(t, span.SpanId, got.SpanId)
+	assert.Equal(t, span.Name, got.Name)
+	assert.Equal(t, span.StartTime, got.StartTime)
+	assert.Equal(t, map[string]*tracepb.AttributeValue{
+		originalSizeAttribute: {Value: &tracepb.AttributeValue_IntValue{IntValue: int64(size)}},
+	}, got.Attributes.AttributeMap)
+	assert.Equal(t, int32(2), got.Attributes.DroppedAttributesCount)
+	assert.Equal(t, int32(20), got.TimeEvents.DroppedAnnotationsCount)
+	assert.Equal(t, int32(1), got.Links.DroppedLinksCount)
+	assert.Equal(t, size, span.Size())
+
+	span.Name.Value = strings.Repeat("x", 2000)
+	assert.Nil(t, stripSpan(span, 1000))
+}
+
+func TestOversizePolicies(t *testing.T) {
+	drop, err := newOversizeHandler(oversizePolicyDrop)
+	require.NoError(t, err)
+	assert.Nil(t, drop(largeSpan(), 1000))
+
+	_, err = newOversizeHandler("split")
+	assert.Error(t, err)
+}
+
+func TestExporterTruncatesSpans(t *testing.T) {
+	initMetrics()
+	fk := newFakeKinesis(1)
+	e, p := newTestExporter(t, fk, encodingOCProto)
+	e.name = "kinesis/truncate"
+	e.maxBytesPerSpan = 1000
+	e.oversize = truncateSpan
+	before := truncatedSpans(t, e.name)
+
+	td := testTraceData()
+	td.Spans = []*tracepb.Span{largeSpan()}
+	require.NoError(t, e.ConsumeTraceData(context.Background(), td))
+	p.stop()
+
+	records := fk.userRecords(t)
+	require.Len(t, records, 1)
+	req := &agenttracepb.ExportTraceServiceRequest{}
+	require.NoError(t, proto.Unmarshal(records[0].data, req))
+	require.Len(t, req.Spans, 1)
+	assert.Contains(t, req.Spans[0].Attributes.AttributeMap, originalSizeAttribute)
+
+	assert.Equal(t, before+1, truncatedSpans(t, e.name))
+}
+
+// truncatedSpans returns the number of spans truncated by the exporter so far.
+func truncatedSpans(t *testing.T, exporterName string) float64 {
+	return viewValue(t, StatTruncatedSpanCount.Name(), exporterName)
+}
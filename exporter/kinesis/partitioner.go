@@ -0,0 +1,144 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+
+	"github.com/Omnition/omnition-opentelemetry-service/internal/attributes"
+)
+
+const (
+	partitionKeyRandom        = "random"
+	partitionKeyServiceName   = "service-name"
+	partitionKeyHostName      = "host-name"
+	partitionKeyTraceID       = "trace-id"
+	partitionKeySpanAttribute = "span-attribute"
+
+	// Kinesis rejects partition keys longer than this.
+	maxPartitionKeyLength = 256
+)
+
+// metricsPartitioner returns the partition key of a batch of metrics.
+type metricsPartitioner func(md consumerdata.MetricsData) string
+
+func newMetricsPartitioner(partitionKey string) (metricsPartitioner, error) {
+	switch partitionKey {
+	case partitionKeyRandom:
+		return func(consumerdata.MetricsData) string {
+			return randomPartitionKey()
+		}, nil
+	case partitionKeyServiceName:
+		return func(md consumerdata.MetricsData) string {
+			return partitionKeyOrRandom(serviceName(md.Node))
+		}, nil
+	case partitionKeyHostName:
+		return func(md consumerdata.MetricsData) string {
+			return partitionKeyOrRandom(hostName(md.Node))
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported metrics partition key %q", partitionKey)
+}
+
+// spanPartitioner returns the function computing the partition key of every
+// span of a batch. Keys that can't be computed from the span itself, like
+// random keys, are shared by all the spans of the batch so they are still
+// aggregated together.
+type spanPartitioner func(td consumerdata.TraceData) func(span *tracepb.Span) string
+
+func newSpanPartitioner(partitionKey, attribute string) (spanPartitioner, error) {
+	switch partitionKey {
+	case partitionKeyTraceID:
+		return func(consumerdata.TraceData) func(*tracepb.Span) string {
+			fallback := randomPartitionKey()
+			return func(span *tracepb.Span) string {
+				return partitionKeyOr(hex.EncodeToString(span.TraceId), fallback)
+			}
+		}, nil
+	case partitionKeyServiceName:
+		return func(td consumerdata.TraceData) func(*tracepb.Span) string {
+			key := partitionKeyOrRandom(serviceName(td.Node))
+			return func(*tracepb.Span) string {
+				return key
+			}
+		}, nil
+	case partitionKeySpanAttribute:
+		if attribute == "" {
+			return nil, errors.New("partition-key-attribute must be set when partitioning by span attribute")
+		}
+		return func(consumerdata.TraceData) func(*tracepb.Span) string {
+			fallback := randomPartitionKey()
+			return func(span *tracepb.Span) string {
+				value := span.GetAttributes().GetAttributeMap()[attribute]
+				return partitionKeyOr(attributes.ValueString(value), fallback)
+			}
+		}, nil
+	case partitionKeyRandom:
+		return func(consumerdata.TraceData) func(*tracepb.Span) string {
+			key := randomPartitionKey()
+			return func(*tracepb.Span) string {
+				return key
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported trace partition key %q", partitionKey)
+}
+
+func randomPartitionKey() string {
+	return strconv.FormatUint(rand.Uint64(), 36)
+}
+
+// partitionKeyOrRandom makes sure key can be used as a partition key, falling
+// back to a random key when it is empty.
+func partitionKeyOrRandom(key string) string {
+	if key == "" {
+		return randomPartitionKey()
+	}
+	return partitionKeyOr(key, "")
+}
+
+// partitionKeyOr is like partitionKeyOrRandom but falls back to the given
+// key.
+func partitionKeyOr(key, fallback string) string {
+	if key == "" {
+		return fallback
+	}
+	if len(key) > maxPartitionKeyLength {
+		return key[:maxPartitionKeyLength]
+	}
+	return key
+}
+
+func serviceName(node *commonpb.Node) string {
+	if node == nil || node.ServiceInfo == nil {
+		return ""
+	}
+	return node.ServiceInfo.Name
+}
+
+func hostName(node *commonpb.Node) string {
+	if node == nil || node.Identifier == nil {
+		return ""
+	}
+	return node.Identifier.HostName
+}
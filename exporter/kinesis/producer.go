@@ -0,0 +1,547 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awskinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.uber.org/zap"
+)
+
+const (
+	// Limits imposed by the Kinesis PutRecords API.
+	maxRecordSize = 1024 * 1024
+	maxBatchCount = 500
+	maxBatchSize  = 5 * 1024 * 1024
+
+	defaultAggregateBatchCount = math.MaxInt32
+	defaultAggregateBatchSize  = 51200
+	defaultBacklogCount        = 2000
+	defaultFlushInterval       = 5 * time.Second
+	defaultMaxConnections      = 24
+	defaultMaxBackoff          = 5 * time.Second
+	defaultQueueSize           = 100000
+
+	minBackoff = 100 * time.Millisecond
+)
+
+var (
+	errQueueFull       = errors.New("kinesis producer queue is full")
+	errProducerStopped = errors.New("kinesis producer is stopped")
+	errNoOpenShards    = errors.New("kinesis stream has no open shards")
+)
+
+// producerConfig holds the settings of a producer, it is built from the KPL
+// section of the exporter config.
+type producerConfig struct {
+	exporterName        string
+	streamName          string
+	queueSize           int
+	aggregateBatchCount int
+	aggregateBatchSize  int
+	batchCount          int
+	batchSize           int
+	backlogCount        int
+	flushInterval       time.Duration
+	maxConnections      int
+	maxRetries          int
+	maxBackoff          time.Duration
+	// compress is applied to every record before it is sent, nil when the
+	// records are not compressed.
+	compress compressor
+}
+
+// newProducerConfig returns the producer settings for the given stream,
+// replacing unset values with defaults and capping values to the Kinesis
+// API limits.
+func newProducerConfig(c *Config, streamName string) producerConfig {
+	pc := producerConfig{
+		exporterName:        c.Name(),
+		streamName:          streamName,
+		queueSize:           valueOrDefault(c.QueueSize, defaultQueueSize),
+		aggregateBatchCount: valueOrDefault(c.KPL.AggregateBatchCount, defaultAggregateBatchCount),
+		aggregateBatchSize:  valueOrDefault(c.KPL.AggregateBatchSize, defaultAggregateBatchSize),
+		batchCount:          valueOrDefault(c.KPL.BatchCount, maxBatchCount),
+		batchSize:           valueOrDefault(c.KPL.BatchSize, maxBatchSize),
+		backlogCount:        valueOrDefault(c.KPL.BacklogCount, defaultBacklogCount),
+		flushInterval:       time.Duration(c.KPL.FlushIntervalSeconds) * time.Second,
+		maxConnections:      valueOrDefault(c.KPL.MaxConnections, defaultMaxConnections),
+		maxRetries:          c.KPL.MaxRetries,
+		maxBackoff:          time.Duration(c.KPL.MaxBackoffSeconds) * time.Second,
+	}
+	if pc.flushInterval <= 0 {
+		pc.flushInterval = defaultFlushInterval
+	}
+	if pc.maxBackoff <= 0 {
+		pc.maxBackoff = defaultMaxBackoff
+	}
+	if pc.aggregateBatchSize > maxRecordSize {
+		pc.aggregateBatchSize = maxRecordSize
+	}
+	if pc.batchCount > maxBatchCount {
+		pc.batchCount = maxBatchCount
+	}
+	if pc.batchSize > maxBatchSize {
+		pc.batchSize = maxBatchSize
+	}
+	return pc
+}
+
+func valueOrDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// shard is an open shard of the stream. Records are routed to shards the
+// same way Kinesis does it, using the MD5 hash of the partition key, so that
+// records sharing a shard can be aggregated.
+type shard struct {
+	id              string
+	startingHashKey *big.Int
+	endingHashKey   *big.Int
+	agg             *aggregator
+}
+
+// entry is a Kinesis record with the number of items of the user records it
+// holds and their done callbacks.
+type entry struct {
+	*awskinesis.PutRecordsRequestEntry
+	items int
+	dones []func(error)
+}
+
+func newEntry(r *record) *entry {
+	e := &entry{
+		PutRecordsRequestEntry: &awskinesis.PutRecordsRequestEntry{
+			Data:         r.data,
+			PartitionKey: aws.String(r.partitionKey),
+		},
+		items: r.items,
+	}
+	if r.done != nil {
+		e.dones = []func(error){r.done}
+	}
+	return e
+}
+
+// done reports the outcome of sending the entry to its user records.
+func (e *entry) done(err error) {
+	for _, done := range e.dones {
+		done(err)
+	}
+}
+
+func entriesDone(entries []*entry, err error) {
+	for _, e := range entries {
+		e.done(err)
+	}
+}
+
+func countItems(entries []*entry) int64 {
+	var n int64
+	for _, e := range entries {
+		n += int64(e.items)
+	}
+	return n
+}
+
+func countBytes(entries []*entry) int64 {
+	var n int64
+	for _, e := range entries {
+		n += int64(len(e.Data))
+	}
+	return n
+}
+
+// producer batches and aggregates records and writes them to a Kinesis
+// stream using the PutRecords API.
+type producer struct {
+	// pending is the number of items put that were not sent nor dropped
+	// yet. It is accessed atomically and kept first for 64-bit alignment.
+	pending int64
+
+	client kinesisiface.KinesisAPI
+	cfg    producerConfig
+	logger *zap.Logger
+
+	shards []*shard
+
+	records chan *record
+	batches chan []*entry
+
+	// batch and batchBytes are only accessed by the loop goroutine.
+	batch      []*entry
+	batchBytes int
+
+	// ctx is canceled to abort sending when the producer doesn't stop in
+	// time.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// statsCtx holds the tags the producer metrics are recorded with.
+	statsCtx context.Context
+
+	mu      sync.RWMutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// newProducer creates and starts a producer for the configured stream.
+func newProducer(client kinesisiface.KinesisAPI, cfg producerConfig, logger *zap.Logger) (*producer, error) {
+	shards, err := listShards(client, cfg.streamName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shards of kinesis stream %q: %v", cfg.streamName, err)
+	}
+
+	p := &producer{
+		client:  client,
+		cfg:     cfg,
+		logger:  logger,
+		shards:  shards,
+		records: make(chan *record, cfg.queueSize),
+		batches: make(chan []*entry, cfg.backlogCount),
+	}
+	initMetrics()
+	p.statsCtx, err = tag.New(context.Background(), statsTags(cfg.exporterName, cfg.streamName)...)
+	if err != nil {
+		return nil, err
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	p.wg.Add(1 + cfg.maxConnections)
+	go p.loop()
+	for i := 0; i < cfg.maxConnections; i++ {
+		go p.send()
+	}
+	return p, nil
+}
+
+func listShards(client kinesisiface.KinesisAPI, streamName string) ([]*shard, error) {
+	var shards []*shard
+	input := &awskinesis.ListShardsInput{StreamName: aws.String(streamName)}
+	for {
+		out, err := client.ListShards(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range out.Shards {
+			if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+				// Closed shards can't receive records.
+				continue
+			}
+			start, ok := new(big.Int).SetString(aws.StringValue(s.HashKeyRange.StartingHashKey), 10)
+			if !ok {
+				return nil, fmt.Errorf("invalid starting hash key for shard %q", aws.StringValue(s.ShardId))
+			}
+			end, ok := new(big.Int).SetString(aws.StringValue(s.HashKeyRange.EndingHashKey), 10)
+			if !ok {
+				return nil, fmt.Errorf("invalid ending hash key for shard %q", aws.StringValue(s.ShardId))
+			}
+			shards = append(shards, &shard{
+				id:              aws.StringValue(s.ShardId),
+				startingHashKey: start,
+				endingHashKey:   end,
+				agg:             newAggregator(start.String()),
+			})
+		}
+		if out.NextToken == nil {
+			break
+		}
+		input = &awskinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+	if len(shards) == 0 {
+		return nil, errNoOpenShards
+	}
+	return shards, nil
+}
+
+// put queues a record holding items spans or metrics to be sent to the
+// stream. It doesn't block, if the queue is full errQueueFull is returned.
+func (p *producer) put(data []byte, partitionKey string, items int) error {
+	return p.putAsync(data, partitionKey, items, nil)
+}
+
+// putAsync is put with done called once the record was written to the
+// stream, with nil, or failed to be, with the error. It is only called when
+// the record was queued.
+func (p *producer) putAsync(data []byte, partitionKey string, items int, done func(error)) error {
+	if p.cfg.compress != nil {
+		// Every user record is compressed on its own, before aggregation, so
+		// the aggregated records keep the KPL format consumers de-aggregate.
+		data = p.cfg.compress(data)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		return errProducerStopped
+	}
+	select {
+	case p.records <- &record{data: data, partitionKey: partitionKey, items: items, done: done}:
+		atomic.AddInt64(&p.pending, int64(items))
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// stop flushes all queued records and waits for them to be sent.
+func (p *producer) stop() {
+	p.stopWithTimeout(0)
+}
+
+// stopWithTimeout flushes all queued records and waits at most timeout for
+// them to be sent, without limit if timeout is 0. When the timeout expires
+// sending is aborted and the number of items that were not sent is returned.
+func (p *producer) stopWithTimeout(timeout time.Duration) int64 {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return 0
+	}
+	p.stopped = true
+	close(p.records)
+	p.mu.Unlock()
+	defer p.cancel()
+
+	if timeout <= 0 {
+		p.wg.Wait()
+		return 0
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return 0
+	case <-timer.C:
+		return atomic.LoadInt64(&p.pending)
+	}
+}
+
+// loop aggregates and batches the queued records until the producer is
+// stopped.
+func (p *producer) loop() {
+	defer p.wg.Done()
+	defer close(p.batches)
+
+	ticker := time.NewTicker(p.cfg.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case r, ok := <-p.records:
+			if !ok {
+				p.flush()
+				return
+			}
+			p.add(r)
+		case <-ticker.C:
+			p.flush()
+			stats.Record(p.statsCtx, StatProducerQueueDepth.M(int64(len(p.records))))
+		}
+	}
+}
+
+func (p *producer) add(r *record) {
+	if r.size()+aggregationOverhead > p.cfg.aggregateBatchSize {
+		// Too big to be aggregated, send it on its own.
+		p.addEntry(newEntry(r))
+		return
+	}
+
+	agg := p.shardFor(r.partitionKey).agg
+	if agg.count > 0 && (agg.count >= p.cfg.aggregateBatchCount ||
+		agg.size()+r.size()+2*aggregationOverhead > p.cfg.aggregateBatchSize) {
+		p.addEntry(agg.drain())
+	}
+	agg.put(r)
+}
+
+func (p *producer) shardFor(partitionKey string) *shard {
+	sum := md5.Sum([]byte(partitionKey))
+	hashKey := new(big.Int).SetBytes(sum[:])
+	for _, s := range p.shards {
+		if hashKey.Cmp(s.startingHashKey) >= 0 && hashKey.Cmp(s.endingHashKey) <= 0 {
+			return s
+		}
+	}
+	// The open shards always cover the whole hash key range, this can only
+	// happen if the stream was resharded after the producer started. Any
+	// shard will do since Kinesis routes the records by partition key anyway.
+	return p.shards[0]
+}
+
+func (p *producer) addEntry(e *entry) {
+	size := len(e.Data) + len(aws.StringValue(e.PartitionKey))
+	if len(p.batch) >= p.cfg.batchCount || p.batchBytes+size > p.cfg.batchSize {
+		p.flushBatch()
+	}
+	p.batch = append(p.batch, e)
+	p.batchBytes += size
+}
+
+// flush sends all the pending aggregated records and the current batch.
+func (p *producer) flush() {
+	for _, s := range p.shards {
+		if s.agg.count > 0 {
+			p.addEntry(s.agg.drain())
+		}
+	}
+	p.flushBatch()
+}
+
+func (p *producer) flushBatch() {
+	if len(p.batch) == 0 {
+		return
+	}
+	stats.Record(p.statsCtx, StatBatchRecordCount.M(int64(len(p.batch))))
+	p.batches <- p.batch
+	p.batch = nil
+	p.batchBytes = 0
+}
+
+// send puts the batches on the stream until the producer is stopped.
+func (p *producer) send() {
+	defer p.wg.Done()
+	for batch := range p.batches {
+		if p.ctx.Err() != nil {
+			// Sending was aborted, the remaining batches are only drained.
+			entriesDone(batch, errProducerStopped)
+			continue
+		}
+		p.putRecords(batch)
+	}
+}
+
+// putRecords sends a batch to the stream, retrying the failed records with
+// exponential backoff up to the configured maximum number of retries.
+func (p *producer) putRecords(entries []*entry) {
+	backoff := minBackoff
+	for attempt := 0; ; attempt++ {
+		records := make([]*awskinesis.PutRecordsRequestEntry, len(entries))
+		for i, e := range entries {
+			records[i] = e.PutRecordsRequestEntry
+		}
+		start := time.Now()
+		out, err := p.client.PutRecordsWithContext(p.ctx, &awskinesis.PutRecordsInput{
+			StreamName: aws.String(p.cfg.streamName),
+			Records:    records,
+		})
+		stats.Record(p.statsCtx, StatPutLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+		if err == nil {
+			for i, res := range out.Records {
+				if res.ErrorCode == nil {
+					entries[i].done(nil)
+				}
+			}
+			var failed []*entry
+			failed, err = failedEntries(entries, out.Records)
+			atomic.AddInt64(&p.pending, -(countItems(entries) - countItems(failed)))
+			stats.Record(p.statsCtx,
+				StatRecordsSent.M(int64(len(entries)-len(failed))),
+				StatBytesSent.M(countBytes(entries)-countBytes(failed)),
+				StatThrottlingErrors.M(countThrottled(out.Records)))
+			if len(failed) == 0 {
+				return
+			}
+			entries = failed
+		} else if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awskinesis.ErrCodeProvisionedThroughputExceededException {
+			stats.Record(p.statsCtx, StatThrottlingErrors.M(int64(len(entries))))
+		}
+		if p.ctx.Err() != nil {
+			// The entries are reported as not sent by stopWithTimeout.
+			entriesDone(entries, errProducerStopped)
+			return
+		}
+
+		if attempt >= p.cfg.maxRetries {
+			p.logger.Error(
+				"failed to put records to kinesis",
+				zap.String("stream", p.cfg.streamName),
+				zap.Int("records", len(entries)),
+				zap.Int64("items", countItems(entries)),
+				zap.Error(err))
+			atomic.AddInt64(&p.pending, -countItems(entries))
+			entriesDone(entries, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-p.ctx.Done():
+			entriesDone(entries, errProducerStopped)
+			return
+		}
+		stats.Record(p.statsCtx, StatRecordsRetried.M(int64(len(entries))))
+		backoff *= 2
+		if backoff > p.cfg.maxBackoff {
+			backoff = p.cfg.maxBackoff
+		}
+	}
+}
+
+// countThrottled returns the number of records rejected because the
+// throughput of their shard was exceeded.
+func countThrottled(results []*awskinesis.PutRecordsResultEntry) int64 {
+	var n int64
+	for _, res := range results {
+		if aws.StringValue(res.ErrorCode) == awskinesis.ErrCodeProvisionedThroughputExceededException {
+			n++
+		}
+	}
+	return n
+}
+
+// failedEntries returns the entries that Kinesis failed to write and an error
+// describing the first failure.
+func failedEntries(
+	entries []*entry,
+	results []*awskinesis.PutRecordsResultEntry,
+) ([]*entry, error) {
+	var failed []*entry
+	var err error
+	for i, res := range results {
+		if res.ErrorCode == nil {
+			continue
+		}
+		failed = append(failed, entries[i])
+		if err == nil {
+			err = fmt.Errorf("%s: %s", aws.StringValue(res.ErrorCode), aws.StringValue(res.ErrorMessage))
+		}
+	}
+	return failed, err
+}
@@ -0,0 +1,420 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awskinesis "github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeKinesis is an in-memory kinesis client that records all the entries
+// put on the stream.
+type fakeKinesis struct {
+	kinesisiface.KinesisAPI
+
+	shards []*awskinesis.Shard
+
+	mu sync.Mutex
+	// failures is the number of PutRecords calls that will fail all their
+	// records before the calls start succeeding.
+	failures int
+	// partialFailures is the number of PutRecords calls that will fail
+	// every other record, starting with the second one.
+	partialFailures int
+	calls           int
+	entries         []*awskinesis.PutRecordsRequestEntry
+
+	// hold, when set, blocks the PutRecords calls until it is closed or
+	// their context is canceled.
+	hold chan struct{}
+}
+
+// newFakeKinesis returns a fake client for a stream with numShards shards
+// splitting the hash key range evenly.
+func newFakeKinesis(numShards int) *fakeKinesis {
+	maxHashKey := new(big.Int).Lsh(big.NewInt(1), 128)
+	step := new(big.Int).Div(maxHashKey, big.NewInt(int64(numShards)))
+	fk := &fakeKinesis{}
+	for i := 0; i < numShards; i++ {
+		start := new(big.Int).Mul(step, big.NewInt(int64(i)))
+		end := new(big.Int).Sub(new(big.Int).Add(start, step), big.NewInt(1))
+		if i == numShards-1 {
+			end = new(big.Int).Sub(maxHashKey, big.NewInt(1))
+		}
+		fk.shards = append(fk.shards, &awskinesis.Shard{
+			ShardId: aws.String(fmt.Sprintf("shardId-%012d", i)),
+			HashKeyRange: &awskinesis.HashKeyRange{
+				StartingHashKey: aws.String(start.String()),
+				EndingHashKey:   aws.String(end.String()),
+			},
+			SequenceNumberRange: &awskinesis.SequenceNumberRange{
+				StartingSequenceNumber: aws.String("0"),
+			},
+		})
+	}
+	return fk
+}
+
+func (fk *fakeKinesis) ListShards(*awskinesis.ListShardsInput) (*awskinesis.ListShardsOutput, error) {
+	return &awskinesis.ListShardsOutput{Shards: fk.shards}, nil
+}
+
+func (fk *fakeKinesis) PutRecordsWithContext(
+	ctx aws.Context,
+	in *awskinesis.PutRecordsInput,
+	_ ...request.Option,
+) (*awskinesis.PutRecordsOutput, error) {
+	if fk.hold != nil {
+		select {
+		case <-fk.hold:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return fk.PutRecords(in)
+}
+
+func (fk *fakeKinesis) PutRecords(in *awskinesis.PutRecordsInput) (*awskinesis.PutRecordsOutput, error) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+
+	fk.calls++
+	out := &awskinesis.PutRecordsOutput{}
+	for i, entry := range in.Records {
+		if fk.failures > 0 || (fk.partialFailures > 0 && i%2 == 1) {
+			out.FailedRecordCount = aws.Int64(aws.Int64Value(out.FailedRecordCount) + 1)
+			out.Records = append(out.Records, &awskinesis.PutRecordsResultEntry{
+				ErrorCode:    aws.String(awskinesis.ErrCodeProvisionedThroughputExceededException),
+				ErrorMessage: aws.String("slow down"),
+			})
+			continue
+		}
+		fk.entries = append(fk.entries, entry)
+		out.Records = append(out.Records, &awskinesis.PutRecordsResultEntry{
+			SequenceNumber: aws.String("1"),
+		})
+	}
+	if fk.failures > 0 {
+		fk.failures--
+	}
+	if fk.partialFailures > 0 {
+		fk.partialFailures--
+	}
+	return out, nil
+}
+
+// userRecords returns all the user records put on the stream, de-aggregating
+// the aggregated records.
+func (fk *fakeKinesis) userRecords(t *testing.T) []*record {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+
+	var records []*record
+	for _, entry := range fk.entries {
+		rs, err := deaggregate(entry.Data, aws.StringValue(entry.PartitionKey))
+		require.NoError(t, err)
+		for _, r := range rs {
+			r.data, err = decompress(r.data)
+			require.NoError(t, err)
+		}
+		records = append(records, rs...)
+	}
+	return records
+}
+
+// deaggregate decodes a record written by the producer like the KCL does.
+func deaggregate(data []byte, partitionKey string) ([]*record, error) {
+	if !bytes.HasPrefix(data, aggregationMagic) {
+		return []*record{{data: data, partitionKey: partitionKey}}, nil
+	}
+
+	body := data[len(aggregationMagic) : len(data)-md5.Size]
+	sum := md5.Sum(body)
+	if !bytes.Equal(sum[:], data[len(data)-md5.Size:]) {
+		return nil, errors.New("invalid aggregated record checksum")
+	}
+
+	var keys []string
+	var records []*record
+	err := decodeFields(body, func(tag uint64, raw []byte) error {
+		switch tag {
+		case tagPartitionKeyTable:
+			keys = append(keys, string(raw))
+		case tagRecords:
+			r, err := decodeUserRecord(raw, keys)
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+		default:
+			return fmt.Errorf("unexpected tag %d", tag)
+		}
+		return nil
+	})
+	return records, err
+}
+
+func decodeUserRecord(raw []byte, keys []string) (*record, error) {
+	r := &record{}
+	err := decodeFields(raw, func(tag uint64, value []byte) error {
+		switch tag {
+		case tagPartitionKeyIndex:
+			idx, _ := proto.DecodeVarint(value)
+			if idx >= uint64(len(keys)) {
+				return fmt.Errorf("partition key index %d out of range", idx)
+			}
+			r.partitionKey = keys[idx]
+		case tagData:
+			r.data = value
+		default:
+			return fmt.Errorf("unexpected tag %d", tag)
+		}
+		return nil
+	})
+	return r, err
+}
+
+// decodeFields calls fn for every field of a protobuf message that only has
+// varint and length delimited fields. For varint fields the value passed to
+// fn is the encoded varint.
+func decodeFields(msg []byte, fn func(tag uint64, value []byte) error) error {
+	for len(msg) > 0 {
+		tag, n := proto.DecodeVarint(msg)
+		if n == 0 {
+			return errors.New("invalid field tag")
+		}
+		msg = msg[n:]
+
+		var value []byte
+		switch tag & 7 {
+		case 0:
+			_, n = proto.DecodeVarint(msg)
+			if n == 0 {
+				return errors.New("invalid varint")
+			}
+			value, msg = msg[:n], msg[n:]
+		case 2:
+			length, n := proto.DecodeVarint(msg)
+			if n == 0 || uint64(len(msg)-n) < length {
+				return errors.New("invalid length delimited field")
+			}
+			value, msg = msg[n:n+int(length)], msg[n+int(length):]
+		default:
+			return fmt.Errorf("unexpected wire type %d", tag&7)
+		}
+		if err := fn(tag, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func testProducerConfig() producerConfig {
+	return newProducerConfig(&Config{
+		KPL: KPLConfig{
+			FlushIntervalSeconds: 3600,
+			MaxConnections:       2,
+		},
+		QueueSize: 1000,
+	}, "test-stream")
+}
+
+func TestProducerAggregatesPerShard(t *testing.T) {
+	fk := newFakeKinesis(4)
+	p, err := newProducer(fk, testProducerConfig(), zap.NewNop())
+	require.NoError(t, err)
+
+	const numRecords = 100
+	for i := 0; i < numRecords; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		require.NoError(t, p.put([]byte(fmt.Sprintf("data-%d", i)), key, 1))
+	}
+	p.stop()
+
+	// Every shard gets one aggregated record.
+	fk.mu.Lock()
+	assert.Len(t, fk.entries, 4)
+	for _, entry := range fk.entries {
+		assert.True(t, bytes.HasPrefix(entry.Data, aggregationMagic))
+		assert.NotNil(t, entry.ExplicitHashKey)
+	}
+	fk.mu.Unlock()
+
+	records := fk.userRecords(t)
+	require.Len(t, records, numRecords)
+	seen := map[string]string{}
+	for _, r := range records {
+		seen[r.partitionKey] = string(r.data)
+	}
+	for i := 0; i < numRecords; i++ {
+		assert.Equal(t, fmt.Sprintf("data-%d", i), seen[fmt.Sprintf("key-%d", i)])
+	}
+}
+
+func TestProducerLargeRecordsAreNotAggregated(t *testing.T) {
+	fk := newFakeKinesis(1)
+	cfg := testProducerConfig()
+	cfg.aggregateBatchSize = 100
+	p, err := newProducer(fk, cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	large := bytes.Repeat([]byte("x"), 200)
+	require.NoError(t, p.put(large, "a", 1))
+	require.NoError(t, p.put([]byte("small"), "b", 1))
+	p.stop()
+
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	require.Len(t, fk.entries, 2)
+	assert.Equal(t, large, fk.entries[0].Data)
+	assert.Equal(t, []byte("small"), fk.entries[1].Data)
+}
+
+func TestProducerRetriesFailedRecords(t *testing.T) {
+	fk := newFakeKinesis(1)
+	fk.failures = 2
+	cfg := testProducerConfig()
+	cfg.maxRetries = 3
+	cfg.maxBackoff = time.Millisecond
+	p, err := newProducer(fk, cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	require.NoError(t, p.put([]byte("data"), "key", 1))
+	p.stop()
+
+	assert.Equal(t, 3, fk.calls)
+	assert.Len(t, fk.userRecords(t), 1)
+}
+
+func TestProducerRetriesPartialFailuresByDefault(t *testing.T) {
+	fk := newFakeKinesis(2)
+	fk.partialFailures = 1
+	cfg := newProducerConfig((&Factory{}).CreateDefaultConfig().(*Config), "test-stream")
+	p, err := newProducer(fk, cfg, zap.NewNop())
+	require.NoError(t, err)
+
+	// The records of the two shards are sent in the same PutRecords call,
+	// the second one is throttled and retried.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, p.put([]byte("data"), fmt.Sprintf("key-%d", i), 1))
+	}
+	p.stop()
+
+	fk.mu.Lock()
+	assert.Equal(t, 2, fk.calls)
+	assert.Len(t, fk.entries, 2)
+	fk.mu.Unlock()
+	assert.Len(t, fk.userRecords(t), 10)
+}
+
+func TestProducerPutAsync(t *testing.T) {
+	fk := newFakeKinesis(2)
+	fk.failures = 1
+	p, err := newProducer(fk, testProducerConfig(), zap.NewNop())
+	require.NoError(t, err)
+
+	// The records are aggregated, the first PutRecords call fails them all
+	// and there are no retries.
+	var mu sync.Mutex
+	results := map[string]error{}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		require.NoError(t, p.putAsync([]byte("data"), key, 1, func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := results[key]; ok {
+				t.Errorf("done called twice for %s", key)
+			}
+			results[key] = err
+		}))
+	}
+	p.stop()
+
+	sent := len(fk.userRecords(t))
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, results, 10)
+	var written int
+	for _, err := range results {
+		if err == nil {
+			written++
+		}
+	}
+	assert.Equal(t, sent, written)
+	assert.True(t, written < 10, "no record failed")
+}
+
+func TestProducerQueueFull(t *testing.T) {
+	fk := newFakeKinesis(1)
+	p := &producer{
+		client:  fk,
+		cfg:     testProducerConfig(),
+		logger:  zap.NewNop(),
+		records: make(chan *record, 1),
+	}
+	assert.NoError(t, p.put([]byte("a"), "key", 1))
+	assert.Equal(t, errQueueFull, p.put([]byte("b"), "key", 1))
+}
+
+func TestProducerStopped(t *testing.T) {
+	p, err := newProducer(newFakeKinesis(1), testProducerConfig(), zap.NewNop())
+	require.NoError(t, err)
+	p.stop()
+	p.stop()
+	assert.Equal(t, errProducerStopped, p.put([]byte("a"), "key", 1))
+}
+
+func TestProducerStopTimeout(t *testing.T) {
+	fk := newFakeKinesis(1)
+	fk.hold = make(chan struct{})
+	defer close(fk.hold)
+	p, err := newProducer(fk, testProducerConfig(), zap.NewNop())
+	require.NoError(t, err)
+
+	require.NoError(t, p.put([]byte("a"), "a", 2))
+	require.NoError(t, p.put([]byte("b"), "b", 3))
+	assert.Equal(t, int64(5), p.stopWithTimeout(50*time.Millisecond))
+
+	// Sending is aborted once the timeout expires.
+	p.wg.Wait()
+	assert.Empty(t, fk.userRecords(t))
+}
+
+func TestProducerStopBeforeTimeout(t *testing.T) {
+	fk := newFakeKinesis(1)
+	p, err := newProducer(fk, testProducerConfig(), zap.NewNop())
+	require.NoError(t, err)
+
+	require.NoError(t, p.put([]byte("a"), "a", 2))
+	require.NoError(t, p.put([]byte("b"), "b", 3))
+	assert.Equal(t, int64(0), p.stopWithTimeout(time.Minute))
+	assert.Len(t, fk.userRecords(t), 2)
+	assert.Equal(t, int64(0), p.pending)
+}
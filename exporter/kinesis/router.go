@@ -0,0 +1,106 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"errors"
+	"fmt"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+
+	"github.com/Omnition/omnition-opentelemetry-service/internal/attributes"
+)
+
+// spanRouter returns the function giving the index of the stream, in the
+// list returned by newSpanRouter, each span of a batch is written to.
+type spanRouter func(td consumerdata.TraceData) func(span *tracepb.Span) int
+
+// newSpanRouter returns the router for the given routes and the names of the
+// streams they write to. The default stream is always the first one, spans
+// matching no route are written to it.
+func newSpanRouter(defaultStream string, routes []RouteConfig) (spanRouter, []string, error) {
+	streams := []string{defaultStream}
+	indexes := map[string]int{defaultStream: 0}
+	routeStreams := make([]int, len(routes))
+	for i, r := range routes {
+		if r.StreamName == "" {
+			return nil, nil, fmt.Errorf("route %d has no stream-name", i)
+		}
+		if r.ServiceName == "" && len(r.ResourceLabels) == 0 && len(r.SpanAttributes) == 0 {
+			return nil, nil, fmt.Errorf("route to stream %q matches all spans, it needs service-name, resource-labels or span-attributes", r.StreamName)
+		}
+		idx, ok := indexes[r.StreamName]
+		if !ok {
+			idx = len(streams)
+			indexes[r.StreamName] = idx
+			streams = append(streams, r.StreamName)
+		}
+		routeStreams[i] = idx
+	}
+	if len(routes) > 0 && defaultStream == "" {
+		return nil, nil, errors.New("routes require a default stream-name")
+	}
+
+	if len(routes) == 0 {
+		return func(consumerdata.TraceData) func(*tracepb.Span) int {
+			return func(*tracepb.Span) int { return 0 }
+		}, streams, nil
+	}
+	return func(td consumerdata.TraceData) func(*tracepb.Span) int {
+		// The service name and resource labels are the same for all the spans
+		// of the batch, only the span attributes have to be checked per span.
+		var candidates []int
+		for i, r := range routes {
+			if r.matchesBatch(td) {
+				candidates = append(candidates, i)
+			}
+		}
+		return func(span *tracepb.Span) int {
+			for _, i := range candidates {
+				if routes[i].matchesSpan(span) {
+					return routeStreams[i]
+				}
+			}
+			return 0
+		}
+	}, streams, nil
+}
+
+// matchesBatch returns whether the service name and resource labels of the
+// route match the batch.
+func (r RouteConfig) matchesBatch(td consumerdata.TraceData) bool {
+	if r.ServiceName != "" && r.ServiceName != serviceName(td.Node) {
+		return false
+	}
+	for k, v := range r.ResourceLabels {
+		if value, ok := td.Resource.GetLabels()[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesSpan returns whether the span attributes of the route match the
+// span.
+func (r RouteConfig) matchesSpan(span *tracepb.Span) bool {
+	for k, v := range r.SpanAttributes {
+		value, ok := span.GetAttributes().GetAttributeMap()[k]
+		if !ok || attributes.ValueString(value) != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"testing"
+
+	resourcepb "github.com/census-instrumentation/opencensus-proto/gen-go/resource/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpanRouter(t *testing.T) {
+	router, streams, err := newSpanRouter("default", []RouteConfig{
+		{StreamName: "errors", SpanAttributes: map[string]string{"error": "true"}},
+		{StreamName: "tenant-a", ResourceLabels: map[string]string{"tenant": "a"}},
+		{StreamName: "tenant-a", ServiceName: "billing"},
+		{StreamName: "test-service", ServiceName: "test-service", SpanAttributes: map[string]string{"http.method": "POST"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default", "errors", "tenant-a", "test-service"}, streams)
+
+	errorSpan := testSpan(testTraceID1, 1, "error")
+	errorSpan.Attributes.AttributeMap["error"] = &tracepb.AttributeValue{
+		Value: &tracepb.AttributeValue_BoolValue{BoolValue: true},
+	}
+	postSpan := testSpan(testTraceID1, 2, "post")
+	postSpan.Attributes.AttributeMap["http.method"] = stringAttribute("POST")
+	getSpan := testSpan(testTraceID1, 3, "get")
+
+	td := testTraceData()
+	route := router(td)
+	assert.Equal(t, 1, route(errorSpan))
+	assert.Equal(t, 3, route(postSpan))
+	assert.Equal(t, 0, route(getSpan))
+
+	td.Resource = &resourcepb.Resource{Labels: map[string]string{"tenant": "a"}}
+	route = router(td)
+	assert.Equal(t, 1, route(errorSpan))
+	assert.Equal(t, 2, route(postSpan))
+	assert.Equal(t, 2, route(getSpan))
+
+	td.Resource = nil
+	td.Node.ServiceInfo.Name = "billing"
+	route = router(td)
+	assert.Equal(t, 2, route(getSpan))
+}
+
+func TestSpanRouterWithoutRoutes(t *testing.T) {
+	router, streams, err := newSpanRouter("default", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default"}, streams)
+	assert.Equal(t, 0, router(testTraceData())(testSpan(testTraceID1, 1, "span")))
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	tests := []struct {
+		name          string
+		defaultStream string
+		routes        []RouteConfig
+	}{
+		{
+			name:          "no stream",
+			defaultStream: "default",
+			routes:        []RouteConfig{{ServiceName: "a"}},
+		},
+		{
+			name:          "no condition",
+			defaultStream: "default",
+			routes:        []RouteConfig{{StreamName: "a"}},
+		},
+		{
+			name:   "no default stream",
+			routes: []RouteConfig{{StreamName: "a", ServiceName: "a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := newSpanRouter(tt.defaultStream, tt.routes)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	awskinesis "github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// kinesisServer is an in-process Kinesis endpoint serving the subset of the
+// Kinesis JSON API used by the exporter. The records are stored in a
+// fakeKinesis per stream so the tests can inspect them, the one of the first
+// stream is embedded. The exporters use the server through the factory
+// returned by factory.
+type kinesisServer struct {
+	*fakeKinesis
+	streams map[string]*fakeKinesis
+	server  *httptest.Server
+
+	// accessKeyIDs are the access key ids the requests were signed with.
+	accessKeyIDs []string
+}
+
+// newKinesisServer starts a Kinesis endpoint for a stream with numShards
+// shards.
+func newKinesisServer(streamName string, numShards int) *kinesisServer {
+	ks := &kinesisServer{
+		fakeKinesis: newFakeKinesis(numShards),
+		streams:     map[string]*fakeKinesis{},
+	}
+	ks.streams[streamName] = ks.fakeKinesis
+	ks.server = httptest.NewServer(http.HandlerFunc(ks.serveHTTP))
+	return ks
+}
+
+// addStream adds another stream to the server.
+func (ks *kinesisServer) addStream(streamName string, numShards int) *fakeKinesis {
+	fk := newFakeKinesis(numShards)
+	ks.streams[streamName] = fk
+	return fk
+}
+
+// factory returns a factory creating the exporters with clients sending their
+// requests to the server. The requests are signed so the clients have static
+// credentials, the ones set in the exporter config are used over them.
+func (ks *kinesisServer) factory() *Factory {
+	return &Factory{
+		awsConfig: aws.NewConfig().
+			WithEndpoint(ks.server.URL).
+			WithCredentials(credentials.NewStaticCredentials("test-access-key", "test-secret-key", "")),
+	}
+}
+
+func (ks *kinesisServer) Close() {
+	ks.server.Close()
+}
+
+func (ks *kinesisServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// The Authorization header of the SigV4 signature starts with
+	// "AWS4-HMAC-SHA256 Credential=<access key id>/<scope>".
+	auth := r.Header.Get("Authorization")
+	if i := strings.Index(auth, "Credential="); i >= 0 {
+		id := auth[i+len("Credential="):]
+		if j := strings.Index(id, "/"); j >= 0 {
+			ks.mu.Lock()
+			ks.accessKeyIDs = append(ks.accessKeyIDs, id[:j])
+			ks.mu.Unlock()
+		}
+	}
+
+	var out interface{}
+	var err error
+	switch r.Header.Get("X-Amz-Target") {
+	case "Kinesis_20131202.ListShards":
+		in := &awskinesis.ListShardsInput{}
+		var fk *fakeKinesis
+		if fk, err = ks.decode(r, in); err == nil {
+			out, err = fk.ListShards(in)
+		}
+	case "Kinesis_20131202.PutRecords":
+		in := &awskinesis.PutRecordsInput{}
+		var fk *fakeKinesis
+		if fk, err = ks.decode(r, in); err == nil {
+			out, err = fk.PutRecordsWithContext(r.Context(), in)
+		}
+	default:
+		err = fmt.Errorf("unsupported operation %q", r.Header.Get("X-Amz-Target"))
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  awskinesis.ErrCodeResourceNotFoundException,
+			"message": err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(out)
+}
+
+// decode reads the JSON request into in and returns the stream it targets.
+func (ks *kinesisServer) decode(r *http.Request, in interface{}) (*fakeKinesis, error) {
+	var req struct {
+		StreamName string
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, err
+	}
+	fk, ok := ks.streams[req.StreamName]
+	if !ok {
+		return nil, fmt.Errorf("stream %q not found", req.StreamName)
+	}
+	return fk, json.Unmarshal(raw, in)
+}
@@ -0,0 +1,651 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSpillQueueMaxBytes     = 1024 * 1024 * 1024
+	defaultSpillQueueSegmentBytes = 16 * 1024 * 1024
+
+	segmentSuffix  = ".wal"
+	checkpointFile = "checkpoint"
+
+	// Every record is written to a segment as a frame made of the length and
+	// CRC of its payload followed by the payload: the number of items and the
+	// length of the partition key as uvarints, the partition key and the data.
+	frameHeaderSize = 8
+	// maxFramePayloadSize is the largest payload a frame can hold, that of a
+	// record filling a Kinesis record. Longer lengths come from a corrupt
+	// header.
+	maxFramePayloadSize = 2*binary.MaxVarintLen64 + maxRecordSize
+)
+
+var (
+	errSpillQueueFull    = errors.New("kinesis spill queue is full")
+	errSpillQueueStopped = errors.New("kinesis spill queue is stopped")
+	errCorruptFrame      = errors.New("corrupt spill queue frame")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// asyncRecordPutter puts records on a Kinesis stream and reports when they
+// were written, like producer.putAsync.
+type asyncRecordPutter interface {
+	putAsync(data []byte, partitionKey string, items int, done func(error)) error
+}
+
+// segment is a file of the spill queue.
+type segment struct {
+	id   uint64
+	size int64
+	// records is the number of records of the segment, not counting the
+	// ones forwarded before the queue was loaded.
+	records int64
+}
+
+// inflightRecord is a record forwarded to the producer and not written to
+// the stream yet.
+type inflightRecord struct {
+	r       *record
+	segment uint64
+	// size is the size of the frames of the record, records their number.
+	// Only the unreadable end of a segment has more than one.
+	size    int64
+	records int64
+	sent    bool
+}
+
+// spillQueue is a write-ahead queue on disk in front of a producer. Records
+// are appended to segment files and forwarded to the producer in order,
+// waiting while its in-memory queue is full, so they survive throttling and
+// restarts. The read position only moves past the records once the producer
+// wrote them to the stream, the records it fails to write are forwarded
+// again. Segments are deleted once all their records were written.
+//
+// Records are delivered at least once: the read position is saved when the
+// queue is stopped, but after a crash the first segment is replayed from its
+// start.
+type spillQueue struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	logger       *zap.Logger
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	segments []*segment
+	writer   *os.File
+	bytes    int64
+	depth    int64
+	stopped  bool
+	closed   bool
+	done     chan struct{}
+
+	// readOffset and readRecords are the position in the first segment up
+	// to which the records were written to the stream.
+	readOffset  int64
+	readRecords int64
+	// The forward position is the next record to forward to the producer,
+	// ahead of the read position by the inflight records. The records to
+	// forward again are in retries.
+	forwardID      uint64
+	forwardOffset  int64
+	forwardRecords int64
+	inflight       []*inflightRecord
+	retries        []*inflightRecord
+
+	// reader and readerID are only accessed by the forward goroutine.
+	reader   *os.File
+	readerID uint64
+
+	exporterName string
+	streamName   string
+	wg           sync.WaitGroup
+}
+
+// newSpillQueue opens the spill queue in the configured directory, loading
+// the segments left by a previous run, and starts forwarding its records to
+// p, the producer of the given stream.
+func newSpillQueue(
+	c SpillQueueConfig,
+	exporterName string,
+	streamName string,
+	p asyncRecordPutter,
+	logger *zap.Logger,
+) (*spillQueue, error) {
+	q := &spillQueue{
+		dir:          c.Directory,
+		maxBytes:     int64(valueOrDefault(c.MaxBytes, defaultSpillQueueMaxBytes)),
+		segmentBytes: int64(valueOrDefault(c.SegmentBytes, defaultSpillQueueSegmentBytes)),
+		logger:       logger,
+		done:         make(chan struct{}),
+		exporterName: exporterName,
+		streamName:   streamName,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	if q.segmentBytes < maxRecordSize+frameHeaderSize {
+		return nil, fmt.Errorf("spill queue segment-bytes must be at least %d", maxRecordSize+frameHeaderSize)
+	}
+	if q.maxBytes < 2*q.segmentBytes {
+		return nil, fmt.Errorf("spill queue max-bytes must be at least twice segment-bytes (%d)", 2*q.segmentBytes)
+	}
+
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	if err := q.rotate(); err != nil {
+		return nil, err
+	}
+	q.forwardID, q.forwardOffset = q.segments[0].id, q.readOffset
+	if q.depth > 0 {
+		logger.Info("replaying kinesis spill queue",
+			zap.String("directory", q.dir), zap.Int64("records", q.depth), zap.Int64("bytes", q.bytes))
+	}
+
+	initMetrics()
+	q.recordMetrics()
+
+	q.wg.Add(1)
+	go q.forward(p)
+	return q, nil
+}
+
+// load reads the segments of the directory, dropping the records that were
+// already forwarded according to the checkpoint and any torn frame at the
+// end of a segment.
+func (q *spillQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	checkpointID, checkpointOffset := q.readCheckpoint()
+	for _, id := range ids {
+		if id < checkpointID {
+			if err := os.Remove(q.segmentPath(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		offset := int64(0)
+		if id == checkpointID {
+			offset = checkpointOffset
+		}
+		size, records, err := q.scan(id, offset)
+		if err != nil {
+			return err
+		}
+		if size <= offset {
+			if err := os.Remove(q.segmentPath(id)); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(q.segments) == 0 {
+			q.readOffset = offset
+		}
+		q.segments = append(q.segments, &segment{id: id, size: size, records: records})
+		q.bytes += size
+		q.depth += records
+	}
+	return nil
+}
+
+// scan validates the frames of a segment, truncating it after the last valid
+// one. It returns the size of the segment and the number of records after
+// offset.
+func (q *spillQueue) scan(id uint64, offset int64) (int64, int64, error) {
+	f, err := os.OpenFile(q.segmentPath(id), os.O_RDWR, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var size, records int64
+	for {
+		_, n, err := readFrame(f, size)
+		if err != nil {
+			break
+		}
+		if size >= offset {
+			records++
+		}
+		size += n
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > size {
+		q.logger.Warn("truncating corrupt kinesis spill queue segment",
+			zap.String("segment", f.Name()), zap.Int64("size", size))
+		if err := f.Truncate(size); err != nil {
+			return 0, 0, err
+		}
+	}
+	return size, records, nil
+}
+
+// readCheckpoint returns the reader position saved by the last stop. The
+// checkpoint is removed so a crash can't make the queue skip records.
+func (q *spillQueue) readCheckpoint() (uint64, int64) {
+	path := filepath.Join(q.dir, checkpointFile)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0
+	}
+	os.Remove(path)
+
+	var id uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &id, &offset); err != nil {
+		q.logger.Warn("ignoring invalid kinesis spill queue checkpoint", zap.Error(err))
+		return 0, 0
+	}
+	return id, offset
+}
+
+func (q *spillQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// rotate starts a new segment for writing. It must be called with mu held.
+func (q *spillQueue) rotate() error {
+	id := uint64(1)
+	if len(q.segments) > 0 {
+		id = q.segments[len(q.segments)-1].id + 1
+	}
+	f, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if q.writer != nil {
+		q.writer.Close()
+	}
+	q.writer = f
+	q.segments = append(q.segments, &segment{id: id})
+	return nil
+}
+
+// put appends a record to the queue. It returns errSpillQueueFull when the
+// record would make the queue exceed its maximum size.
+func (q *spillQueue) put(data []byte, partitionKey string, items int) error {
+	frame := encodeFrame(data, partitionKey, items)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stopped {
+		return errSpillQueueStopped
+	}
+	if q.bytes+int64(len(frame)) > q.maxBytes {
+		return errSpillQueueFull
+	}
+	tail := q.segments[len(q.segments)-1]
+	if tail.size > 0 && tail.size+int64(len(frame)) > q.segmentBytes {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+		tail = q.segments[len(q.segments)-1]
+	}
+	if _, err := q.writer.Write(frame); err != nil {
+		// Drop whatever part of the frame made it to the file so the
+		// segment stays readable.
+		q.writer.Truncate(tail.size)
+		return err
+	}
+	tail.size += int64(len(frame))
+	tail.records++
+	q.bytes += int64(len(frame))
+	q.depth++
+	q.recordMetrics()
+	q.cond.Signal()
+	return nil
+}
+
+// putAsync is put for the exporter, the records of which hold spans. done is
+// never called: the queue forwards its records until they are written to the
+// stream, including after a restart, and counts their spans as sent once
+// they are. The spans on disk are counted as spilled.
+func (q *spillQueue) putAsync(data []byte, partitionKey string, items int, done func(error)) error {
+	if err := q.put(data, partitionKey, items); err != nil {
+		return err
+	}
+	stats.RecordWithTags(context.Background(), statsTags(q.exporterName, q.streamName), StatSpilledSpanCount.M(int64(items)))
+	return nil
+}
+
+// forward sends the records of the queue to p until the queue is stopped.
+func (q *spillQueue) forward(p asyncRecordPutter) {
+	defer q.wg.Done()
+
+	retryBackoff := minBackoff
+	for {
+		ir, retry, err := q.next()
+		if err == errSpillQueueStopped {
+			return
+		}
+		if err != nil {
+			q.logger.Error("skipping corrupt kinesis spill queue segment", zap.Error(err))
+			continue
+		}
+		if !retry {
+			retryBackoff = minBackoff
+		} else if !q.wait(&retryBackoff) {
+			return
+		}
+
+		backoff := minBackoff
+		for {
+			err = p.putAsync(ir.r.data, ir.r.partitionKey, ir.r.items, func(err error) {
+				q.sent(ir, err)
+			})
+			if err == nil {
+				break
+			}
+			if err == errProducerStopped {
+				// The record is sent again on the next start.
+				return
+			}
+			if err != errQueueFull {
+				q.logger.Error("error forwarding record from the kinesis spill queue", zap.Error(err))
+			}
+			if !q.wait(&backoff) {
+				return
+			}
+		}
+	}
+}
+
+// wait waits for backoff, which is doubled, unless the queue is stopped
+// before. It returns whether forwarding should go on.
+func (q *spillQueue) wait(backoff *time.Duration) bool {
+	select {
+	case <-time.After(*backoff):
+	case <-q.done:
+		return false
+	}
+	if *backoff *= 2; *backoff > defaultMaxBackoff {
+		*backoff = defaultMaxBackoff
+	}
+	return true
+}
+
+// next returns the next record to forward, the first record to retry if any
+// or else the record at the forward position, and whether it is a retry. It
+// blocks until there is one or the queue is stopped.
+func (q *spillQueue) next() (*inflightRecord, bool, error) {
+	q.mu.Lock()
+	var seg *segment
+	for {
+		if q.stopped {
+			q.mu.Unlock()
+			return nil, false, errSpillQueueStopped
+		}
+		if len(q.retries) > 0 {
+			ir := q.retries[0]
+			q.retries[0] = nil
+			q.retries = q.retries[1:]
+			q.mu.Unlock()
+			return ir, true, nil
+		}
+
+		// The segment of the forward position may have been deleted once
+		// all its records were written.
+		i := sort.Search(len(q.segments), func(i int) bool { return q.segments[i].id >= q.forwardID })
+		seg = q.segments[i]
+		if seg.id != q.forwardID {
+			q.forwardID, q.forwardOffset, q.forwardRecords = seg.id, 0, 0
+		}
+		if q.forwardOffset < seg.size {
+			break
+		}
+		if i == len(q.segments)-1 {
+			q.cond.Wait()
+			continue
+		}
+		q.forwardID = q.segments[i+1].id
+	}
+	id, offset, size := seg.id, q.forwardOffset, seg.size
+	q.mu.Unlock()
+
+	if q.reader == nil || q.readerID != id {
+		if q.reader != nil {
+			q.reader.Close()
+		}
+		f, err := os.Open(q.segmentPath(id))
+		if err != nil {
+			q.reader = nil
+			q.skipForward(seg, size)
+			return nil, false, err
+		}
+		q.reader, q.readerID = f, id
+	}
+
+	r, n, err := readFrame(q.reader, offset)
+	if err != nil {
+		q.skipForward(seg, size)
+		return nil, false, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ir := &inflightRecord{r: r, segment: id, size: n, records: 1}
+	q.inflight = append(q.inflight, ir)
+	q.forwardOffset += n
+	q.forwardRecords++
+	return ir, false, nil
+}
+
+// skipForward drops the records of a segment from the forward position to
+// size, when they can't be read.
+func (q *spillQueue) skipForward(seg *segment, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inflight = append(q.inflight, &inflightRecord{
+		segment: seg.id,
+		size:    size - q.forwardOffset,
+		records: seg.records - q.forwardRecords,
+		sent:    true,
+	})
+	q.forwardOffset = size
+	q.forwardRecords = seg.records
+	q.advance()
+}
+
+// sent is called with the outcome of writing an inflight record to the
+// stream. The records that failed to be written are forwarded again.
+func (q *spillQueue) sent(ir *inflightRecord, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	if err != nil {
+		if q.stopped {
+			// The record is sent again on the next start.
+			return
+		}
+		q.logger.Warn("retrying record of the kinesis spill queue", zap.Error(err))
+		q.retries = append(q.retries, ir)
+		q.cond.Signal()
+		return
+	}
+	ir.sent = true
+	stats.RecordWithTags(context.Background(), statsTags(q.exporterName, q.streamName), StatStreamSpanCount.M(int64(ir.r.items)))
+	q.advance()
+}
+
+// advance moves the read position past the inflight records written to the
+// stream, in order, deleting the segments whose records were all written.
+// It must be called with mu held.
+func (q *spillQueue) advance() {
+	for len(q.inflight) > 0 && q.inflight[0].sent {
+		ir := q.inflight[0]
+		q.inflight[0] = nil
+		q.inflight = q.inflight[1:]
+		for q.segments[0].id != ir.segment {
+			q.removeHead()
+		}
+		q.readOffset += ir.size
+		q.readRecords += ir.records
+		q.depth -= ir.records
+	}
+	for len(q.segments) > 1 && q.readOffset >= q.segments[0].size {
+		q.removeHead()
+	}
+	q.recordMetrics()
+}
+
+// removeHead deletes the first segment once all its records were written.
+// It must be called with mu held.
+func (q *spillQueue) removeHead() {
+	head := q.segments[0]
+	if err := os.Remove(q.segmentPath(head.id)); err != nil {
+		q.logger.Warn("error removing kinesis spill queue segment", zap.Error(err))
+	}
+	q.segments = q.segments[1:]
+	q.bytes -= head.size
+	q.readOffset = 0
+	q.readRecords = 0
+}
+
+// stopForwarding stops forwarding records to the producer. The inflight
+// records keep moving the read position until the queue is stopped.
+func (q *spillQueue) stopForwarding() {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.done)
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	q.wg.Wait()
+	if q.reader != nil {
+		q.reader.Close()
+		q.reader = nil
+	}
+}
+
+// stop stops forwarding records and closes the queue. The records that were
+// not written to the stream yet are kept on disk and replayed on the next
+// start.
+func (q *spillQueue) stop() {
+	q.stopForwarding()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.writer.Close()
+	head := q.segments[0]
+	checkpoint := fmt.Sprintf("%d %d", head.id, q.readOffset)
+	if err := ioutil.WriteFile(filepath.Join(q.dir, checkpointFile), []byte(checkpoint), 0600); err != nil {
+		q.logger.Error("error saving kinesis spill queue checkpoint", zap.Error(err))
+	}
+}
+
+func (q *spillQueue) recordMetrics() {
+	stats.RecordWithTags(
+		context.Background(),
+		statsTags(q.exporterName, q.streamName),
+		StatSpillQueueDepth.M(q.depth),
+		StatSpillQueueBytes.M(q.bytes))
+}
+
+func encodeFrame(data []byte, partitionKey string, items int) []byte {
+	payload := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(partitionKey)+len(data))
+	n := binary.PutUvarint(payload, uint64(items))
+	payload = payload[:n+binary.PutUvarint(payload[n:], uint64(len(partitionKey)))]
+	payload = append(payload, partitionKey...)
+	payload = append(payload, data...)
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, crcTable))
+	return append(frame, payload...)
+}
+
+// readFrame reads the record of the frame at offset, returning the size of
+// the frame. A frame longer than any record is reported as corrupt before its
+// payload is allocated.
+func readFrame(f *os.File, offset int64) (*record, int64, error) {
+	var header [frameHeaderSize]byte
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFramePayloadSize {
+		return nil, 0, errCorruptFrame
+	}
+	payload := make([]byte, size)
+	if _, err := f.ReadAt(payload, offset+frameHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorruptFrame
+	}
+	items, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, 0, errCorruptFrame
+	}
+	keyLen, m := binary.Uvarint(payload[n:])
+	if m <= 0 || uint64(len(payload)-n-m) < keyLen {
+		return nil, 0, errCorruptFrame
+	}
+	n += m
+	r := &record{
+		partitionKey: string(payload[n : n+int(keyLen)]),
+		data:         payload[n+int(keyLen):],
+		items:        int(items),
+	}
+	return r, int64(frameHeaderSize + len(payload)), nil
+}
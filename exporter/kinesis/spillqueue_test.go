@@ -0,0 +1,388 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"go.uber.org/zap"
+)
+
+// fakePutter records the records forwarded by a spill queue and reports them
+// written right away, unless hold is set. It behaves like a full producer
+// queue while full is set.
+type fakePutter struct {
+	mu      sync.Mutex
+	full    bool
+	hold    bool
+	records []*record
+	dones   []func(error)
+}
+
+func (fp *fakePutter) putAsync(data []byte, partitionKey string, items int, done func(error)) error {
+	fp.mu.Lock()
+	if fp.full {
+		fp.mu.Unlock()
+		return errQueueFull
+	}
+	fp.records = append(fp.records, &record{data: data, partitionKey: partitionKey, items: items})
+	if fp.hold {
+		fp.dones = append(fp.dones, done)
+		fp.mu.Unlock()
+		return nil
+	}
+	fp.mu.Unlock()
+	done(nil)
+	return nil
+}
+
+// complete reports the outcome of writing the i-th held record.
+func (fp *fakePutter) complete(i int, err error) {
+	fp.mu.Lock()
+	done := fp.dones[i]
+	fp.mu.Unlock()
+	done(err)
+}
+
+func (fp *fakePutter) setFull(full bool) {
+	fp.mu.Lock()
+	fp.full = full
+	fp.mu.Unlock()
+}
+
+func (fp *fakePutter) len() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return len(fp.records)
+}
+
+func (fp *fakePutter) waitFor(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for fp.len() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d records, got %d", n, fp.len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func testSpillQueueConfig(t *testing.T) SpillQueueConfig {
+	dir, err := ioutil.TempDir("", "kinesis-spill-queue")
+	require.NoError(t, err)
+	return SpillQueueConfig{Directory: dir}
+}
+
+func putRecords(t *testing.T, q *spillQueue, from, to int) {
+	for i := from; i < to; i++ {
+		require.NoError(t, q.put([]byte(fmt.Sprintf("data-%d", i)), fmt.Sprintf("key-%d", i), 1))
+	}
+}
+
+func assertRecords(t *testing.T, records []*record, from, to int) {
+	require.Len(t, records, to-from)
+	for i, r := range records {
+		assert.Equal(t, fmt.Sprintf("data-%d", from+i), string(r.data))
+		assert.Equal(t, fmt.Sprintf("key-%d", from+i), r.partitionKey)
+	}
+}
+
+func TestSpillQueueForwardsRecords(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	fp := &fakePutter{}
+	q, err := newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 0, 100)
+	fp.waitFor(t, 100)
+	q.stop()
+
+	assertRecords(t, fp.records, 0, 100)
+	assert.Equal(t, errSpillQueueStopped, q.put([]byte("data"), "key", 1))
+}
+
+func TestSpillQueueReplaysOnRestart(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	// Forward some records and keep the rest on disk.
+	fp := &fakePutter{}
+	q, err := newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 0, 10)
+	fp.waitFor(t, 10)
+	fp.setFull(true)
+	putRecords(t, q, 10, 20)
+	q.stop()
+	assertRecords(t, fp.records, 0, 10)
+
+	// Only the records that were not forwarded are replayed.
+	fp = &fakePutter{}
+	q, err = newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 20, 30)
+	fp.waitFor(t, 20)
+	q.stop()
+	assertRecords(t, fp.records, 10, 30)
+}
+
+func TestSpillQueueAcksWrittenRecords(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	fp := &fakePutter{hold: true}
+	q, err := newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 0, 10)
+	fp.waitFor(t, 10)
+	// The records are written out of order, the read position only moves
+	// past the first ones.
+	for i := 4; i >= 0; i-- {
+		fp.complete(i, nil)
+	}
+	fp.complete(7, nil)
+	q.stop()
+
+	// The forwarded records that were not written are replayed.
+	fp = &fakePutter{}
+	q, err = newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	fp.waitFor(t, 5)
+	q.stop()
+	assertRecords(t, fp.records, 5, 10)
+}
+
+func TestSpillQueueRetriesFailedRecords(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	fp := &fakePutter{hold: true}
+	q, err := newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 0, 3)
+	fp.waitFor(t, 3)
+	fp.complete(1, errors.New("ProvisionedThroughputExceededException"))
+	fp.waitFor(t, 4)
+	assert.Equal(t, "data-1", string(fp.records[3].data))
+	for _, i := range []int{0, 2, 3} {
+		fp.complete(i, nil)
+	}
+	q.stop()
+	assert.Equal(t, int64(0), q.depth)
+
+	// Nothing is replayed once all the records were written.
+	fp = &fakePutter{}
+	q, err = newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 3, 4)
+	fp.waitFor(t, 1)
+	q.stop()
+	assertRecords(t, fp.records, 3, 4)
+}
+
+func TestSpillQueueRotatesSegments(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+	cfg.SegmentBytes = 2 * maxRecordSize
+
+	fp := &fakePutter{full: true}
+	q, err := newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("x"), maxRecordSize/2)
+	for i := 0; i < 8; i++ {
+		require.NoError(t, q.put(data, "key", 1))
+	}
+	segments, err := filepath.Glob(filepath.Join(cfg.Directory, "*"+segmentSuffix))
+	require.NoError(t, err)
+	assert.Len(t, segments, 3)
+
+	fp.setFull(false)
+	fp.waitFor(t, 8)
+	require.NoError(t, q.put(data, "key", 1))
+	fp.waitFor(t, 9)
+	q.stop()
+
+	// The segments are deleted once forwarded.
+	segments, err = filepath.Glob(filepath.Join(cfg.Directory, "*"+segmentSuffix))
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestSpillQueueFull(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+	cfg.SegmentBytes = 2 * maxRecordSize
+	cfg.MaxBytes = 4 * maxRecordSize
+
+	fp := &fakePutter{full: true}
+	q, err := newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	defer q.stop()
+
+	data := bytes.Repeat([]byte("x"), maxRecordSize/2)
+	for i := 0; i < 7; i++ {
+		require.NoError(t, q.put(data, "key", 1))
+	}
+	assert.Equal(t, errSpillQueueFull, q.put(data, "key", 1))
+}
+
+func TestSpillQueueTruncatesTornFrames(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	fp := &fakePutter{full: true}
+	q, err := newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 0, 5)
+	q.stop()
+
+	// Simulate a crash in the middle of a write.
+	f, err := os.OpenFile(q.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	frame := encodeFrame([]byte("torn"), "key", 1)
+	_, err = f.Write(frame[:len(frame)-2])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	fp = &fakePutter{}
+	q, err = newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 5, 10)
+	fp.waitFor(t, 10)
+	q.stop()
+	assertRecords(t, fp.records, 0, 10)
+}
+
+func TestSpillQueueTruncatesCorruptFrameLengths(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	fp := &fakePutter{full: true}
+	q, err := newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 0, 5)
+	q.stop()
+
+	// A corrupt header announcing a 4 GiB payload, followed by a valid frame
+	// that is dropped with the rest of the segment.
+	f, err := os.OpenFile(q.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	header := make([]byte, frameHeaderSize)
+	binary.BigEndian.PutUint32(header, math.MaxUint32)
+	_, err = f.Write(header)
+	require.NoError(t, err)
+	_, err = f.Write(encodeFrame([]byte("after"), "key", 1))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = os.Open(q.segmentPath(1))
+	require.NoError(t, err)
+	_, _, err = readFrame(f, q.segments[0].size)
+	assert.Equal(t, errCorruptFrame, err)
+	require.NoError(t, f.Close())
+
+	fp = &fakePutter{}
+	q, err = newSpillQueue(cfg, "kinesis", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	putRecords(t, q, 5, 10)
+	fp.waitFor(t, 10)
+	q.stop()
+	assertRecords(t, fp.records, 0, 10)
+}
+
+func TestSpillQueueInvalidConfig(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	cfg.SegmentBytes = 1024
+	_, err := newSpillQueue(cfg, "kinesis", "test-stream", &fakePutter{}, zap.NewNop())
+	assert.Error(t, err)
+
+	cfg.SegmentBytes = 2 * maxRecordSize
+	cfg.MaxBytes = 3 * maxRecordSize
+	_, err = newSpillQueue(cfg, "kinesis", "test-stream", &fakePutter{}, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestSpillQueueMetrics(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	fp := &fakePutter{full: true}
+	q, err := newSpillQueue(cfg, "spill-metrics", "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	defer q.stop()
+	putRecords(t, q, 0, 3)
+
+	lastValue := func(name string) float64 {
+		rows, err := view.RetrieveData(name)
+		require.NoError(t, err)
+		for _, row := range rows {
+			for _, tag := range row.Tags {
+				if tag.Key == TagExporterNameKey && tag.Value == "spill-metrics" {
+					return row.Data.(*view.LastValueData).Value
+				}
+			}
+		}
+		t.Fatalf("no %s data recorded", name)
+		return 0
+	}
+	assert.Equal(t, float64(3), lastValue(StatSpillQueueDepth.Name()))
+	assert.Equal(t, float64(q.bytes), lastValue(StatSpillQueueBytes.Name()))
+}
+
+func TestSpillQueueCountsSpansOnceWritten(t *testing.T) {
+	cfg := testSpillQueueConfig(t)
+	defer os.RemoveAll(cfg.Directory)
+
+	const exporterName = "kinesis/spill-spans"
+	fp := &fakePutter{hold: true}
+	q, err := newSpillQueue(cfg, exporterName, "test-stream", fp, zap.NewNop())
+	require.NoError(t, err)
+	defer q.stop()
+
+	// The views are cumulative over the test runs, only their changes are
+	// checked.
+	spilled := viewValue(t, StatSpilledSpanCount.Name(), exporterName)
+	written := viewValue(t, StatStreamSpanCount.Name(), exporterName)
+
+	done := func(error) { t.Error("done called for a queued record") }
+	require.NoError(t, q.putAsync([]byte("a"), "a", 2, done))
+	require.NoError(t, q.putAsync([]byte("b"), "b", 3, done))
+	fp.waitFor(t, 2)
+
+	// The spans are on disk and forwarded, but not written to the stream.
+	assert.Equal(t, float64(5), viewValue(t, StatSpilledSpanCount.Name(), exporterName)-spilled)
+	assert.Equal(t, float64(0), viewValue(t, StatStreamSpanCount.Name(), exporterName)-written)
+
+	fp.complete(1, nil)
+	assert.Equal(t, float64(3), viewValue(t, StatStreamSpanCount.Name(), exporterName)-written)
+	fp.complete(0, errors.New("throttled"))
+	assert.Equal(t, float64(3), viewValue(t, StatStreamSpanCount.Name(), exporterName)-written)
+}
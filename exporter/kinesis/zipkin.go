@@ -0,0 +1,211 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kinesis
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/gogo/protobuf/types"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	zipkinmodel "github.com/openzipkin/zipkin-go/model"
+
+	"github.com/Omnition/omnition-opentelemetry-service/internal/attributes"
+)
+
+const (
+	statusCodeTagKey        = "error"
+	statusDescriptionTagKey = "opencensus.status_description"
+)
+
+// canonicalCodes are the names of the gRPC status codes used by OpenCensus.
+var canonicalCodes = [...]string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// zipkinSpans converts the spans of a batch to the Zipkin v2 model. The local
+// endpoint of all the spans is built from the node of the batch.
+func zipkinSpans(td consumerdata.TraceData) []*zipkinmodel.SpanModel {
+	endpoint := zipkinEndpoint(td.Node)
+	spans := make([]*zipkinmodel.SpanModel, 0, len(td.Spans))
+	for _, span := range td.Spans {
+		if span == nil {
+			continue
+		}
+		spans = append(spans, zipkinSpan(span, endpoint))
+	}
+	return spans
+}
+
+func zipkinSpan(span *tracepb.Span, endpoint *zipkinmodel.Endpoint) *zipkinmodel.SpanModel {
+	z := &zipkinmodel.SpanModel{
+		SpanContext: zipkinmodel.SpanContext{
+			TraceID: zipkinTraceID(span.TraceId),
+			ID:      zipkinmodel.ID(uint64FromBytes(span.SpanId)),
+		},
+		Name:          span.GetName().GetValue(),
+		Kind:          zipkinKind(span.Kind),
+		LocalEndpoint: endpoint,
+	}
+	if id := uint64FromBytes(span.ParentSpanId); id != 0 {
+		parentID := zipkinmodel.ID(id)
+		z.ParentID = &parentID
+	}
+
+	start, end := timestampToTime(span.StartTime), timestampToTime(span.EndTime)
+	z.Timestamp = start
+	if !start.IsZero() && !end.IsZero() {
+		z.Duration = end.Sub(start)
+	}
+
+	z.Tags = zipkinTags(span)
+	z.Annotations = zipkinAnnotations(span.GetTimeEvents())
+	return z
+}
+
+func zipkinTags(span *tracepb.Span) map[string]string {
+	attrs := span.GetAttributes().GetAttributeMap()
+	status := span.GetStatus()
+	if len(attrs) == 0 && status.GetCode() == 0 && status.GetMessage() == "" {
+		return nil
+	}
+
+	tags := make(map[string]string, len(attrs)+2)
+	for key, value := range attrs {
+		if v := attributes.ValueString(value); v != "" {
+			tags[key] = v
+		}
+	}
+	if code := status.GetCode(); code != 0 {
+		if code > 0 && int(code) < len(canonicalCodes) {
+			tags[statusCodeTagKey] = canonicalCodes[code]
+		} else {
+			tags[statusCodeTagKey] = "error code " + strconv.FormatInt(int64(code), 10)
+		}
+	}
+	if msg := status.GetMessage(); msg != "" {
+		tags[statusDescriptionTagKey] = msg
+	}
+	return tags
+}
+
+func zipkinAnnotations(events *tracepb.Span_TimeEvents) []zipkinmodel.Annotation {
+	if len(events.GetTimeEvent()) == 0 {
+		return nil
+	}
+
+	annotations := make([]zipkinmodel.Annotation, 0, len(events.TimeEvent))
+	for _, event := range events.TimeEvent {
+		a := zipkinmodel.Annotation{Timestamp: timestampToTime(event.Time)}
+		switch v := event.Value.(type) {
+		case *tracepb.Span_TimeEvent_Annotation_:
+			a.Value = v.Annotation.GetDescription().GetValue()
+		case *tracepb.Span_TimeEvent_MessageEvent_:
+			switch v.MessageEvent.Type {
+			case tracepb.Span_TimeEvent_MessageEvent_SENT:
+				a.Value = "SENT"
+			case tracepb.Span_TimeEvent_MessageEvent_RECEIVED:
+				a.Value = "RECV"
+			default:
+				a.Value = "<?>"
+			}
+		default:
+			continue
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations
+}
+
+func zipkinKind(kind tracepb.Span_SpanKind) zipkinmodel.Kind {
+	switch kind {
+	case tracepb.Span_CLIENT:
+		return zipkinmodel.Client
+	case tracepb.Span_SERVER:
+		return zipkinmodel.Server
+	}
+	return zipkinmodel.Undetermined
+}
+
+// zipkinEndpoint builds the local endpoint of the spans of a node. The
+// address of the endpoint is read from the "ipv4", "ipv6" and "port" node
+// attributes, like the Zipkin receiver saves them.
+func zipkinEndpoint(node *commonpb.Node) *zipkinmodel.Endpoint {
+	if node == nil {
+		return nil
+	}
+
+	endpoint := &zipkinmodel.Endpoint{ServiceName: serviceName(node)}
+	if ipv4 := node.Attributes["ipv4"]; ipv4 != "" {
+		endpoint.IPv4 = net.ParseIP(ipv4)
+	} else if ipv6 := node.Attributes["ipv6"]; ipv6 != "" {
+		endpoint.IPv6 = net.ParseIP(ipv6)
+	}
+	port, _ := strconv.ParseUint(node.Attributes["port"], 10, 16)
+	endpoint.Port = uint16(port)
+
+	if endpoint.ServiceName == "" && endpoint.IPv4 == nil && endpoint.IPv6 == nil && endpoint.Port == 0 {
+		return nil
+	}
+	return endpoint
+}
+
+func zipkinTraceID(id []byte) zipkinmodel.TraceID {
+	if len(id) != 16 {
+		return zipkinmodel.TraceID{}
+	}
+	return zipkinmodel.TraceID{
+		High: binary.BigEndian.Uint64(id[:8]),
+		Low:  binary.BigEndian.Uint64(id[8:]),
+	}
+}
+
+func uint64FromBytes(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func timestampToTime(ts *types.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	t, err := types.TimestampFromProto(ts)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,38 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package attributes contains helpers for the OpenCensus span attributes.
+package attributes
+
+import (
+	"strconv"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+)
+
+// ValueString formats the value of a span attribute, returning an empty
+// string when the attribute is not set.
+func ValueString(value *tracepb.AttributeValue) string {
+	switch v := value.GetValue().(type) {
+	case *tracepb.AttributeValue_StringValue:
+		return v.StringValue.GetValue()
+	case *tracepb.AttributeValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *tracepb.AttributeValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *tracepb.AttributeValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package attributes
+
+import (
+	"testing"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueString(t *testing.T) {
+	tests := []struct {
+		value *tracepb.AttributeValue
+		want  string
+	}{
+		{nil, ""},
+		{&tracepb.AttributeValue{}, ""},
+		{
+			&tracepb.AttributeValue{Value: &tracepb.AttributeValue_StringValue{
+				StringValue: &tracepb.TruncatableString{Value: "a"}}},
+			"a",
+		},
+		{&tracepb.AttributeValue{Value: &tracepb.AttributeValue_BoolValue{BoolValue: true}}, "true"},
+		{&tracepb.AttributeValue{Value: &tracepb.AttributeValue_IntValue{IntValue: -42}}, "-42"},
+		{&tracepb.AttributeValue{Value: &tracepb.AttributeValue_DoubleValue{DoubleValue: 0.5}}, "0.5"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ValueString(tt.value))
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2019, OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memorylimiter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Paths used to detect the memory available to the process, they are
+// variables so tests can point them to fake files.
+var (
+	cgroupRoot     = "/sys/fs/cgroup"
+	procCgroupPath = "/proc/self/cgroup"
+	mountinfoPath  = "/proc/self/mountinfo"
+	meminfoPath    = "/proc/meminfo"
+)
+
+// Sources of the total memory returned by totalMemory.
+const (
+	memorySourceCgroupV2 = "cgroup-v2"
+	memorySourceCgroupV1 = "cgroup-v1"
+	memorySourceSystem   = "system"
+)
+
+var errNoTotalMemory = errors.New("cannot determine the total memory")
+
+// cgroupPaths are the directories of the cgroup of the process in the cgroup
+// v2 unified hierarchy and in the cgroup v1 memory hierarchy.
+type cgroupPaths struct {
+	v2 string
+	v1 string
+}
+
+// rootCgroupPaths returns the directories of the root cgroups mounted under
+// cgroupRoot, they are the cgroups of a process running in its own cgroup
+// namespace.
+func rootCgroupPaths(cgroupRoot string) cgroupPaths {
+	return cgroupPaths{v2: cgroupRoot, v1: filepath.Join(cgroupRoot, "memory")}
+}
+
+// findCgroupPaths returns the directories of the cgroup of the process, from
+// its cgroup paths in procCgroupPath and the cgroup mounts in mountinfoPath.
+// The root cgroups under cgroupRoot are used for the hierarchies the cgroup
+// can't be found in, for instance if the cgroup isn't mounted.
+func findCgroupPaths(cgroupRoot, procCgroupPath, mountinfoPath string) cgroupPaths {
+	paths := rootCgroupPaths(cgroupRoot)
+	v2Cgroup, v1Cgroup, err := readProcCgroup(procCgroupPath)
+	if err != nil {
+		return paths
+	}
+	v2Mount, v1Mount, err := readCgroupMounts(mountinfoPath)
+	if err != nil {
+		return paths
+	}
+	if dir, ok := v2Mount.dir(v2Cgroup); ok {
+		paths.v2 = dir
+	}
+	if dir, ok := v1Mount.dir(v1Cgroup); ok {
+		paths.v1 = dir
+	}
+	return paths
+}
+
+// readProcCgroup returns the path of the cgroup of the process in the cgroup
+// v2 hierarchy and in the cgroup v1 memory hierarchy, empty if the process
+// isn't in one of them.
+func readProcCgroup(path string) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	var v2Cgroup, v1Cgroup string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The lines are formatted as "hierarchy-id:controllers:path", with
+		// "0::path" for cgroup v2.
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			v2Cgroup = fields[2]
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				v1Cgroup = fields[2]
+			}
+		}
+	}
+	return v2Cgroup, v1Cgroup, scanner.Err()
+}
+
+// cgroupMount is a mount of a cgroup hierarchy, root is the path of the
+// mounted cgroup in the hierarchy.
+type cgroupMount struct {
+	root       string
+	mountPoint string
+}
+
+// dir returns the directory of the cgroup at the given path of the hierarchy,
+// if it is under the mounted cgroup and exists.
+func (m *cgroupMount) dir(cgroup string) (string, bool) {
+	if m == nil || cgroup == "" {
+		return "", false
+	}
+	rel := cgroup
+	if m.root != "/" {
+		// Without a cgroup namespace, the mounted cgroup of a container is
+		// the one of the container.
+		if cgroup != m.root && !strings.HasPrefix(cgroup, m.root+"/") {
+			return "", false
+		}
+		rel = strings.TrimPrefix(cgroup, m.root)
+	}
+	dir := filepath.Join(m.mountPoint, rel)
+	if _, err := os.Stat(dir); err != nil {
+		return "", false
+	}
+	return dir, true
+}
+
+// readCgroupMounts returns the first mounts of the cgroup v2 hierarchy and of
+// the cgroup v1 memory hierarchy, nil if there is none.
+func readCgroupMounts(path string) (*cgroupMount, *cgroupMount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var v2Mount, v1Mount *cgroupMount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The lines are formatted as "id parent major:minor root mount-point
+		// options [optional fields...] - fstype source super-options".
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+3 >= len(fields) {
+			continue
+		}
+		mount := &cgroupMount{root: fields[3], mountPoint: fields[4]}
+		switch fields[sep+1] {
+		case "cgroup2":
+			if v2Mount == nil {
+				v2Mount = mount
+			}
+		case "cgroup":
+			for _, opt := range strings.Split(fields[sep+3], ",") {
+				if opt == "memory" && v1Mount == nil {
+					v1Mount = mount
+				}
+			}
+		}
+	}
+	return v2Mount, v1Mount, scanner.Err()
+}
+
+// totalMemory returns the memory, in bytes, available to the process and its
+// source. It is the cgroup v2 or v1 memory limit when one is set and smaller
+// than the system memory, and the total system memory otherwise.
+func totalMemory(cgroups cgroupPaths, meminfoPath string) (uint64, string, error) {
+	system, err := systemMemory(meminfoPath)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// cgroup v2 uses "max" for no limit.
+	limit, err := readCgroupLimit(filepath.Join(cgroups.v2, "memory.max"))
+	if err == nil {
+		if limit > 0 && limit < system {
+			return limit, memorySourceCgroupV2, nil
+		}
+		return system, memorySourceSystem, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, "", err
+	}
+
+	// cgroup v1 has no value for no limit, it reports a very large number
+	// instead.
+	limit, err = readCgroupLimit(filepath.Join(cgroups.v1, "memory.limit_in_bytes"))
+	if err == nil {
+		if limit > 0 && limit < system {
+			return limit, memorySourceCgroupV1, nil
+		}
+		return system, memorySourceSystem, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, "", err
+	}
+
+	return system, memorySourceSystem, nil
+}
+
+// readCgroupLimit reads a cgroup memory limit file, it returns zero if there
+// is no limit.
+func readCgroupLimit(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cgroup memory limit in %s: %v", path, err)
+	}
+	return limit, nil
+}
+
+// systemMemory returns the total system memory, in bytes, read from the
+// MemTotal line of /proc/meminfo.
+func systemMemory(meminfoPath string) (uint64, error) {
+	f, err := os.Open(meminfoPath)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", errNoTotalMemory, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The line is formatted as "MemTotal:       16314428 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "MemTotal:" || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%v: invalid MemTotal in %s: %v", errNoTotalMemory, meminfoPath, err)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("%v: %v", errNoTotalMemory, err)
+	}
+	return 0, fmt.Errorf("%v: no MemTotal in %s", errNoTotalMemory, meminfoPath)
+}
@@ -0,0 +1,210 @@
+// Copyright 2019, OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memorylimiter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMeminfo = `MemTotal:        4194304 kB
+MemFree:         1048576 kB
+MemAvailable:    2097152 kB
+`
+
+// fakeMemoryFiles writes the given files, relative to a temporary directory,
+// and returns the directory.
+func fakeMemoryFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "memorylimiter")
+	require.NoError(t, err)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestTotalMemory(t *testing.T) {
+	const systemBytes = 4194304 * 1024
+	tests := []struct {
+		name       string
+		files      map[string]string
+		wantBytes  uint64
+		wantSource string
+	}{
+		{
+			name:       "no_cgroup",
+			files:      map[string]string{"meminfo": testMeminfo},
+			wantBytes:  systemBytes,
+			wantSource: memorySourceSystem,
+		},
+		{
+			name: "cgroup_v2",
+			files: map[string]string{
+				"meminfo":           testMeminfo,
+				"cgroup/memory.max": "1073741824\n",
+			},
+			wantBytes:  1073741824,
+			wantSource: memorySourceCgroupV2,
+		},
+		{
+			name: "cgroup_v2_no_limit",
+			files: map[string]string{
+				"meminfo":           testMeminfo,
+				"cgroup/memory.max": "max\n",
+			},
+			wantBytes:  systemBytes,
+			wantSource: memorySourceSystem,
+		},
+		{
+			name: "cgroup_v1",
+			files: map[string]string{
+				"meminfo":                             testMeminfo,
+				"cgroup/memory/memory.limit_in_bytes": "536870912\n",
+			},
+			wantBytes:  536870912,
+			wantSource: memorySourceCgroupV1,
+		},
+		{
+			name: "cgroup_v1_no_limit",
+			files: map[string]string{
+				"meminfo":                             testMeminfo,
+				"cgroup/memory/memory.limit_in_bytes": "9223372036854771712\n",
+			},
+			wantBytes:  systemBytes,
+			wantSource: memorySourceSystem,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := fakeMemoryFiles(t, tt.files)
+			defer os.RemoveAll(dir)
+
+			total, source, err := totalMemory(rootCgroupPaths(filepath.Join(dir, "cgroup")), filepath.Join(dir, "meminfo"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantBytes, total)
+			assert.Equal(t, tt.wantSource, source)
+		})
+	}
+}
+
+func TestTotalMemoryErrors(t *testing.T) {
+	dir := fakeMemoryFiles(t, map[string]string{
+		"meminfo":           testMeminfo,
+		"cgroup/memory.max": "lots\n",
+		"empty_meminfo":     "MemFree: 1048576 kB\n",
+	})
+	defer os.RemoveAll(dir)
+
+	_, _, err := totalMemory(rootCgroupPaths(filepath.Join(dir, "cgroup")), filepath.Join(dir, "meminfo"))
+	assert.Error(t, err)
+
+	_, _, err = totalMemory(rootCgroupPaths(filepath.Join(dir, "none")), filepath.Join(dir, "empty_meminfo"))
+	assert.Error(t, err)
+
+	_, _, err = totalMemory(rootCgroupPaths(filepath.Join(dir, "none")), filepath.Join(dir, "none"))
+	assert.Error(t, err)
+}
+
+func TestFindCgroupPaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		cgroup    string
+		mountinfo string
+		dirs      []string
+		want      cgroupPaths
+	}{
+		{
+			name:      "cgroup_v2_nested",
+			cgroup:    "0::/system.slice/otelsvc.service\n",
+			mountinfo: "30 25 0:26 / {dir}/unified rw,nosuid shared:9 - cgroup2 cgroup2 rw,nsdelegate\n",
+			dirs:      []string{"unified/system.slice/otelsvc.service"},
+			want:      cgroupPaths{v2: "{dir}/unified/system.slice/otelsvc.service", v1: "{root}/memory"},
+		},
+		{
+			name: "cgroup_v1_container",
+			cgroup: "12:cpu,cpuacct:/docker/abc\n" +
+				"11:memory:/docker/abc\n" +
+				"0::/docker/abc\n",
+			mountinfo: "40 35 0:35 /docker/abc {dir}/cpu rw - cgroup cgroup rw,cpu,cpuacct\n" +
+				"41 35 0:36 /docker/abc {dir}/memory rw - cgroup cgroup rw,memory\n",
+			dirs: []string{"memory"},
+			want: cgroupPaths{v2: "{root}", v1: "{dir}/memory"},
+		},
+		{
+			name:      "cgroup_v1_nested",
+			cgroup:    "11:memory:/kubepods/pod1/abc\n",
+			mountinfo: "41 35 0:36 /kubepods {dir}/memory rw shared:20 - cgroup cgroup rw,memory\n",
+			dirs:      []string{"memory/pod1/abc"},
+			want:      cgroupPaths{v2: "{root}", v1: "{dir}/memory/pod1/abc"},
+		},
+		{
+			name:      "cgroup_namespace",
+			cgroup:    "0::/\n",
+			mountinfo: "30 25 0:26 / {dir}/unified rw - cgroup2 cgroup2 rw\n",
+			dirs:      []string{"unified"},
+			want:      cgroupPaths{v2: "{dir}/unified", v1: "{root}/memory"},
+		},
+		{
+			name:      "outside_mount",
+			cgroup:    "11:memory:/other\n",
+			mountinfo: "41 35 0:36 /docker/abc {dir}/memory rw - cgroup cgroup rw,memory\n",
+			dirs:      []string{"memory"},
+			want:      rootCgroupPaths("{root}"),
+		},
+		{
+			name:      "missing_dir",
+			cgroup:    "0::/user.slice\n",
+			mountinfo: "30 25 0:26 / {dir}/unified rw - cgroup2 cgroup2 rw\n",
+			want:      rootCgroupPaths("{root}"),
+		},
+		{
+			name:   "no_mount",
+			cgroup: "0::/user.slice\n",
+			want:   rootCgroupPaths("{root}"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := fakeMemoryFiles(t, map[string]string{"cgroup": tt.cgroup})
+			defer os.RemoveAll(dir)
+			root := filepath.Join(dir, "root")
+			for _, d := range tt.dirs {
+				require.NoError(t, os.MkdirAll(filepath.Join(dir, d), 0755))
+			}
+			mountinfo := strings.Replace(tt.mountinfo, "{dir}", dir, -1)
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "mountinfo"), []byte(mountinfo), 0644))
+			replace := func(path string) string {
+				path = strings.Replace(path, "{root}", root, -1)
+				return strings.Replace(path, "{dir}", dir, -1)
+			}
+			want := cgroupPaths{v2: replace(tt.want.v2), v1: replace(tt.want.v1)}
+
+			got := findCgroupPaths(root, filepath.Join(dir, "cgroup"), filepath.Join(dir, "mountinfo"))
+			assert.Equal(t, want, got)
+		})
+	}
+
+	// Without the proc files the root cgroups are used.
+	got := findCgroupPaths("/sys/fs/cgroup", "/nonexistent/cgroup", "/nonexistent/mountinfo")
+	assert.Equal(t, rootCgroupPaths("/sys/fs/cgroup"), got)
+}
@@ -40,7 +40,83 @@ type Config struct {
 	// measurements of memory usage.
 	MemorySpikeLimitMiB uint32 `mapstructure:"spike-limit-mib"`
 
-	// BallastSizeMiB is the size, in MiB, of the ballast size being used by the
-	// process.
+	// MemoryLimitPercentage is the maximum amount of memory, as a percentage
+	// of the memory available to the process, targeted to be allocated by the
+	// process. The available memory is the cgroup memory limit or, when there
+	// is none, the total system memory. It can't be used with MemoryLimitMiB.
+	MemoryLimitPercentage uint32 `mapstructure:"limit-percentage"`
+
+	// MemorySpikeLimitPercentage is the maximum spike expected between the
+	// measurements of memory usage, as a percentage of the memory available
+	// to the process. It can't be used with MemorySpikeLimitMiB.
+	MemorySpikeLimitPercentage uint32 `mapstructure:"spike-limit-percentage"`
+
+	// SoftLimitMiB is the amount of memory, in MiB, above which new data is
+	// refused with a retryable error instead of being dropped. It must be
+	// smaller than the hard limit, MemoryLimitMiB minus MemorySpikeLimitMiB,
+	// data is only dropped above the hard limit. Zero disables the soft limit.
+	SoftLimitMiB uint32 `mapstructure:"soft-limit-mib"`
+
+	// SoftLimitDelay is the maximum time data above the soft limit is held,
+	// waiting for the memory usage to go back under the soft limit, before
+	// being refused. Defaults to zero, data is refused right away.
+	SoftLimitDelay time.Duration `mapstructure:"soft-limit-delay"`
+
+	// BallastSizeMiB is the size, in MiB, of the memory ballast allocated and
+	// held by the processor, it isn't counted in the memory usage. All the
+	// processors share the same ballast, so they must all set the same size
+	// or none. It replaces the service mem-ballast-size-mib flag, which must
+	// be left unset: the processors don't know the size of the service
+	// ballast, so it would be counted in the memory usage.
 	BallastSizeMiB uint32 `mapstructure:"ballast-size-mib"`
+
+	// MinGCInterval is the minimum time between the GCs forced while above
+	// the hard limit. Defaults to zero, a GC is forced on every check.
+	MinGCInterval time.Duration `mapstructure:"min-gc-interval"`
+
+	// FreeOSMemory indicates to also return the memory to the operating
+	// system when forcing a GC, using debug.FreeOSMemory.
+	FreeOSMemory bool `mapstructure:"free-os-memory"`
+
+	// GCPercent, when set, is the GC percent, see debug.SetGCPercent, used
+	// while above the hard limit instead of forcing GCs. The previous value is
+	// restored once under the hard limit. When several processors set it, the
+	// lowest percent of the ones above their hard limit is used. It can't be
+	// used with FreeOSMemory.
+	GCPercent uint32 `mapstructure:"gc-percent"`
+
+	// Priorities are the rules giving a priority to the data. Above the soft
+	// limit only the data without priority is refused. Above the hard limit
+	// the data with the lowest priorities is dropped first, the higher the
+	// memory usage the higher the priority dropped, and all the data is
+	// dropped at the limit.
+	Priorities []PriorityConfig `mapstructure:"priorities"`
+
+	// Measures are the memory measures the limits apply to, the highest of
+	// them is compared to the limits. They can be "heap", the Go heap
+	// allocated memory minus the ballast, "rss", the resident set size of the
+	// process, and "cgroup", the memory usage of the process cgroup, which
+	// also counts the page cache. Defaults to "heap".
+	Measures []string `mapstructure:"measures"`
+}
+
+// PriorityConfig defines a rule giving a priority to the spans, and metrics,
+// matching all its conditions. Data matching several rules gets the highest
+// priority, data matching none has priority zero.
+type PriorityConfig struct {
+	// Priority is the priority of the matching data, it must be greater than
+	// zero.
+	Priority uint32 `mapstructure:"priority"`
+
+	// ServiceName is the service name the data must come from. Rules with
+	// only a service name also apply to metrics.
+	ServiceName string `mapstructure:"service-name"`
+
+	// SpanAttributes are the attribute values the spans must have, for
+	// example error: "true".
+	SpanAttributes map[string]string `mapstructure:"span-attributes"`
+
+	// SamplingPriority is the minimum sampling.priority attribute the spans
+	// must have.
+	SamplingPriority int64 `mapstructure:"sampling-priority"`
 }
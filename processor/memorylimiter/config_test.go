@@ -63,6 +63,34 @@ func TestLoadConfig(t *testing.T) {
 			CheckInterval:       250 * time.Millisecond,
 			MemoryLimitMiB:      4000,
 			MemorySpikeLimitMiB: 500,
+			SoftLimitMiB:        3000,
+			SoftLimitDelay:      time.Second,
 			BallastSizeMiB:      2000,
+			MinGCInterval:       5 * time.Second,
+			FreeOSMemory:        true,
+			Priorities: []PriorityConfig{
+				{
+					Priority:       10,
+					SpanAttributes: map[string]string{"error": "true"},
+				},
+				{
+					Priority:         5,
+					ServiceName:      "checkout",
+					SamplingPriority: 1,
+				},
+			},
+		})
+	p2 := config.Processors["memory-limiter/with-percentages"]
+	assert.Equal(t, p2,
+		&Config{
+			ProcessorSettings: configmodels.ProcessorSettings{
+				TypeVal: "memory-limiter",
+				NameVal: "memory-limiter/with-percentages",
+			},
+			CheckInterval:              time.Second,
+			MemoryLimitPercentage:      80,
+			MemorySpikeLimitPercentage: 15,
+			GCPercent:                  50,
+			Measures:                   []string{"heap", "rss"},
 		})
 }
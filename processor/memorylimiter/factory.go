@@ -15,21 +15,58 @@
 package memorylimiter
 
 import (
+	"errors"
+	"sync"
+
 	"go.uber.org/zap"
 
-	"github.com/open-telemetry/opentelemetry-service/config/configerror"
 	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
 	"github.com/open-telemetry/opentelemetry-service/consumer"
+	"github.com/open-telemetry/opentelemetry-service/oterr"
 	"github.com/open-telemetry/opentelemetry-service/processor"
 )
 
 const (
 	// The value of "type" Attribute Key in configuration.
 	typeStr = "memory-limiter"
+
+	mibBytes = 1024 * 1024
+)
+
+var (
+	errLimitAndPercentage = errors.New(
+		"limit-mib and spike-limit-mib can't be used with limit-percentage or spike-limit-percentage")
+
+	errPercentageOutOfRange = errors.New(
+		"limit-percentage and spike-limit-percentage must be at most 100")
+
+	errBallastSizeMismatch = errors.New(
+		"ballast-size-mib must be the same, or unset, for all the memory-limiter processors")
 )
 
 // Factory is the factory for Attribute Key processor.
 type Factory struct {
+	mu sync.Mutex
+	// checkers holds the memory checker of each processor configuration, so
+	// the trace and metrics processors created from the same configuration
+	// share the same memory checks. A checker is removed once all the
+	// processors using it are shut down.
+	checkers map[string]*memoryChecker
+	// processors holds the processors created by the factory and not shut
+	// down yet, so they can be shut down with it.
+	processors []*memoryLimiter
+
+	// ballast is the memory ballast allocated for the ballast-size-mib
+	// setting. There is a single ballast for the process, shared by all the
+	// processors, it is held by the factory until the last of them is shut
+	// down. ballastSet is true once a processor set its size, zero included.
+	ballast    []byte
+	ballastSet bool
+
+	// gcPercent is shared by the checkers setting gc-percent, so that the
+	// process GC percent is restored once none of them is above its hard
+	// limit.
+	gcPercent sharedGCPercent
 }
 
 // Type gets the type of the config created by this factory.
@@ -54,16 +91,23 @@ func (f *Factory) CreateTraceProcessor(
 	nextConsumer consumer.TraceConsumer,
 	cfg configmodels.Processor,
 ) (processor.TraceProcessor, error) {
-	const mibBytes = 1024 * 1024
-	pCfg := cfg.(*Config)
-	return New(
-		cfg.Name(),
-		nextConsumer,
-		pCfg.CheckInterval,
-		uint64(pCfg.MemoryLimitMiB)*mibBytes,
-		uint64(pCfg.MemorySpikeLimitMiB)*mibBytes,
-		uint64(pCfg.BallastSizeMiB)*mibBytes,
-	)
+	if nextConsumer == nil {
+		return nil, errNilNextConsumer
+	}
+	// The processor starts using the checker with the factory locked, so
+	// the checker isn't released by the factory meanwhile.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	checker, err := f.getChecker(logger, cfg.(*Config))
+	if err != nil {
+		return nil, err
+	}
+	tp, err := newTraceProcessor(cfg.Name(), nextConsumer, checker)
+	if err != nil {
+		return nil, err
+	}
+	f.processors = append(f.processors, tp.(*memoryLimiter))
+	return tp, nil
 }
 
 // CreateMetricsProcessor creates a metrics processor based on this config.
@@ -72,5 +116,174 @@ func (f *Factory) CreateMetricsProcessor(
 	nextConsumer consumer.MetricsConsumer,
 	cfg configmodels.Processor,
 ) (processor.MetricsProcessor, error) {
-	return nil, configerror.ErrDataTypeIsNotSupported
+	if nextConsumer == nil {
+		return nil, errNilNextConsumer
+	}
+	// The processor starts using the checker with the factory locked, so
+	// the checker isn't released by the factory meanwhile.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	checker, err := f.getChecker(logger, cfg.(*Config))
+	if err != nil {
+		return nil, err
+	}
+	mp, err := newMetricsProcessor(cfg.Name(), nextConsumer, checker)
+	if err != nil {
+		return nil, err
+	}
+	f.processors = append(f.processors, mp.(*memoryLimiter))
+	return mp, nil
+}
+
+// Shutdown shuts down all the processors created by the factory that are not
+// shut down yet. Shutting down the processors releases their memory checks,
+// and the memory ballast with the last one. The service doesn't shut down the
+// processors, the program calls it once the service returned.
+func (f *Factory) Shutdown() error {
+	f.mu.Lock()
+	processors := f.processors
+	f.mu.Unlock()
+
+	var errs []error
+	for _, ml := range processors {
+		if err := ml.Shutdown(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return oterr.CombineErrors(errs)
+}
+
+// releaseChecker is called once all the processors using the checker are shut
+// down, it removes the checker and its processors and, when no checker is
+// left, releases the memory ballast.
+func (f *Factory) releaseChecker(mc *memoryChecker) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// A processor was created from the same configuration meanwhile.
+	if mc.hasUsers() {
+		return
+	}
+	for name, checker := range f.checkers {
+		if checker == mc {
+			delete(f.checkers, name)
+		}
+	}
+	var processors []*memoryLimiter
+	for _, ml := range f.processors {
+		if ml.checker != mc {
+			processors = append(processors, ml)
+		}
+	}
+	f.processors = processors
+	if len(f.checkers) == 0 {
+		f.ballast = nil
+		f.ballastSet = false
+	}
+}
+
+// getChecker returns the memory checker for the configuration, creating it
+// the first time the configuration is used. It must be called with f.mu held.
+func (f *Factory) getChecker(logger *zap.Logger, pCfg *Config) (*memoryChecker, error) {
+	if checker, ok := f.checkers[pCfg.Name()]; ok {
+		return checker, nil
+	}
+
+	memAllocLimit, memSpikeLimit, err := memoryLimits(logger, pCfg)
+	if err != nil {
+		return nil, err
+	}
+	prioritizer, err := newPrioritizer(pCfg.Priorities)
+	if err != nil {
+		return nil, err
+	}
+	measures, err := newMemoryMeasures(pCfg.Measures)
+	if err != nil {
+		return nil, err
+	}
+	ballastSize, err := f.ballastSize(pCfg)
+	if err != nil {
+		return nil, err
+	}
+	checker, err := newMemoryChecker(
+		pCfg.Name(),
+		pCfg.CheckInterval,
+		memAllocLimit,
+		memSpikeLimit,
+		uint64(pCfg.SoftLimitMiB)*mibBytes,
+		pCfg.SoftLimitDelay,
+		ballastSize,
+		gcConfig{
+			minInterval:  pCfg.MinGCInterval,
+			freeOSMemory: pCfg.FreeOSMemory,
+			percent:      int(pCfg.GCPercent),
+		},
+		prioritizer,
+		measures,
+	)
+	if err != nil {
+		return nil, err
+	}
+	f.allocateBallast(logger, ballastSize)
+	checker.gcPercent = &f.gcPercent
+	checker.idleFn = f.releaseChecker
+	if f.checkers == nil {
+		f.checkers = make(map[string]*memoryChecker)
+	}
+	f.checkers[pCfg.Name()] = checker
+	return checker, nil
+}
+
+// ballastSize returns the size of the memory ballast the checker of the
+// configuration doesn't count in the memory usage. The processors must all use the same size, set by
+// the first one created, so that no checker counts the ballast as memory
+// usage.
+func (f *Factory) ballastSize(pCfg *Config) (uint64, error) {
+	size := uint64(pCfg.BallastSizeMiB) * mibBytes
+	if f.ballastSet && uint64(len(f.ballast)) != size {
+		return 0, errBallastSizeMismatch
+	}
+	return size, nil
+}
+
+// allocateBallast allocates the memory ballast the first time a processor is
+// created, if it sets a ballast size.
+func (f *Factory) allocateBallast(logger *zap.Logger, size uint64) {
+	if f.ballastSet {
+		return
+	}
+	f.ballastSet = true
+	if size != 0 {
+		f.ballast = make([]byte, size)
+		logger.Info("Using memory ballast", zap.Uint64("MiBs", size/mibBytes))
+	}
+}
+
+// memoryLimits returns the limit and spike limit, in bytes, set by the
+// configuration either as absolute values or as percentages of the memory
+// available to the process.
+func memoryLimits(logger *zap.Logger, pCfg *Config) (uint64, uint64, error) {
+	if pCfg.MemoryLimitPercentage == 0 && pCfg.MemorySpikeLimitPercentage == 0 {
+		return uint64(pCfg.MemoryLimitMiB) * mibBytes, uint64(pCfg.MemorySpikeLimitMiB) * mibBytes, nil
+	}
+	if pCfg.MemoryLimitMiB != 0 || pCfg.MemorySpikeLimitMiB != 0 {
+		return 0, 0, errLimitAndPercentage
+	}
+	if pCfg.MemoryLimitPercentage > 100 || pCfg.MemorySpikeLimitPercentage > 100 {
+		return 0, 0, errPercentageOutOfRange
+	}
+
+	total, source, err := totalMemory(findCgroupPaths(cgroupRoot, procCgroupPath, mountinfoPath), meminfoPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	memAllocLimit := total / 100 * uint64(pCfg.MemoryLimitPercentage)
+	memSpikeLimit := total / 100 * uint64(pCfg.MemorySpikeLimitPercentage)
+	logger.Info("Memory limiter limits computed from the total memory",
+		zap.String("processor", pCfg.Name()),
+		zap.String("source", source),
+		zap.Uint64("total-mib", total/mibBytes),
+		zap.Uint64("limit-mib", memAllocLimit/mibBytes),
+		zap.Uint64("spike-limit-mib", memSpikeLimit/mibBytes))
+	return memAllocLimit, memSpikeLimit, nil
 }
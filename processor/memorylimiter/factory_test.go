@@ -15,12 +15,16 @@
 package memorylimiter
 
 import (
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/open-telemetry/opentelemetry-service/exporter/exportertest"
 )
@@ -44,9 +48,9 @@ func TestCreateProcessor(t *testing.T) {
 	assert.Nil(t, tp)
 	assert.Error(t, err, "created processor with invalid settings")
 
-	mp, err := factory.CreateMetricsProcessor(zap.NewNop(), nil, cfg)
+	mp, err := factory.CreateMetricsProcessor(zap.NewNop(), exportertest.NewNopMetricsExporter(), cfg)
 	assert.Nil(t, mp)
-	assert.Error(t, err, "should not be able to create metric processor")
+	assert.Error(t, err, "created processor with invalid settings")
 
 	// Create processor with a valid config.
 	pCfg := cfg.(*Config)
@@ -57,6 +61,244 @@ func TestCreateProcessor(t *testing.T) {
 	tp, err = factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), cfg)
 	assert.NoError(t, err)
 	assert.NotNil(t, tp)
-	tp.(*memoryLimiter).stopCheck()
 
+	mp, err = factory.CreateMetricsProcessor(zap.NewNop(), exportertest.NewNopMetricsExporter(), cfg)
+	assert.NoError(t, err)
+	assert.NotNil(t, mp)
+
+	// The trace and metrics processors of the same configuration share the
+	// memory checker.
+	assert.True(t, tp.(*memoryLimiter).checker == mp.(*memoryLimiter).checker)
+	assert.NoError(t, factory.Shutdown())
+}
+
+func TestCreateProcessorWithPercentages(t *testing.T) {
+	dir := fakeMemoryFiles(t, map[string]string{
+		"meminfo":           testMeminfo,
+		"cgroup/memory.max": "1073741824\n",
+	})
+	defer os.RemoveAll(dir)
+	defer func(root, procCgroup, meminfo string) {
+		cgroupRoot, procCgroupPath, meminfoPath = root, procCgroup, meminfo
+	}(cgroupRoot, procCgroupPath, meminfoPath)
+	cgroupRoot = filepath.Join(dir, "cgroup")
+	procCgroupPath = filepath.Join(dir, "none")
+	meminfoPath = filepath.Join(dir, "meminfo")
+
+	factory := &Factory{}
+	pCfg := factory.CreateDefaultConfig().(*Config)
+	pCfg.CheckInterval = 100 * time.Millisecond
+	pCfg.MemoryLimitPercentage = 50
+	pCfg.MemorySpikeLimitPercentage = 10
+
+	core, logs := observer.New(zap.InfoLevel)
+	tp, err := factory.CreateTraceProcessor(zap.New(core), exportertest.NewNopTraceExporter(), pCfg)
+	require.NoError(t, err)
+	defer factory.Shutdown()
+	checker := tp.(*memoryLimiter).checker
+
+	// The limits are computed from the 1GiB cgroup limit.
+	assert.Equal(t, uint64(1073741824/100*50), checker.memAllocLimit)
+	assert.Equal(t, uint64(1073741824/100*10), checker.memSpikeLimit)
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, map[string]interface{}{
+		"processor":       "memory-limiter",
+		"source":          memorySourceCgroupV2,
+		"total-mib":       uint64(1024),
+		"limit-mib":       uint64(511),
+		"spike-limit-mib": uint64(102),
+	}, logs.All()[0].ContextMap())
+
+	// Absolute values and percentages can't be mixed.
+	pCfg.MemoryLimitMiB = 512
+	factory = &Factory{}
+	_, err = factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), pCfg)
+	assert.Equal(t, errLimitAndPercentage, err)
+
+	pCfg.MemoryLimitMiB = 0
+	pCfg.MemoryLimitPercentage = 101
+	_, err = factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), pCfg)
+	assert.Equal(t, errPercentageOutOfRange, err)
+}
+
+func TestCreateProcessorAllocatesBallast(t *testing.T) {
+	factory := &Factory{}
+	newConfig := func(name string, ballastSizeMiB uint32) *Config {
+		pCfg := factory.CreateDefaultConfig().(*Config)
+		pCfg.NameVal = name
+		pCfg.CheckInterval = 100 * time.Millisecond
+		pCfg.MemoryLimitMiB = 1024
+		pCfg.BallastSizeMiB = ballastSizeMiB
+		return pCfg
+	}
+
+	defer factory.Shutdown()
+
+	tp, err := factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), newConfig("memory-limiter/a", 4))
+	require.NoError(t, err)
+	require.Len(t, factory.ballast, 4*1024*1024)
+	ballast := factory.ballast
+	assert.Equal(t, uint64(len(ballast)), tp.(*memoryLimiter).checker.ballastSize)
+
+	// Another processor shares the same ballast.
+	mp, err := factory.CreateMetricsProcessor(zap.NewNop(), exportertest.NewNopMetricsExporter(), newConfig("memory-limiter/b", 4))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(ballast)), mp.(*memoryLimiter).checker.ballastSize)
+	assert.True(t, &ballast[0] == &factory.ballast[0], "ballast allocated twice")
+
+	// The processors must all use the same size.
+	_, err = factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), newConfig("memory-limiter/c", 8))
+	assert.Equal(t, errBallastSizeMismatch, err)
+
+	// Processors without ballast would count it in their memory usage.
+	_, err = factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), newConfig("memory-limiter/d", 0))
+	assert.Equal(t, errBallastSizeMismatch, err)
+	assert.Len(t, factory.ballast, 4*1024*1024)
+
+	// Once a processor without ballast is created, none can set one.
+	require.NoError(t, factory.Shutdown())
+	tp, err = factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), newConfig("memory-limiter/a", 0))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), tp.(*memoryLimiter).checker.ballastSize)
+	_, err = factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), newConfig("memory-limiter/b", 4))
+	assert.Equal(t, errBallastSizeMismatch, err)
+	assert.Nil(t, factory.ballast)
+}
+
+func TestFactoryShutdown(t *testing.T) {
+	factory := &Factory{}
+	pCfg := factory.CreateDefaultConfig().(*Config)
+	pCfg.CheckInterval = time.Millisecond
+	pCfg.MemoryLimitMiB = 1024
+	pCfg.BallastSizeMiB = 1
+
+	tp, err := factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), pCfg)
+	require.NoError(t, err)
+	mp, err := factory.CreateMetricsProcessor(zap.NewNop(), exportertest.NewNopMetricsExporter(), pCfg)
+	require.NoError(t, err)
+
+	// The goroutine checking the memory usage is stopped by the factory,
+	// which the goroutine leak checker of TestMain verifies.
+	checker := tp.(*memoryLimiter).checker
+	assert.Equal(t, 2, checkerUsers(checker))
+	assert.NoError(t, factory.Shutdown())
+	assert.Equal(t, 0, checkerUsers(checker))
+	assert.Nil(t, factory.ballast)
+
+	// Shutting down the processors again is harmless.
+	assert.NoError(t, tp.(*memoryLimiter).Shutdown())
+	assert.NoError(t, mp.(*memoryLimiter).Shutdown())
+	assert.NoError(t, factory.Shutdown())
+}
+
+func TestProcessorsShutdownReleaseChecker(t *testing.T) {
+	factory := &Factory{}
+	newConfig := func(name string) *Config {
+		pCfg := factory.CreateDefaultConfig().(*Config)
+		pCfg.NameVal = name
+		pCfg.CheckInterval = time.Millisecond
+		pCfg.MemoryLimitMiB = 1024
+		pCfg.BallastSizeMiB = 1
+		return pCfg
+	}
+
+	tpA, err := factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), newConfig("memory-limiter/a"))
+	require.NoError(t, err)
+	mpA, err := factory.CreateMetricsProcessor(zap.NewNop(), exportertest.NewNopMetricsExporter(), newConfig("memory-limiter/a"))
+	require.NoError(t, err)
+	tpB, err := factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), newConfig("memory-limiter/b"))
+	require.NoError(t, err)
+	require.Len(t, factory.ballast, 1024*1024)
+
+	// The checker is released with the last processor of its configuration,
+	// without the factory being shut down.
+	assert.NoError(t, tpA.(*memoryLimiter).Shutdown())
+	assert.Contains(t, factory.checkers, "memory-limiter/a")
+	assert.NoError(t, mpA.(*memoryLimiter).Shutdown())
+	assert.NotContains(t, factory.checkers, "memory-limiter/a")
+	assert.Len(t, factory.processors, 1)
+	assert.Len(t, factory.ballast, 1024*1024)
+
+	// The ballast is released with the last checker.
+	assert.NoError(t, tpB.(*memoryLimiter).Shutdown())
+	assert.Empty(t, factory.checkers)
+	assert.Empty(t, factory.processors)
+	assert.Nil(t, factory.ballast)
+
+	// Processors created afterwards get new checks and ballast.
+	pCfg := newConfig("memory-limiter/a")
+	pCfg.BallastSizeMiB = 2
+	tp, err := factory.CreateTraceProcessor(zap.NewNop(), exportertest.NewNopTraceExporter(), pCfg)
+	require.NoError(t, err)
+	assert.False(t, tp.(*memoryLimiter).checker == tpA.(*memoryLimiter).checker)
+	assert.Len(t, factory.ballast, 2*1024*1024)
+	assert.NoError(t, tp.(*memoryLimiter).Shutdown())
+	assert.Nil(t, factory.ballast)
+
+	// Nothing is left for the factory to shut down.
+	assert.NoError(t, factory.Shutdown())
+}
+
+func TestGCPercentSharedByCheckers(t *testing.T) {
+	factory := &Factory{}
+	gcPercent := 100
+	var setPercents []int
+	factory.gcPercent.setFn = func(percent int) int {
+		setPercents = append(setPercents, percent)
+		prev := gcPercent
+		gcPercent = percent
+		return prev
+	}
+
+	memAllocs := map[string]uint64{}
+	newChecker := func(name string, percent uint32) *memoryChecker {
+		pCfg := factory.CreateDefaultConfig().(*Config)
+		pCfg.NameVal = name
+		pCfg.CheckInterval = time.Second
+		pCfg.MemoryLimitMiB = 1024
+		pCfg.MemorySpikeLimitMiB = 256
+		pCfg.GCPercent = percent
+		checker, err := factory.getChecker(zap.NewNop(), pCfg)
+		require.NoError(t, err)
+		checker.readMemStatsFn = func(ms *runtime.MemStats) {
+			ms.Alloc = memAllocs[name]
+		}
+		return checker
+	}
+	a := newChecker("memory-limiter/a", 20)
+	b := newChecker("memory-limiter/b", 50)
+	check := func(aMiB, bMiB uint64) {
+		memAllocs["memory-limiter/a"] = aMiB * mibBytes
+		memAllocs["memory-limiter/b"] = bMiB * mibBytes
+		a.memCheck()
+		b.memCheck()
+	}
+
+	// The checkers overlapping above their hard limit use the lowest GC
+	// percent, the original one is restored when both are back under it,
+	// whatever the order they go back under it in.
+	check(900, 100)
+	assert.Equal(t, 20, gcPercent)
+	check(900, 900)
+	assert.Equal(t, 20, gcPercent)
+	check(100, 900)
+	assert.Equal(t, 50, gcPercent)
+	check(100, 100)
+	assert.Equal(t, 100, gcPercent)
+	assert.Equal(t, []int{20, 50, 100}, setPercents)
+
+	setPercents = nil
+	check(100, 900)
+	check(900, 900)
+	check(900, 100)
+	assert.Equal(t, 20, gcPercent)
+	check(100, 100)
+	assert.Equal(t, 100, gcPercent)
+	assert.Equal(t, []int{50, 20, 100}, setPercents)
+
+	// A checker stopping above its hard limit restores the GC percent too.
+	check(900, 100)
+	assert.Equal(t, 20, gcPercent)
+	a.restoreGCPercent()
+	assert.Equal(t, 100, gcPercent)
 }
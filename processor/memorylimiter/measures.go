@@ -0,0 +1,116 @@
+// Copyright 2019, OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memorylimiter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Names of the memory measures the limits can apply to.
+const (
+	measureHeap   = "heap"
+	measureRSS    = "rss"
+	measureCgroup = "cgroup"
+)
+
+// statmPath is the file the resident set size is read from, it is a variable
+// so tests can point it to a fake file.
+var statmPath = "/proc/self/statm"
+
+// memoryMeasure measures the memory used by the process, in bytes. The heap
+// measure is read from the memory stats, the others from the system.
+type memoryMeasure struct {
+	name string
+	read func(ms *runtime.MemStats) (uint64, error)
+}
+
+// newMemoryMeasures returns the measures with the given names, the heap one
+// if there is none. Each of them is read once to make sure it is available.
+func newMemoryMeasures(names []string) ([]memoryMeasure, error) {
+	if len(names) == 0 {
+		names = []string{measureHeap}
+	}
+	measures := make([]memoryMeasure, 0, len(names))
+	for _, name := range names {
+		var read func(ms *runtime.MemStats) (uint64, error)
+		switch name {
+		case measureHeap:
+			read = func(ms *runtime.MemStats) (uint64, error) { return ms.Alloc, nil }
+		case measureRSS:
+			path, pageSize := statmPath, uint64(os.Getpagesize())
+			read = func(*runtime.MemStats) (uint64, error) { return residentSetSize(path, pageSize) }
+		case measureCgroup:
+			cgroups := findCgroupPaths(cgroupRoot, procCgroupPath, mountinfoPath)
+			read = func(*runtime.MemStats) (uint64, error) { return cgroupMemoryUsage(cgroups) }
+		default:
+			return nil, fmt.Errorf("unknown memory measure %q, it must be %s, %s or %s",
+				name, measureHeap, measureRSS, measureCgroup)
+		}
+		if _, err := read(&runtime.MemStats{}); err != nil {
+			return nil, fmt.Errorf("memory measure %q is not available: %v", name, err)
+		}
+		measures = append(measures, memoryMeasure{name: name, read: read})
+	}
+	return measures, nil
+}
+
+// residentSetSize returns the resident set size of the process, the second
+// field of the statm file is its number of pages.
+func residentSetSize(statmPath string, pageSize uint64) (uint64, error) {
+	data, err := ioutil.ReadFile(statmPath)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("invalid %s content %q", statmPath, data)
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid resident pages in %s: %v", statmPath, err)
+	}
+	return pages * pageSize, nil
+}
+
+// cgroupMemoryUsage returns the memory usage of the cgroup of the process,
+// from cgroup v2 memory.current or cgroup v1 memory.usage_in_bytes. It is the
+// value compared to the cgroup limit by the OOM killer.
+func cgroupMemoryUsage(cgroups cgroupPaths) (uint64, error) {
+	paths := []string{
+		filepath.Join(cgroups.v2, "memory.current"),
+		filepath.Join(cgroups.v1, "memory.usage_in_bytes"),
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		usage, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cgroup memory usage in %s: %v", path, err)
+		}
+		return usage, nil
+	}
+	return 0, fmt.Errorf("no cgroup memory usage in %s or %s", cgroups.v2, cgroups.v1)
+}
@@ -0,0 +1,109 @@
+// Copyright 2019, OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memorylimiter
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResidentSetSize(t *testing.T) {
+	dir := fakeMemoryFiles(t, map[string]string{
+		"statm":         "1234 567 89 1 0 300 0\n",
+		"invalid_statm": "1234\n",
+	})
+	defer os.RemoveAll(dir)
+
+	rss, err := residentSetSize(filepath.Join(dir, "statm"), 4096)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(567*4096), rss)
+
+	_, err = residentSetSize(filepath.Join(dir, "invalid_statm"), 4096)
+	assert.Error(t, err)
+
+	// The statm file of the test process.
+	rss, err = residentSetSize(statmPath, uint64(os.Getpagesize()))
+	if err == nil {
+		assert.True(t, rss > 0)
+	}
+}
+
+func TestCgroupMemoryUsage(t *testing.T) {
+	dir := fakeMemoryFiles(t, map[string]string{
+		"v2/memory.current":               "1048576\n",
+		"v1/memory/memory.usage_in_bytes": "2097152\n",
+		"invalid/memory.current":          "a lot\n",
+	})
+	defer os.RemoveAll(dir)
+
+	usage, err := cgroupMemoryUsage(rootCgroupPaths(filepath.Join(dir, "v2")))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1048576), usage)
+
+	usage, err = cgroupMemoryUsage(rootCgroupPaths(filepath.Join(dir, "v1")))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2097152), usage)
+
+	_, err = cgroupMemoryUsage(rootCgroupPaths(filepath.Join(dir, "invalid")))
+	assert.Error(t, err)
+
+	_, err = cgroupMemoryUsage(rootCgroupPaths(filepath.Join(dir, "none")))
+	assert.Error(t, err)
+}
+
+func TestNewMemoryMeasures(t *testing.T) {
+	dir := fakeMemoryFiles(t, map[string]string{
+		"statm":                 "1234 567 89 1 0 300 0\n",
+		"cgroup/memory.current": "1048576\n",
+	})
+	defer os.RemoveAll(dir)
+	defer func(root, procCgroup, statm string) {
+		cgroupRoot, procCgroupPath, statmPath = root, procCgroup, statm
+	}(cgroupRoot, procCgroupPath, statmPath)
+	cgroupRoot = filepath.Join(dir, "cgroup")
+	procCgroupPath = filepath.Join(dir, "none")
+	statmPath = filepath.Join(dir, "statm")
+
+	measures, err := newMemoryMeasures(nil)
+	require.NoError(t, err)
+	require.Len(t, measures, 1)
+	assert.Equal(t, measureHeap, measures[0].name)
+
+	measures, err = newMemoryMeasures([]string{measureHeap, measureRSS, measureCgroup})
+	require.NoError(t, err)
+	values := map[string]uint64{}
+	for _, m := range measures {
+		values[m.name], err = m.read(&runtime.MemStats{Alloc: 1000})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, map[string]uint64{
+		measureHeap:   1000,
+		measureRSS:    567 * uint64(os.Getpagesize()),
+		measureCgroup: 1048576,
+	}, values)
+
+	_, err = newMemoryMeasures([]string{"swap"})
+	assert.Error(t, err)
+
+	// Measures are only accepted if available.
+	statmPath = filepath.Join(dir, "none")
+	_, err = newMemoryMeasures([]string{measureRSS})
+	assert.Error(t, err)
+}
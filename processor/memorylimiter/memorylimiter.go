@@ -17,12 +17,18 @@ package memorylimiter
 import (
 	"context"
 	"errors"
+	"math"
 	"runtime"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/open-telemetry/opentelemetry-service/consumer"
 	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
@@ -30,10 +36,19 @@ import (
 )
 
 var (
-	// errForcedDrop will be returned to callers of ConsumeTraceData to indicate
-	// that data is being dropped due to high memory usage.
+	// errForcedDrop will be returned to callers of ConsumeTraceData and
+	// ConsumeMetricsData to indicate that data is being dropped due to high
+	// memory usage.
 	errForcedDrop = errors.New("data dropped due to high memory usage")
 
+	// errMemoryPressure will be returned to callers of ConsumeTraceData and
+	// ConsumeMetricsData when the memory usage is above the soft limit. It is
+	// a gRPC RESOURCE_EXHAUSTED status so receivers returning it to their
+	// clients tell them to back off and retry later.
+	errMemoryPressure = status.Error(
+		codes.ResourceExhausted,
+		"data refused due to high memory usage, retry later")
+
 	// Construction errors
 
 	errNilNextConsumer = errors.New("nil nextConsumer")
@@ -46,31 +61,205 @@ var (
 
 	errMemSpikeLimitOutOfRange = errors.New(
 		"memSpikeLimit must be smaller than memAllocLimit")
+
+	errSoftLimitOutOfRange = errors.New(
+		"softLimit must be smaller than memAllocLimit minus memSpikeLimit")
+
+	errGCPercentAndFreeOSMemory = errors.New(
+		"gcPercent can't be used with freeOSMemory")
+
+	errProcessorShutdown = errors.New(
+		"memory limiter processor can't be started once shut down")
 )
 
-type memoryLimiter struct {
-	nextConsumer consumer.TraceConsumer
+// States of the memory usage, as seen by the last check.
+const (
+	memStateNormal int64 = iota
+	// memStateSoftLimited indicates the usage is above the soft limit, new
+	// data is refused with errMemoryPressure.
+	memStateSoftLimited
+	// memStateHardLimited indicates the usage is above the hard limit, new
+	// data is dropped with errForcedDrop.
+	memStateHardLimited
+)
 
+// memoryChecker periodically checks the memory usage and tells the
+// processors sharing it when data has to be dropped.
+type memoryChecker struct {
 	memAllocLimit uint64
 	memSpikeLimit uint64
 	memCheckWait  time.Duration
 	ballastSize   uint64
 
-	// forceDrop is used atomically to indicate when data should be dropped.
-	forceDrop int64
-
-	ticker *time.Ticker
+	// softLimit is the memory usage above which data is refused, zero
+	// disables it. softLimitDelay is how long data is held waiting for the
+	// usage to go back under it before being refused.
+	softLimit      uint64
+	softLimitDelay time.Duration
+
+	// state is used atomically to indicate when data should be refused or
+	// dropped, its values are the memState constants.
+	state int64
+
+	// prioritizer gives the priority of the data, it is nil without priority
+	// rules. In memStateHardLimited, the data with a priority below dropBelow,
+	// used atomically, is dropped.
+	prioritizer *prioritizer
+	dropBelow   int64
+
+	// measures are the memory measures the limits apply to, the highest of
+	// them is used. The heap one is used when there is none.
+	measures []memoryMeasure
+
+	// relievedMu protects relieved, which is closed and replaced every time
+	// the state leaves memStateSoftLimited.
+	relievedMu sync.Mutex
+	relieved   chan struct{}
+
+	gc gcConfig
+	// gcPercent is shared by the checkers of the factory to lower the GC
+	// percent of the process, it is only used if gc.percent is set.
+	gcPercent *sharedGCPercent
+	// lastGC is the time of the last forced GC, it is only used by memCheck.
+	lastGC time.Time
+
+	// lastCheck is the time of the last check and droppingDuration the total
+	// time spent above the hard limit. They are only used by memCheck.
+	lastCheck        time.Time
+	droppingDuration time.Duration
+
+	// usersMu protects users, the number of started processors using the
+	// checker, and done, closed to stop the goroutine checking the memory
+	// usage once there are no users.
+	usersMu      sync.Mutex
+	users        int
+	done         chan struct{}
+	collectionWG sync.WaitGroup
+
+	// idleFn, when set, is called once the last processor using the checker
+	// is shut down, after the check stopped. The factory uses it to release
+	// the checker and the memory ballast.
+	idleFn func(mc *memoryChecker)
 
 	// The function to read the mem values is set as a reference to help with
 	// testing different values.
 	readMemStatsFn func(m *runtime.MemStats)
 
+	// The function forcing GCs is also set as a reference for testing,
+	// runtime.GC or debug.FreeOSMemory are used when it is nil.
+	gcFn func()
+
+	statsTags []tag.Mutator
+}
+
+// gcConfig defines how the memory checker releases memory when the hard
+// limit is reached.
+type gcConfig struct {
+	// minInterval is the minimum time between forced GCs.
+	minInterval time.Duration
+	// freeOSMemory indicates to return the memory to the OS when forcing a
+	// GC, using debug.FreeOSMemory instead of runtime.GC.
+	freeOSMemory bool
+	// percent, when not zero, is the GC percent set while above the hard
+	// limit instead of forcing GCs.
+	percent int
+}
+
+// sharedGCPercent lowers the GC percent of the process while memory checkers
+// are above their hard limit. debug.SetGCPercent changes a process wide
+// setting, so the checkers of a factory share it: the lowest percent of the
+// checkers above their hard limit is used, and the original percent is
+// restored when the last of them goes back under it.
+type sharedGCPercent struct {
+	mu sync.Mutex
+	// percents holds the GC percent of each checker above its hard limit,
+	// original the GC percent to restore once there is none left.
+	percents map[*memoryChecker]int
+	original int
+
+	// setFn is set for testing, debug.SetGCPercent is used when it is nil.
+	setFn func(percent int) int
+}
+
+// lower sets the GC percent of mc, if it is lower than the one set by the
+// other checkers.
+func (s *sharedGCPercent) lower(mc *memoryChecker, percent int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.percents[mc]; ok {
+		return
+	}
+	if len(s.percents) == 0 {
+		s.percents = map[*memoryChecker]int{mc: percent}
+		s.original = s.set(percent)
+		return
+	}
+	current := s.lowest()
+	s.percents[mc] = percent
+	if percent < current {
+		s.set(percent)
+	}
+}
+
+// restore removes the GC percent of mc, setting the lowest one left or the
+// original one if mc was the last checker above its hard limit.
+func (s *sharedGCPercent) restore(mc *memoryChecker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.percents[mc]; !ok {
+		return
+	}
+	current := s.lowest()
+	delete(s.percents, mc)
+	if len(s.percents) == 0 {
+		s.set(s.original)
+		return
+	}
+	if lowest := s.lowest(); lowest != current {
+		s.set(lowest)
+	}
+}
+
+func (s *sharedGCPercent) lowest() int {
+	lowest := math.MaxInt32
+	for _, percent := range s.percents {
+		if percent < lowest {
+			lowest = percent
+		}
+	}
+	return lowest
+}
+
+func (s *sharedGCPercent) set(percent int) int {
+	if s.setFn != nil {
+		return s.setFn(percent)
+	}
+	return debug.SetGCPercent(percent)
+}
+
+// memoryLimiter drops the data going through it while its memory checker
+// reports high memory usage. It implements both processor.TraceProcessor and
+// processor.MetricsProcessor, only the consumer of its data type is set.
+type memoryLimiter struct {
+	traceConsumer   consumer.TraceConsumer
+	metricsConsumer consumer.MetricsConsumer
+
+	checker *memoryChecker
+
 	statsTags []tag.Mutator
+
+	// startedMu protects started, indicating if the processor is using the
+	// memory checker, and shutdown, indicating it was shut down.
+	startedMu sync.Mutex
+	started   bool
+	shutdown  bool
 }
 
 var _ processor.TraceProcessor = (*memoryLimiter)(nil)
+var _ processor.MetricsProcessor = (*memoryLimiter)(nil)
 
-// New returns a new memorylimiter processor.
+// New returns a new memorylimiter processor. The ballastSize is the size of a
+// memory ballast allocated by the caller, it isn't allocated by the processor.
 func New(
 	name string,
 	nextConsumer consumer.TraceConsumer,
@@ -83,6 +272,62 @@ func New(
 	if nextConsumer == nil {
 		return nil, errNilNextConsumer
 	}
+	checker, err := newMemoryChecker(name, checkInterval, memAllocLimit, memSpikeLimit, 0, 0, ballastSize, gcConfig{}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return newTraceProcessor(name, nextConsumer, checker)
+}
+
+func newTraceProcessor(
+	name string,
+	nextConsumer consumer.TraceConsumer,
+	checker *memoryChecker,
+) (processor.TraceProcessor, error) {
+	if nextConsumer == nil {
+		return nil, errNilNextConsumer
+	}
+	initMetrics()
+	ml := &memoryLimiter{
+		traceConsumer: nextConsumer,
+		checker:       checker,
+		statsTags:     statsTagsForBatch(name),
+	}
+	return ml, ml.Start()
+}
+
+func newMetricsProcessor(
+	name string,
+	nextConsumer consumer.MetricsConsumer,
+	checker *memoryChecker,
+) (processor.MetricsProcessor, error) {
+	if nextConsumer == nil {
+		return nil, errNilNextConsumer
+	}
+	initMetrics()
+	ml := &memoryLimiter{
+		metricsConsumer: nextConsumer,
+		checker:         checker,
+		statsTags:       statsTagsForBatch(name),
+	}
+	return ml, ml.Start()
+}
+
+// newMemoryChecker creates a memory checker, it checks the memory usage every
+// checkInterval while it is used by started processors.
+func newMemoryChecker(
+	name string,
+	checkInterval time.Duration,
+	memAllocLimit uint64,
+	memSpikeLimit uint64,
+	softLimit uint64,
+	softLimitDelay time.Duration,
+	ballastSize uint64,
+	gc gcConfig,
+	prioritizer *prioritizer,
+	measures []memoryMeasure,
+) (*memoryChecker, error) {
+
 	if checkInterval <= 0 {
 		return nil, errCheckIntervalOutOfRange
 	}
@@ -92,23 +337,30 @@ func New(
 	if memSpikeLimit >= memAllocLimit {
 		return nil, errMemSpikeLimitOutOfRange
 	}
+	if softLimit >= memAllocLimit-memSpikeLimit {
+		return nil, errSoftLimitOutOfRange
+	}
+	if gc.percent != 0 && gc.freeOSMemory {
+		return nil, errGCPercentAndFreeOSMemory
+	}
 
-	ml := &memoryLimiter{
-		nextConsumer:   nextConsumer,
+	mc := &memoryChecker{
 		memAllocLimit:  memAllocLimit,
 		memSpikeLimit:  memSpikeLimit,
 		memCheckWait:   checkInterval,
 		ballastSize:    ballastSize,
-		ticker:         time.NewTicker(checkInterval),
+		softLimit:      softLimit,
+		softLimitDelay: softLimitDelay,
+		gc:             gc,
+		prioritizer:    prioritizer,
+		measures:       measures,
 		readMemStatsFn: runtime.ReadMemStats,
 		statsTags:      statsTagsForBatch(name),
 	}
 
 	initMetrics()
 
-	ml.startCollection()
-
-	return ml, nil
+	return mc, nil
 }
 
 func (ml *memoryLimiter) ConsumeTraceData(
@@ -116,66 +368,403 @@ func (ml *memoryLimiter) ConsumeTraceData(
 	td consumerdata.TraceData,
 ) error {
 
-	if ml.forcingDrop() {
+	// The priorities are only needed, and computed, while above the limits.
+	var priorities []int64
+	var priority int64
+	batchPriority := func() int64 {
+		if priorities == nil && ml.checker.prioritizer != nil {
+			priorities, priority = ml.checker.prioritizer.spanPriorities(td)
+		}
+		return priority
+	}
+	if err := ml.checker.admit(ctx, batchPriority); err != nil {
 		numSpans := len(td.Spans)
+		stat := StatDroppedSpanCount
+		if err != errForcedDrop {
+			stat = StatRefusedSpanCount
+		}
 		stats.RecordWithTags(
 			context.Background(),
 			ml.statsTags,
-			StatDroppedSpanCount.M(int64(numSpans)))
+			stat.M(int64(numSpans)))
 
-		return errForcedDrop
+		return err
 	}
-	return ml.nextConsumer.ConsumeTraceData(ctx, td)
+
+	// The batch went through because some spans have a high enough priority,
+	// the others are dropped. They are recorded apart from the dropped
+	// batches, which are only the ones dropped as a whole.
+	if ml.checker.prioritizer != nil && ml.checker.forcingDrop() {
+		batchPriority()
+		spans := make([]*tracepb.Span, 0, len(td.Spans))
+		for i, span := range td.Spans {
+			if !ml.checker.shouldShed(priorities[i]) {
+				spans = append(spans, span)
+			}
+		}
+		if dropped := len(td.Spans) - len(spans); dropped > 0 {
+			stats.RecordWithTags(
+				context.Background(),
+				ml.statsTags,
+				StatShedSpanCount.M(int64(dropped)))
+			td.Spans = spans
+		}
+	}
+	return ml.traceConsumer.ConsumeTraceData(ctx, td)
 }
 
-// stopCheck stops the periodic check for memory consumption.
-// The processor.TraceProcessor interface doesn't have a stop/flush method that
-// could be used and closing the background goroutine is important in tests.
-func (ml *memoryLimiter) stopCheck() {
-	ml.ticker.Stop()
+func (ml *memoryLimiter) ConsumeMetricsData(
+	ctx context.Context,
+	md consumerdata.MetricsData,
+) error {
+
+	batchPriority := func() int64 {
+		if ml.checker.prioritizer == nil {
+			return 0
+		}
+		return ml.checker.prioritizer.metricsPriority(md)
+	}
+	if err := ml.checker.admit(ctx, batchPriority); err != nil {
+		numMetrics := len(md.Metrics)
+		stat := StatDroppedMetricCount
+		if err != errForcedDrop {
+			stat = StatRefusedMetricCount
+		}
+		stats.RecordWithTags(
+			context.Background(),
+			ml.statsTags,
+			stat.M(int64(numMetrics)))
+
+		return err
+	}
+	return ml.metricsConsumer.ConsumeMetricsData(ctx, md)
+}
+
+// Start starts the memory checks used by the processor. Processors are
+// started when created, and can't be started again once shut down since the
+// factory releases the memory checks of the processors shut down.
+func (ml *memoryLimiter) Start() error {
+	ml.startedMu.Lock()
+	defer ml.startedMu.Unlock()
+	if ml.shutdown {
+		return errProcessorShutdown
+	}
+	if !ml.started {
+		ml.started = true
+		ml.checker.acquire()
+	}
+	return nil
+}
+
+// Shutdown stops the memory checks used by the processor, they are shared
+// with the other processors created from the same configuration and only stop
+// once all of them are shut down. The service doesn't call it, the processors
+// are shut down by Factory.Shutdown.
+func (ml *memoryLimiter) Shutdown() error {
+	ml.startedMu.Lock()
+	defer ml.startedMu.Unlock()
+	ml.shutdown = true
+	if ml.started {
+		ml.started = false
+		ml.checker.release()
+	}
+	return nil
 }
 
-func (ml *memoryLimiter) readMemStats(ms *runtime.MemStats) {
-	ml.readMemStatsFn(ms)
-	// If proper configured ms.Alloc should be at least ml.ballastSize but since
+// acquire adds a user to the checker, the periodic check for memory
+// consumption starts with the first one.
+func (mc *memoryChecker) acquire() {
+	mc.usersMu.Lock()
+	defer mc.usersMu.Unlock()
+	mc.users++
+	if mc.users == 1 {
+		mc.startCollection()
+	}
+}
+
+// release removes a user from the checker, the periodic check for memory
+// consumption stops with the last one. idleFn is called without holding
+// usersMu, so it can check the users.
+func (mc *memoryChecker) release() {
+	mc.usersMu.Lock()
+	mc.users--
+	idle := mc.users == 0
+	if idle {
+		mc.stopCheck()
+	}
+	mc.usersMu.Unlock()
+	if idle && mc.idleFn != nil {
+		mc.idleFn(mc)
+	}
+}
+
+// hasUsers returns true if started processors use the checker.
+func (mc *memoryChecker) hasUsers() bool {
+	mc.usersMu.Lock()
+	defer mc.usersMu.Unlock()
+	return mc.users > 0
+}
+
+// stopCheck stops the periodic check for memory consumption and waits for
+// its goroutine to exit.
+func (mc *memoryChecker) stopCheck() {
+	close(mc.done)
+	mc.collectionWG.Wait()
+	mc.restoreGCPercent()
+}
+
+func (mc *memoryChecker) readMemStats(ms *runtime.MemStats) {
+	mc.readMemStatsFn(ms)
+	// If proper configured ms.Alloc should be at least mc.ballastSize but since
 	// a misconfiguration is possible check for that here.
-	if ms.Alloc >= ml.ballastSize {
-		ms.Alloc -= ml.ballastSize
+	if ms.Alloc >= mc.ballastSize {
+		ms.Alloc -= mc.ballastSize
 	}
 }
 
 // startCollection starts a ticker'd goroutine that will check memory usage
-// every checkInterval period.
-func (ml *memoryLimiter) startCollection() {
+// every checkInterval period, until stopCheck is called.
+func (mc *memoryChecker) startCollection() {
+	ticker := time.NewTicker(mc.memCheckWait)
+	done := make(chan struct{})
+	mc.done = done
+	mc.collectionWG.Add(1)
 	go func() {
-		for range ml.ticker.C {
-			ml.memCheck()
+		defer mc.collectionWG.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mc.memCheck()
+			case <-done:
+				return
+			}
 		}
 	}()
 }
 
 // forcingDrop indicates when memory resources need to be released.
-func (ml *memoryLimiter) forcingDrop() bool {
-	return atomic.LoadInt64(&ml.forceDrop) != 0
+func (mc *memoryChecker) forcingDrop() bool {
+	return atomic.LoadInt64(&mc.state) == memStateHardLimited
+}
+
+// admit returns nil if new data with the given priority can go through,
+// errForcedDrop if it has to be dropped or errMemoryPressure if it is refused.
+// Above the soft limit it waits up to softLimitDelay for the memory usage to
+// go back under it, data with a priority is never refused. The priority is
+// only computed above the soft limit.
+func (mc *memoryChecker) admit(ctx context.Context, priority func() int64) error {
+	switch atomic.LoadInt64(&mc.state) {
+	case memStateNormal:
+		return nil
+	case memStateHardLimited:
+		return mc.shed(priority())
+	}
+
+	if priority() > 0 {
+		return nil
+	}
+	if mc.softLimitDelay <= 0 {
+		return errMemoryPressure
+	}
+	relieved := mc.relievedChan()
+	// The state may have changed before the channel was taken.
+	switch atomic.LoadInt64(&mc.state) {
+	case memStateNormal:
+		return nil
+	case memStateHardLimited:
+		return mc.shed(priority())
+	}
+	timer := time.NewTimer(mc.softLimitDelay)
+	defer timer.Stop()
+	select {
+	case <-relieved:
+		if mc.forcingDrop() {
+			return mc.shed(priority())
+		}
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return errMemoryPressure
+}
+
+// shed returns errForcedDrop if data with the given priority has to be
+// dropped above the hard limit.
+func (mc *memoryChecker) shed(priority int64) error {
+	if mc.shouldShed(priority) {
+		return errForcedDrop
+	}
+	return nil
+}
+
+func (mc *memoryChecker) shouldShed(priority int64) bool {
+	return priority < atomic.LoadInt64(&mc.dropBelow)
+}
+
+func (mc *memoryChecker) relievedChan() chan struct{} {
+	mc.relievedMu.Lock()
+	defer mc.relievedMu.Unlock()
+	if mc.relieved == nil {
+		mc.relieved = make(chan struct{})
+	}
+	return mc.relieved
+}
+
+func (mc *memoryChecker) setState(state int64) {
+	old := atomic.SwapInt64(&mc.state, state)
+	if old != memStateSoftLimited || state == memStateSoftLimited {
+		return
+	}
+	// Release the data waiting for the memory usage to go under the soft
+	// limit, it goes through or is dropped according to the new state.
+	mc.relievedMu.Lock()
+	if mc.relieved != nil {
+		close(mc.relieved)
+		mc.relieved = nil
+	}
+	mc.relievedMu.Unlock()
 }
 
-func (ml *memoryLimiter) memCheck() {
+func (mc *memoryChecker) memCheck() {
 	ms := &runtime.MemStats{}
-	ml.readMemStats(ms)
-	ml.memLimiting(ms)
+	mc.readMemStats(ms)
+	usage := mc.memoryUsage(ms)
+	wasDropping := mc.forcingDrop()
+	mc.memLimiting(usage)
+	mc.recordStats(ms, usage, wasDropping)
 }
 
-func (ml *memoryLimiter) shouldForceDrop(ms *runtime.MemStats) bool {
-	return ml.memAllocLimit <= ms.Alloc || ml.memAllocLimit-ms.Alloc <= ml.memSpikeLimit
+// memoryUsage returns the memory usage the limits apply to, the highest of
+// the measures. The ballast is only subtracted from the heap, it is never
+// written so it isn't part of the resident memory.
+func (mc *memoryChecker) memoryUsage(ms *runtime.MemStats) uint64 {
+	if len(mc.measures) == 0 {
+		return ms.Alloc
+	}
+	var usage uint64
+	read := false
+	for _, m := range mc.measures {
+		// The measures were available when the checker was created, one
+		// failing now is skipped.
+		value, err := m.read(ms)
+		if err != nil {
+			continue
+		}
+		read = true
+		if value > usage {
+			usage = value
+		}
+	}
+	if !read {
+		return ms.Alloc
+	}
+	return usage
 }
 
-func (ml *memoryLimiter) memLimiting(ms *runtime.MemStats) {
-	if !ml.shouldForceDrop(ms) {
-		atomic.StoreInt64(&ml.forceDrop, 0)
-	} else {
-		atomic.StoreInt64(&ml.forceDrop, 1)
-		// Force a GC at this point and see if this is enough to get to
-		// the desired level.
+// recordStats records the memory usage seen by the check, wasDropping
+// indicates whether data was dropped since the previous check.
+func (mc *memoryChecker) recordStats(ms *runtime.MemStats, usage uint64, wasDropping bool) {
+	now := time.Now()
+	if wasDropping && !mc.lastCheck.IsZero() {
+		mc.droppingDuration += now.Sub(mc.lastCheck)
+	}
+	mc.lastCheck = now
+
+	var headroom int64
+	if hardLimit := mc.memAllocLimit - mc.memSpikeLimit; usage < hardLimit {
+		headroom = int64(hardLimit - usage)
+	}
+	var dropping int64
+	if mc.forcingDrop() {
+		dropping = 1
+	}
+	stats.RecordWithTags(
+		context.Background(),
+		mc.statsTags,
+		StatHeapAlloc.M(int64(ms.Alloc)),
+		StatMemoryUsage.M(int64(usage)),
+		StatMemoryLimit.M(int64(mc.memAllocLimit)),
+		StatSpikeHeadroom.M(headroom),
+		StatDropping.M(dropping),
+		StatDroppingDuration.M(mc.droppingDuration.Seconds()))
+}
+
+func (mc *memoryChecker) shouldForceDrop(usage uint64) bool {
+	return mc.memAllocLimit <= usage || mc.memAllocLimit-usage <= mc.memSpikeLimit
+}
+
+func (mc *memoryChecker) shouldRefuse(usage uint64) bool {
+	return mc.softLimit > 0 && mc.softLimit <= usage
+}
+
+func (mc *memoryChecker) memLimiting(usage uint64) {
+	switch {
+	case mc.shouldForceDrop(usage):
+		atomic.StoreInt64(&mc.dropBelow, mc.dropThreshold(usage))
+		mc.setState(memStateHardLimited)
+		mc.releaseMemory()
+		return
+	case mc.shouldRefuse(usage):
+		mc.setState(memStateSoftLimited)
+	default:
+		mc.setState(memStateNormal)
+	}
+	mc.restoreGCPercent()
+}
+
+// dropThreshold returns the priority below which data is dropped above the
+// hard limit. Without priority rules all the data is dropped. Otherwise the
+// spike limit is split in as many bands as there are priority levels plus one,
+// the higher the band the usage is in the higher the priority kept, and all the
+// data is dropped at the limit.
+func (mc *memoryChecker) dropThreshold(usage uint64) int64 {
+	if mc.prioritizer == nil || usage >= mc.memAllocLimit {
+		return math.MaxInt64
+	}
+	levels := mc.prioritizer.levels
+	hardLimit := mc.memAllocLimit - mc.memSpikeLimit
+	band := (usage - hardLimit) * uint64(len(levels)+1) / mc.memSpikeLimit
+	if band >= uint64(len(levels)) {
+		return math.MaxInt64
+	}
+	return levels[band]
+}
+
+// releaseMemory is called on every check above the hard limit. It lowers the
+// GC percent if gc.percent is set, otherwise it forces a GC, at most once per
+// gc.minInterval, to see if this is enough to get to the desired level.
+func (mc *memoryChecker) releaseMemory() {
+	if mc.gc.percent != 0 {
+		mc.gcPercent.lower(mc, mc.gc.percent)
+		return
+	}
+
+	start := time.Now()
+	if !mc.lastGC.IsZero() && start.Sub(mc.lastGC) < mc.gc.minInterval {
+		return
+	}
+	mc.lastGC = start
+
+	switch {
+	case mc.gcFn != nil:
+		mc.gcFn()
+	case mc.gc.freeOSMemory:
+		debug.FreeOSMemory()
+	default:
 		runtime.GC()
 	}
+
+	stats.RecordWithTags(
+		context.Background(),
+		mc.statsTags,
+		StatForcedGCDuration.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
+
+// restoreGCPercent restores the GC percent lowered by releaseMemory, it is
+// called on every check under the hard limit and when the checks stop.
+func (mc *memoryChecker) restoreGCPercent() {
+	if mc.gc.percent != 0 {
+		mc.gcPercent.restore(mc)
+	}
 }
@@ -16,11 +16,18 @@ package memorylimiter
 
 import (
 	"context"
+	"errors"
 	"runtime"
 	"testing"
 	"time"
 
+	metricspb "github.com/census-instrumentation/opencensus-proto/gen-go/metrics/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/open-telemetry/opentelemetry-service/consumer"
 	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
@@ -93,7 +100,7 @@ func TestNew(t *testing.T) {
 				return
 			}
 			if got != nil {
-				got.(*memoryLimiter).stopCheck()
+				assert.NoError(t, got.(*memoryLimiter).Shutdown())
 			}
 		})
 	}
@@ -104,54 +111,539 @@ func TestNew(t *testing.T) {
 func TestMemoryPressureResponse(t *testing.T) {
 	var currentMemAlloc uint64
 	sink := new(exportertest.SinkTraceExporter)
-	ml := &memoryLimiter{
-		nextConsumer:  sink,
+	mc := &memoryChecker{
 		memAllocLimit: 1024,
 		readMemStatsFn: func(ms *runtime.MemStats) {
 			ms.Alloc = currentMemAlloc
 		},
 	}
+	ml := &memoryLimiter{
+		traceConsumer: sink,
+		checker:       mc,
+	}
 
 	ctx := context.Background()
 	td := consumerdata.TraceData{}
 
 	// Below memAllocLimit.
 	currentMemAlloc = 800
-	ml.memCheck()
+	mc.memCheck()
 	assert.NoError(t, ml.ConsumeTraceData(ctx, td))
 
 	// Above memAllocLimit.
 	currentMemAlloc = 1800
-	ml.memCheck()
+	mc.memCheck()
 	assert.Equal(t, errForcedDrop, ml.ConsumeTraceData(ctx, td))
 
 	// Check ballast effect
-	ml.ballastSize = 1000
+	mc.ballastSize = 1000
 
 	// Below memAllocLimit accounting for ballast.
-	currentMemAlloc = 800 + ml.ballastSize
-	ml.memCheck()
+	currentMemAlloc = 800 + mc.ballastSize
+	mc.memCheck()
 	assert.NoError(t, ml.ConsumeTraceData(ctx, td))
 
 	// Above memAllocLimit even accountiing for ballast.
-	currentMemAlloc = 1800 + ml.ballastSize
-	ml.memCheck()
+	currentMemAlloc = 1800 + mc.ballastSize
+	mc.memCheck()
 	assert.Equal(t, errForcedDrop, ml.ConsumeTraceData(ctx, td))
 
 	// Restore ballast to default.
-	ml.ballastSize = 0
+	mc.ballastSize = 0
 
 	// Check spike limit
-	ml.memSpikeLimit = 512
+	mc.memSpikeLimit = 512
 
 	// Below memSpikeLimit.
 	currentMemAlloc = 500
-	ml.memCheck()
+	mc.memCheck()
 	assert.NoError(t, ml.ConsumeTraceData(ctx, td))
 
 	// Above memSpikeLimit.
 	currentMemAlloc = 550
-	ml.memCheck()
+	mc.memCheck()
 	assert.Equal(t, errForcedDrop, ml.ConsumeTraceData(ctx, td))
 
 }
+
+func TestProcessorShutdown(t *testing.T) {
+	checks := make(chan struct{}, 1)
+	mc, err := newMemoryChecker("shutdown", time.Millisecond, 1024, 0, 0, 0, 0, gcConfig{}, nil, nil)
+	require.NoError(t, err)
+	mc.readMemStatsFn = func(ms *runtime.MemStats) {
+		select {
+		case checks <- struct{}{}:
+		default:
+		}
+	}
+	tp, err := newTraceProcessor("shutdown", exportertest.NewNopTraceExporter(), mc)
+	require.NoError(t, err)
+	mp, err := newMetricsProcessor("shutdown", exportertest.NewNopMetricsExporter(), mc)
+	require.NoError(t, err)
+	ml := tp.(*memoryLimiter)
+	<-checks
+
+	// The checks go on until all the processors sharing them are shut down.
+	assert.NoError(t, ml.Shutdown())
+	assert.NoError(t, ml.Shutdown())
+	assert.Equal(t, 1, checkerUsers(mc))
+	<-checks
+	assert.NoError(t, mp.(*memoryLimiter).Shutdown())
+	assert.Equal(t, 0, checkerUsers(mc))
+
+	// A shut down processor can't be started again.
+	assert.Equal(t, errProcessorShutdown, ml.Start())
+	assert.Equal(t, 0, checkerUsers(mc))
+}
+
+// checkerUsers returns the number of started processors using the checker.
+func checkerUsers(mc *memoryChecker) int {
+	mc.usersMu.Lock()
+	defer mc.usersMu.Unlock()
+	return mc.users
+}
+
+func TestMetricsMemoryPressureResponse(t *testing.T) {
+	var currentMemAlloc uint64
+	mc := &memoryChecker{
+		memAllocLimit: 1024,
+		readMemStatsFn: func(ms *runtime.MemStats) {
+			ms.Alloc = currentMemAlloc
+		},
+	}
+	sink := new(exportertest.SinkMetricsExporter)
+	mp := &memoryLimiter{
+		metricsConsumer: sink,
+		checker:         mc,
+		statsTags:       statsTagsForBatch("metrics-pressure"),
+	}
+
+	ctx := context.Background()
+	md := consumerdata.MetricsData{
+		Metrics: make([]*metricspb.Metric, 3),
+	}
+	droppedBefore := viewValue(t, StatDroppedMetricCount.Name(), "metrics-pressure")
+
+	// Below memAllocLimit.
+	currentMemAlloc = 800
+	mc.memCheck()
+	assert.NoError(t, mp.ConsumeMetricsData(ctx, md))
+	assert.Len(t, sink.AllMetrics(), 1)
+
+	// Above memAllocLimit.
+	currentMemAlloc = 1800
+	mc.memCheck()
+	assert.Equal(t, errForcedDrop, mp.ConsumeMetricsData(ctx, md))
+	assert.Len(t, sink.AllMetrics(), 1)
+	assert.Equal(t, float64(3), viewValue(t, StatDroppedMetricCount.Name(), "metrics-pressure")-droppedBefore)
+}
+
+func TestSoftLimit(t *testing.T) {
+	var currentMemAlloc uint64
+	mc := &memoryChecker{
+		memAllocLimit: 1024,
+		memSpikeLimit: 256,
+		softLimit:     512,
+		readMemStatsFn: func(ms *runtime.MemStats) {
+			ms.Alloc = currentMemAlloc
+		},
+	}
+	sink := new(exportertest.SinkTraceExporter)
+	tp := &memoryLimiter{
+		traceConsumer: sink,
+		checker:       mc,
+		statsTags:     statsTagsForBatch("soft-limit"),
+	}
+
+	ctx := context.Background()
+	td := consumerdata.TraceData{
+		Spans: make([]*tracepb.Span, 2),
+	}
+	refusedBefore := viewValue(t, StatRefusedSpanCount.Name(), "soft-limit")
+	droppedBefore := viewValue(t, StatDroppedSpanCount.Name(), "soft-limit")
+
+	// Below the soft limit.
+	currentMemAlloc = 500
+	mc.memCheck()
+	assert.NoError(t, tp.ConsumeTraceData(ctx, td))
+
+	// Between the soft and hard limits the data is refused with a retryable
+	// status.
+	currentMemAlloc = 600
+	mc.memCheck()
+	err := tp.ConsumeTraceData(ctx, td)
+	assert.Equal(t, errMemoryPressure, err)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// Above the hard limit the data is dropped.
+	currentMemAlloc = 800
+	mc.memCheck()
+	assert.Equal(t, errForcedDrop, tp.ConsumeTraceData(ctx, td))
+
+	assert.Len(t, sink.AllTraces(), 1)
+	assert.Equal(t, float64(2), viewValue(t, StatRefusedSpanCount.Name(), "soft-limit")-refusedBefore)
+	assert.Equal(t, float64(2), viewValue(t, StatDroppedSpanCount.Name(), "soft-limit")-droppedBefore)
+}
+
+func TestSoftLimitDelay(t *testing.T) {
+	var currentMemAlloc uint64
+	mc := &memoryChecker{
+		memAllocLimit:  1024,
+		softLimit:      512,
+		softLimitDelay: time.Hour,
+		readMemStatsFn: func(ms *runtime.MemStats) {
+			ms.Alloc = currentMemAlloc
+		},
+	}
+	sink := new(exportertest.SinkTraceExporter)
+	tp := &memoryLimiter{
+		traceConsumer: sink,
+		checker:       mc,
+		statsTags:     statsTagsForBatch("soft-limit-delay"),
+	}
+
+	currentMemAlloc = 600
+	mc.memCheck()
+
+	// The data is held until the memory usage goes under the soft limit.
+	done := make(chan error, 1)
+	go func() {
+		done <- tp.ConsumeTraceData(context.Background(), consumerdata.TraceData{})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("data went through above the soft limit: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	currentMemAlloc = 400
+	mc.memCheck()
+	assert.NoError(t, <-done)
+	assert.Len(t, sink.AllTraces(), 1)
+
+	// The wait stops with the context.
+	currentMemAlloc = 600
+	mc.memCheck()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, errMemoryPressure, tp.ConsumeTraceData(ctx, consumerdata.TraceData{}))
+
+	// Data held when the hard limit is reached is dropped.
+	go func() {
+		done <- tp.ConsumeTraceData(context.Background(), consumerdata.TraceData{})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	currentMemAlloc = 2000
+	mc.memCheck()
+	assert.Equal(t, errForcedDrop, <-done)
+}
+
+func TestPriorityShedding(t *testing.T) {
+	var currentMemAlloc uint64
+	p, err := newPrioritizer([]PriorityConfig{
+		{Priority: 10, SpanAttributes: map[string]string{"error": "true"}},
+		{Priority: 5, ServiceName: "checkout"},
+	})
+	require.NoError(t, err)
+	mc := &memoryChecker{
+		memAllocLimit: 1000,
+		memSpikeLimit: 300,
+		softLimit:     500,
+		prioritizer:   p,
+		readMemStatsFn: func(ms *runtime.MemStats) {
+			ms.Alloc = currentMemAlloc
+		},
+		gcFn: func() {},
+	}
+	sink := new(exportertest.SinkTraceExporter)
+	tp := &memoryLimiter{
+		traceConsumer: sink,
+		checker:       mc,
+		statsTags:     statsTagsForBatch("priority-shedding"),
+	}
+
+	errorSpan := testSpan(map[string]*tracepb.AttributeValue{"error": boolAttribute(true)})
+	otherSpan := testSpan(nil)
+	batch := func(service string) consumerdata.TraceData {
+		return consumerdata.TraceData{
+			Node:  testNode(service),
+			Spans: []*tracepb.Span{otherSpan, errorSpan},
+		}
+	}
+	// consume returns the spans of the batch going through the processor.
+	consume := func(td consumerdata.TraceData) ([]*tracepb.Span, error) {
+		sent := len(sink.AllTraces())
+		err := tp.ConsumeTraceData(context.Background(), td)
+		var spans []*tracepb.Span
+		for _, td := range sink.AllTraces()[sent:] {
+			spans = append(spans, td.Spans...)
+		}
+		return spans, err
+	}
+	ctx := context.Background()
+
+	// Below the soft limit the priorities aren't computed.
+	currentMemAlloc = 100
+	mc.memCheck()
+	nop := &memoryLimiter{
+		traceConsumer: exportertest.NewNopTraceExporter(),
+		checker:       mc,
+		statsTags:     statsTagsForBatch("priority-shedding"),
+	}
+	td := batch("checkout")
+	allocs := testing.AllocsPerRun(100, func() { _ = nop.ConsumeTraceData(ctx, td) })
+	mc.prioritizer = nil
+	allocsWithoutPriorities := testing.AllocsPerRun(100, func() { _ = nop.ConsumeTraceData(ctx, td) })
+	mc.prioritizer = p
+	assert.Equal(t, allocsWithoutPriorities, allocs)
+
+	// Above the soft limit only the data without priority is refused.
+	currentMemAlloc = 600
+	mc.memCheck()
+	spans, err := consume(batch("frontend"))
+	assert.NoError(t, err)
+	assert.Equal(t, []*tracepb.Span{otherSpan, errorSpan}, spans)
+	assert.Equal(t, errMemoryPressure, tp.ConsumeTraceData(ctx, consumerdata.TraceData{Spans: []*tracepb.Span{otherSpan}}))
+
+	// The hard limit is at 700, the spike limit is split in three bands
+	// for the two priority levels. In the first one the spans without
+	// priority are dropped.
+	currentMemAlloc = 750
+	mc.memCheck()
+	shedBefore := viewValue(t, StatShedSpanCount.Name(), "priority-shedding")
+	droppedBefore := viewValue(t, StatDroppedSpanCount.Name(), "priority-shedding")
+	batchesBefore := viewValue(t, "batches_dropped", "priority-shedding")
+	spans, err = consume(batch("frontend"))
+	assert.NoError(t, err)
+	assert.Equal(t, []*tracepb.Span{errorSpan}, spans)
+	assert.Equal(t, float64(1), viewValue(t, StatShedSpanCount.Name(), "priority-shedding")-shedBefore)
+	// The batch let through isn't counted as dropped.
+	assert.Equal(t, droppedBefore, viewValue(t, StatDroppedSpanCount.Name(), "priority-shedding"))
+	assert.Equal(t, batchesBefore, viewValue(t, "batches_dropped", "priority-shedding"))
+	spans, err = consume(batch("checkout"))
+	assert.NoError(t, err)
+	assert.Equal(t, []*tracepb.Span{otherSpan, errorSpan}, spans)
+
+	// In the second one only the error spans are kept.
+	currentMemAlloc = 850
+	mc.memCheck()
+	spans, err = consume(batch("checkout"))
+	assert.NoError(t, err)
+	assert.Equal(t, []*tracepb.Span{errorSpan}, spans)
+
+	// In the last one, and above the limit, everything is dropped.
+	for _, alloc := range []uint64{950, 1200} {
+		currentMemAlloc = alloc
+		mc.memCheck()
+		spans, err = consume(batch("checkout"))
+		assert.Equal(t, errForcedDrop, err)
+		assert.Empty(t, spans)
+	}
+}
+
+func TestMemoryMeasures(t *testing.T) {
+	var currentMemAlloc, currentRSS uint64
+	rssErr := errors.New("no rss")
+	var currentRSSErr error
+	mc := &memoryChecker{
+		memAllocLimit: 1024,
+		memSpikeLimit: 256,
+		ballastSize:   100,
+		measures: []memoryMeasure{
+			{name: measureHeap, read: func(ms *runtime.MemStats) (uint64, error) { return ms.Alloc, nil }},
+			{name: measureRSS, read: func(*runtime.MemStats) (uint64, error) { return currentRSS, currentRSSErr }},
+		},
+		readMemStatsFn: func(ms *runtime.MemStats) {
+			ms.Alloc = currentMemAlloc
+		},
+		gcFn:      func() {},
+		statsTags: statsTagsForBatch("memory-measures"),
+	}
+	initMetrics()
+
+	// The limits apply to the highest measure, the ballast is only
+	// subtracted from the heap.
+	currentMemAlloc = 500 + mc.ballastSize
+	currentRSS = 600
+	mc.memCheck()
+	assert.False(t, mc.forcingDrop())
+	assert.Equal(t, float64(600), viewValue(t, StatMemoryUsage.Name(), "memory-measures"))
+	assert.Equal(t, float64(500), viewValue(t, StatHeapAlloc.Name(), "memory-measures"))
+
+	currentRSS = 900
+	mc.memCheck()
+	assert.True(t, mc.forcingDrop())
+	assert.Equal(t, float64(900), viewValue(t, StatMemoryUsage.Name(), "memory-measures"))
+	assert.Equal(t, float64(0), viewValue(t, StatSpikeHeadroom.Name(), "memory-measures"))
+
+	// A measure failing is skipped.
+	currentRSSErr = rssErr
+	mc.memCheck()
+	assert.False(t, mc.forcingDrop())
+	assert.Equal(t, float64(500), viewValue(t, StatMemoryUsage.Name(), "memory-measures"))
+}
+
+func TestNewMemoryCheckerSoftLimit(t *testing.T) {
+	_, err := newMemoryChecker("test", time.Second, 1024, 256, 768, 0, 0, gcConfig{}, nil, nil)
+	assert.Equal(t, errSoftLimitOutOfRange, err)
+
+	_, err = newMemoryChecker("test", time.Second, 1024, 256, 512, 0, 0, gcConfig{}, nil, nil)
+	assert.NoError(t, err)
+
+	_, err = newMemoryChecker("test", time.Second, 1024, 256, 0, 0, 0, gcConfig{percent: 50, freeOSMemory: true}, nil, nil)
+	assert.Equal(t, errGCPercentAndFreeOSMemory, err)
+}
+
+func TestForcedGCInterval(t *testing.T) {
+	var currentMemAlloc uint64
+	gcs := 0
+	mc := &memoryChecker{
+		memAllocLimit: 1024,
+		gc:            gcConfig{minInterval: time.Hour},
+		readMemStatsFn: func(ms *runtime.MemStats) {
+			ms.Alloc = currentMemAlloc
+		},
+		gcFn:      func() { gcs++ },
+		statsTags: statsTagsForBatch("forced-gc-interval"),
+	}
+	initMetrics()
+	gcsBefore := viewValue(t, "forced_gcs", "forced-gc-interval")
+	durationsBefore := viewValue(t, StatForcedGCDuration.Name(), "forced-gc-interval")
+
+	// Only the first check above the limit forces a GC.
+	currentMemAlloc = 1800
+	for i := 0; i < 3; i++ {
+		mc.memCheck()
+	}
+	assert.Equal(t, 1, gcs)
+
+	// Without a minimum interval every check does.
+	mc.gc.minInterval = 0
+	for i := 0; i < 3; i++ {
+		mc.memCheck()
+	}
+	assert.Equal(t, 4, gcs)
+
+	assert.Equal(t, float64(4), viewValue(t, "forced_gcs", "forced-gc-interval")-gcsBefore)
+	assert.Equal(t, float64(4), viewValue(t, StatForcedGCDuration.Name(), "forced-gc-interval")-durationsBefore)
+}
+
+func TestGCPercent(t *testing.T) {
+	var currentMemAlloc uint64
+	gcPercent := 100
+	var setPercents []int
+	mc := &memoryChecker{
+		memAllocLimit: 1024,
+		gc:            gcConfig{percent: 20},
+		gcPercent: &sharedGCPercent{
+			setFn: func(percent int) int {
+				setPercents = append(setPercents, percent)
+				prev := gcPercent
+				gcPercent = percent
+				return prev
+			},
+		},
+		readMemStatsFn: func(ms *runtime.MemStats) {
+			ms.Alloc = currentMemAlloc
+		},
+		gcFn: func() { t.Error("GC forced with a GC percent") },
+	}
+
+	currentMemAlloc = 800
+	mc.memCheck()
+	assert.Empty(t, setPercents)
+
+	// The GC percent is lowered once above the hard limit, and restored
+	// when back under it.
+	currentMemAlloc = 1800
+	mc.memCheck()
+	mc.memCheck()
+	assert.Equal(t, 20, gcPercent)
+	assert.True(t, mc.forcingDrop())
+
+	currentMemAlloc = 800
+	mc.memCheck()
+	mc.memCheck()
+	assert.Equal(t, 100, gcPercent)
+	assert.Equal(t, []int{20, 100}, setPercents)
+}
+
+func TestMemoryStats(t *testing.T) {
+	var currentMemAlloc uint64
+	mc := &memoryChecker{
+		memAllocLimit: 1024,
+		memSpikeLimit: 256,
+		ballastSize:   100,
+		readMemStatsFn: func(ms *runtime.MemStats) {
+			ms.Alloc = currentMemAlloc
+		},
+		gcFn:      func() {},
+		statsTags: statsTagsForBatch("memory-stats"),
+	}
+	initMetrics()
+	gauges := func() map[string]float64 {
+		return map[string]float64{
+			StatHeapAlloc.Name():     viewValue(t, StatHeapAlloc.Name(), "memory-stats"),
+			StatMemoryLimit.Name():   viewValue(t, StatMemoryLimit.Name(), "memory-stats"),
+			StatSpikeHeadroom.Name(): viewValue(t, StatSpikeHeadroom.Name(), "memory-stats"),
+			StatDropping.Name():      viewValue(t, StatDropping.Name(), "memory-stats"),
+		}
+	}
+
+	// The ballast isn't counted.
+	currentMemAlloc = 600 + mc.ballastSize
+	mc.memCheck()
+	assert.Equal(t, map[string]float64{
+		StatHeapAlloc.Name():     600,
+		StatMemoryLimit.Name():   1024,
+		StatSpikeHeadroom.Name(): 1024 - 256 - 600,
+		StatDropping.Name():      0,
+	}, gauges())
+	assert.Equal(t, float64(0), viewValue(t, StatDroppingDuration.Name(), "memory-stats"))
+
+	currentMemAlloc = 900 + mc.ballastSize
+	mc.memCheck()
+	assert.Equal(t, map[string]float64{
+		StatHeapAlloc.Name():     900,
+		StatMemoryLimit.Name():   1024,
+		StatSpikeHeadroom.Name(): 0,
+		StatDropping.Name():      1,
+	}, gauges())
+
+	// The time between checks above the hard limit is added to the total
+	// dropping duration, until back under the limit.
+	time.Sleep(10 * time.Millisecond)
+	currentMemAlloc = 600 + mc.ballastSize
+	mc.memCheck()
+	duration := viewValue(t, StatDroppingDuration.Name(), "memory-stats")
+	assert.True(t, duration >= 0.01, "dropping duration %v", duration)
+	assert.Equal(t, float64(0), viewValue(t, StatDropping.Name(), "memory-stats"))
+
+	time.Sleep(10 * time.Millisecond)
+	mc.memCheck()
+	assert.Equal(t, duration, viewValue(t, StatDroppingDuration.Name(), "memory-stats"))
+}
+
+// viewValue returns the value of a Sum, Count or LastValue view, or the count
+// of a Distribution view, for the processor.
+func viewValue(t *testing.T, viewName, processorName string) float64 {
+	rows, err := view.RetrieveData(viewName)
+	require.NoError(t, err)
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Key != TagProcessorNameKey || tag.Value != processorName {
+				continue
+			}
+			switch data := row.Data.(type) {
+			case *view.SumData:
+				return data.Value
+			case *view.CountData:
+				return float64(data.Value)
+			case *view.LastValueData:
+				return data.Value
+			case *view.DistributionData:
+				return float64(data.Count)
+			}
+		}
+	}
+	return 0
+}
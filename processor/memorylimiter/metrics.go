@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// This file contains metrics to record dropped data via memory limiter,
+// This file contains metrics to record dropped data and memory usage via memory limiter,
 // the package and its int wouldn't be necessary when proper dependencies are
 // exposed via packages.
 
@@ -28,12 +28,67 @@ import (
 
 // Keys and stats for telemetry.
 var (
-	TagExporterNameKey, _ = tag.NewKey("exporter")
+	TagProcessorNameKey, _ = tag.NewKey("processor")
 
 	StatDroppedSpanCount = stats.Int64(
 		"spans_dropped",
 		"counts the number of spans dropped",
 		stats.UnitDimensionless)
+
+	StatShedSpanCount = stats.Int64(
+		"spans_shed",
+		"counts the number of low priority spans dropped from the batches let through above the hard limit",
+		stats.UnitDimensionless)
+
+	StatDroppedMetricCount = stats.Int64(
+		"metrics_dropped",
+		"counts the number of metrics dropped",
+		stats.UnitDimensionless)
+
+	StatRefusedSpanCount = stats.Int64(
+		"spans_refused",
+		"counts the number of spans refused because of the soft limit",
+		stats.UnitDimensionless)
+
+	StatRefusedMetricCount = stats.Int64(
+		"metrics_refused",
+		"counts the number of metrics refused because of the soft limit",
+		stats.UnitDimensionless)
+
+	StatForcedGCDuration = stats.Float64(
+		"forced_gc_duration",
+		"duration of the GCs forced because of the hard limit",
+		stats.UnitMilliseconds)
+
+	StatHeapAlloc = stats.Int64(
+		"memory_limiter_heap_alloc",
+		"heap memory allocated, minus the ballast, at the last check",
+		stats.UnitBytes)
+
+	StatMemoryUsage = stats.Int64(
+		"memory_limiter_usage",
+		"memory usage the limits apply to at the last check, the highest of the configured measures",
+		stats.UnitBytes)
+
+	StatMemoryLimit = stats.Int64(
+		"memory_limiter_limit",
+		"configured memory limit",
+		stats.UnitBytes)
+
+	StatSpikeHeadroom = stats.Int64(
+		"memory_limiter_spike_headroom",
+		"memory that can still be allocated before reaching the hard limit, the memory limit minus the spike limit",
+		stats.UnitBytes)
+
+	StatDropping = stats.Int64(
+		"memory_limiter_dropping",
+		"1 when data is being dropped because of the hard limit, 0 otherwise",
+		stats.UnitDimensionless)
+
+	StatDroppingDuration = stats.Float64(
+		"memory_limiter_dropping_duration",
+		"total time data has been dropped because of the hard limit",
+		"s")
 )
 
 var initOnce sync.Once
@@ -41,7 +96,7 @@ var initOnce sync.Once
 func initMetrics() {
 	initOnce.Do(func() {
 		tagKeys := []tag.Key{
-			TagExporterNameKey,
+			TagProcessorNameKey,
 		}
 		droppedBatchesView := &view.View{
 			Name:        "batches_dropped",
@@ -57,8 +112,84 @@ func initMetrics() {
 			TagKeys:     tagKeys,
 			Aggregation: view.Sum(),
 		}
+		shedSpansView := &view.View{
+			Name:        StatShedSpanCount.Name(),
+			Measure:     StatShedSpanCount,
+			Description: "The number of low priority spans dropped from the batches let through above the hard limit.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		droppedMetricBatchesView := &view.View{
+			Name:        "metric_batches_dropped",
+			Measure:     StatDroppedMetricCount,
+			Description: "The number of metric batches dropped.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Count(),
+		}
+		droppedMetricsView := &view.View{
+			Name:        StatDroppedMetricCount.Name(),
+			Measure:     StatDroppedMetricCount,
+			Description: "The number of metrics dropped.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		refusedSpansView := &view.View{
+			Name:        StatRefusedSpanCount.Name(),
+			Measure:     StatRefusedSpanCount,
+			Description: "The number of spans refused because of the soft limit.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		refusedMetricsView := &view.View{
+			Name:        StatRefusedMetricCount.Name(),
+			Measure:     StatRefusedMetricCount,
+			Description: "The number of metrics refused because of the soft limit.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Sum(),
+		}
+		forcedGCsView := &view.View{
+			Name:        "forced_gcs",
+			Measure:     StatForcedGCDuration,
+			Description: "The number of GCs forced because of the hard limit.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Count(),
+		}
+		forcedGCDurationView := &view.View{
+			Name:        StatForcedGCDuration.Name(),
+			Measure:     StatForcedGCDuration,
+			Description: "The duration of the GCs forced because of the hard limit.",
+			TagKeys:     tagKeys,
+			Aggregation: view.Distribution(1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000),
+		}
+		gaugeViews := make([]*view.View, 0, 6)
+		for _, measure := range []stats.Measure{
+			StatHeapAlloc,
+			StatMemoryUsage,
+			StatMemoryLimit,
+			StatSpikeHeadroom,
+			StatDropping,
+			StatDroppingDuration,
+		} {
+			gaugeViews = append(gaugeViews, &view.View{
+				Name:        measure.Name(),
+				Measure:     measure,
+				Description: "The " + measure.Description() + ".",
+				TagKeys:     tagKeys,
+				Aggregation: view.LastValue(),
+			})
+		}
 
-		view.Register(droppedBatchesView, droppedSpansView)
+		view.Register(gaugeViews...)
+		view.Register(
+			droppedBatchesView,
+			droppedSpansView,
+			shedSpansView,
+			droppedMetricBatchesView,
+			droppedMetricsView,
+			refusedSpansView,
+			refusedMetricsView,
+			forcedGCsView,
+			forcedGCDurationView)
 	})
 }
 
@@ -67,7 +198,7 @@ func initMetrics() {
 // function. This ensures uniformity of labels for the metrics.
 func statsTagsForBatch(processorName string) []tag.Mutator {
 	statsTags := []tag.Mutator{
-		tag.Upsert(TagExporterNameKey, processorName),
+		tag.Upsert(TagProcessorNameKey, processorName),
 	}
 
 	return statsTags
@@ -0,0 +1,138 @@
+// Copyright 2019, OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memorylimiter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+
+	"github.com/Omnition/omnition-opentelemetry-service/internal/attributes"
+)
+
+// samplingPriorityAttribute is the span attribute holding the sampling
+// priority, as set by OpenTracing clients.
+const samplingPriorityAttribute = "sampling.priority"
+
+var errPriorityOutOfRange = errors.New("priority must be greater than zero")
+
+// prioritizer gives the priority of the data going through the processor
+// according to the priority rules. Data matching no rule has priority zero.
+type prioritizer struct {
+	rules []PriorityConfig
+	// levels holds the distinct priorities of the rules, in increasing order.
+	levels []int64
+}
+
+func newPrioritizer(rules []PriorityConfig) (*prioritizer, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	seen := make(map[int64]bool)
+	p := &prioritizer{rules: rules}
+	for i, r := range rules {
+		if r.Priority == 0 {
+			return nil, errPriorityOutOfRange
+		}
+		if r.ServiceName == "" && len(r.SpanAttributes) == 0 && r.SamplingPriority == 0 {
+			return nil, fmt.Errorf("priority rule %d matches all data, it needs service-name, span-attributes or sampling-priority", i)
+		}
+		if !seen[int64(r.Priority)] {
+			seen[int64(r.Priority)] = true
+			p.levels = append(p.levels, int64(r.Priority))
+		}
+	}
+	sort.Slice(p.levels, func(i, j int) bool { return p.levels[i] < p.levels[j] })
+	return p, nil
+}
+
+// spanPriorities returns the priority of each span of the batch and the
+// highest of them.
+func (p *prioritizer) spanPriorities(td consumerdata.TraceData) ([]int64, int64) {
+	// Only the rules matching the service name of the batch have to be
+	// checked for each span.
+	service := td.Node.GetServiceInfo().GetName()
+	var candidates []PriorityConfig
+	for _, r := range p.rules {
+		if r.ServiceName == "" || r.ServiceName == service {
+			candidates = append(candidates, r)
+		}
+	}
+
+	priorities := make([]int64, len(td.Spans))
+	var max int64
+	for i, span := range td.Spans {
+		for _, r := range candidates {
+			if int64(r.Priority) > priorities[i] && r.matchesSpan(span) {
+				priorities[i] = int64(r.Priority)
+			}
+		}
+		if priorities[i] > max {
+			max = priorities[i]
+		}
+	}
+	return priorities, max
+}
+
+// metricsPriority returns the priority of a metrics batch, only the rules
+// matching on the service name alone apply to metrics.
+func (p *prioritizer) metricsPriority(md consumerdata.MetricsData) int64 {
+	service := md.Node.GetServiceInfo().GetName()
+	var priority int64
+	for _, r := range p.rules {
+		if r.ServiceName == service && len(r.SpanAttributes) == 0 && r.SamplingPriority == 0 &&
+			int64(r.Priority) > priority {
+			priority = int64(r.Priority)
+		}
+	}
+	return priority
+}
+
+// matchesSpan returns whether the span attributes and sampling priority of
+// the rule match the span.
+func (r PriorityConfig) matchesSpan(span *tracepb.Span) bool {
+	attributeMap := span.GetAttributes().GetAttributeMap()
+	for k, v := range r.SpanAttributes {
+		value, ok := attributeMap[k]
+		if !ok || attributes.ValueString(value) != v {
+			return false
+		}
+	}
+	if r.SamplingPriority != 0 {
+		priority, ok := samplingPriority(attributeMap[samplingPriorityAttribute])
+		if !ok || priority < r.SamplingPriority {
+			return false
+		}
+	}
+	return true
+}
+
+func samplingPriority(value *tracepb.AttributeValue) (int64, bool) {
+	switch v := value.GetValue().(type) {
+	case *tracepb.AttributeValue_IntValue:
+		return v.IntValue, true
+	case *tracepb.AttributeValue_DoubleValue:
+		return int64(v.DoubleValue), true
+	case *tracepb.AttributeValue_StringValue:
+		priority, err := strconv.ParseInt(v.StringValue.GetValue(), 10, 64)
+		return priority, err == nil
+	}
+	return 0, false
+}
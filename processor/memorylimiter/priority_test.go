@@ -0,0 +1,125 @@
+// Copyright 2019, OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memorylimiter
+
+import (
+	"testing"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+)
+
+func testNode(service string) *commonpb.Node {
+	return &commonpb.Node{ServiceInfo: &commonpb.ServiceInfo{Name: service}}
+}
+
+func testSpan(attributes map[string]*tracepb.AttributeValue) *tracepb.Span {
+	return &tracepb.Span{Attributes: &tracepb.Span_Attributes{AttributeMap: attributes}}
+}
+
+func boolAttribute(value bool) *tracepb.AttributeValue {
+	return &tracepb.AttributeValue{Value: &tracepb.AttributeValue_BoolValue{BoolValue: value}}
+}
+
+func intAttribute(value int64) *tracepb.AttributeValue {
+	return &tracepb.AttributeValue{Value: &tracepb.AttributeValue_IntValue{IntValue: value}}
+}
+
+func TestNewPrioritizer(t *testing.T) {
+	p, err := newPrioritizer(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	_, err = newPrioritizer([]PriorityConfig{{ServiceName: "checkout"}})
+	assert.Equal(t, errPriorityOutOfRange, err)
+
+	_, err = newPrioritizer([]PriorityConfig{{Priority: 1}})
+	assert.Error(t, err)
+
+	p, err = newPrioritizer([]PriorityConfig{
+		{Priority: 10, SpanAttributes: map[string]string{"error": "true"}},
+		{Priority: 5, ServiceName: "checkout"},
+		{Priority: 10, SamplingPriority: 1},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int64{5, 10}, p.levels)
+}
+
+func TestSpanPriorities(t *testing.T) {
+	p, err := newPrioritizer([]PriorityConfig{
+		{Priority: 10, SpanAttributes: map[string]string{"error": "true"}},
+		{Priority: 5, ServiceName: "checkout"},
+		{Priority: 7, ServiceName: "checkout", SamplingPriority: 1},
+	})
+	require.NoError(t, err)
+
+	spans := []*tracepb.Span{
+		testSpan(nil),
+		testSpan(map[string]*tracepb.AttributeValue{"error": boolAttribute(true)}),
+		testSpan(map[string]*tracepb.AttributeValue{"error": boolAttribute(false)}),
+		testSpan(map[string]*tracepb.AttributeValue{samplingPriorityAttribute: intAttribute(1)}),
+	}
+
+	priorities, max := p.spanPriorities(consumerdata.TraceData{Node: testNode("frontend"), Spans: spans})
+	assert.Equal(t, []int64{0, 10, 0, 0}, priorities)
+	assert.Equal(t, int64(10), max)
+
+	priorities, max = p.spanPriorities(consumerdata.TraceData{Node: testNode("checkout"), Spans: spans})
+	assert.Equal(t, []int64{5, 10, 5, 7}, priorities)
+	assert.Equal(t, int64(10), max)
+
+	priorities, max = p.spanPriorities(consumerdata.TraceData{Spans: spans[:1]})
+	assert.Equal(t, []int64{0}, priorities)
+	assert.Equal(t, int64(0), max)
+}
+
+func TestMetricsPriority(t *testing.T) {
+	p, err := newPrioritizer([]PriorityConfig{
+		{Priority: 10, SpanAttributes: map[string]string{"error": "true"}},
+		{Priority: 5, ServiceName: "checkout"},
+		{Priority: 7, ServiceName: "checkout", SamplingPriority: 1},
+	})
+	require.NoError(t, err)
+
+	// Only the rules on the service name alone apply to metrics.
+	assert.Equal(t, int64(5), p.metricsPriority(consumerdata.MetricsData{Node: testNode("checkout")}))
+	assert.Equal(t, int64(0), p.metricsPriority(consumerdata.MetricsData{Node: testNode("frontend")}))
+	assert.Equal(t, int64(0), p.metricsPriority(consumerdata.MetricsData{}))
+}
+
+func TestSamplingPriority(t *testing.T) {
+	r := PriorityConfig{Priority: 1, SamplingPriority: 2}
+	for _, tt := range []struct {
+		value *tracepb.AttributeValue
+		want  bool
+	}{
+		{value: nil, want: false},
+		{value: intAttribute(1), want: false},
+		{value: intAttribute(2), want: true},
+		{value: &tracepb.AttributeValue{Value: &tracepb.AttributeValue_DoubleValue{DoubleValue: 3}}, want: true},
+		{value: &tracepb.AttributeValue{Value: &tracepb.AttributeValue_StringValue{
+			StringValue: &tracepb.TruncatableString{Value: "2"}}}, want: true},
+		{value: &tracepb.AttributeValue{Value: &tracepb.AttributeValue_StringValue{
+			StringValue: &tracepb.TruncatableString{Value: "high"}}}, want: false},
+		{value: boolAttribute(true), want: false},
+	} {
+		span := testSpan(map[string]*tracepb.AttributeValue{samplingPriorityAttribute: tt.value})
+		assert.Equal(t, tt.want, r.matchesSpan(span), "sampling priority %v", tt.value)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	gatewayruntime "github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/Omnition/omnition-opentelemetry-service/receiver/opencensusreceiver/octrace"
+)
+
+const (
+	// apiKeyHeader is the gRPC metadata key, and HTTP header, holding the
+	// API key. The bearer token is read from the authorization one.
+	apiKeyHeader = "x-api-key"
+
+	defaultTenantLabel = "tenant"
+)
+
+var (
+	errNoTokens        = errors.New("auth requires tokens or a tokens-file")
+	errEmptyToken      = errors.New("auth tokens can't be empty")
+	errUnauthenticated = status.Error(codes.Unauthenticated, "missing or invalid bearer token or API key")
+	errMultipleTokens  = status.Error(codes.Unauthenticated, "multiple bearer tokens or API keys")
+)
+
+// tokenHash is the key the tokens are looked up by, hashing them makes the
+// lookup time independent of the tokens the clients send.
+type tokenHash [sha256.Size]byte
+
+// authenticator authenticates the gRPC calls, and through the grpc-gateway
+// the HTTP requests, with a bearer token or an API key. The tenant of the
+// matched token is set as a label of the resource of the received spans, the
+// label sent by the clients is removed for the tokens without a tenant.
+type authenticator struct {
+	staticTokens map[tokenHash]string
+	tenantLabel  string
+
+	tokensFile string
+	reloader   *fileReloader
+	// fileTokens holds the map[tokenHash]string of the tokens file.
+	fileTokens atomic.Value
+}
+
+func newAuthenticator(cfg *authConfig) (*authenticator, error) {
+	if len(cfg.Tokens) == 0 && cfg.TokensFile == "" {
+		return nil, errNoTokens
+	}
+
+	a := &authenticator{
+		staticTokens: make(map[tokenHash]string, len(cfg.Tokens)),
+		tenantLabel:  cfg.TenantLabel,
+		tokensFile:   cfg.TokensFile,
+	}
+	if a.tenantLabel == "" {
+		a.tenantLabel = defaultTenantLabel
+	}
+	for _, t := range cfg.Tokens {
+		if t.Token == "" {
+			return nil, errEmptyToken
+		}
+		a.staticTokens[sha256.Sum256([]byte(t.Token))] = t.Tenant
+	}
+
+	if a.tokensFile != "" {
+		var err error
+		a.reloader, err = newFileReloader([]string{a.tokensFile}, a.loadTokensFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// loadTokensFile loads the tokens file. It has one token per line, optionally
+// followed by its tenant after white spaces. Empty lines and lines starting
+// with # are ignored.
+func (a *authenticator) loadTokensFile() error {
+	f, err := os.Open(a.tokensFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tokens := map[tokenHash]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 2 {
+			return fmt.Errorf("%s:%d: want a token and an optional tenant, got %d fields", a.tokensFile, line, len(fields))
+		}
+		var tenant string
+		if len(fields) == 2 {
+			tenant = fields[1]
+		}
+		tokens[sha256.Sum256([]byte(fields[0]))] = tenant
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.fileTokens.Store(tokens)
+	return nil
+}
+
+// authenticate checks the token of the incoming call and returns its context
+// with the resource label of the tenant.
+func (a *authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	token, err := requestToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	tenant, ok := a.staticTokens[hash]
+	if !ok && a.reloader != nil {
+		tenant, ok = a.fileTokens.Load().(map[tokenHash]string)[hash]
+	}
+	if !ok {
+		return nil, errUnauthenticated
+	}
+
+	return octrace.ContextWithResourceLabels(ctx, map[string]string{a.tenantLabel: tenant}), nil
+}
+
+// requestToken returns the bearer token or the API key of the incoming call.
+func requestToken(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var tokens []string
+	for _, v := range md.Get("authorization") {
+		// The scheme is case insensitive.
+		if len(v) > len("bearer ") && strings.EqualFold(v[:len("bearer ")], "bearer ") {
+			tokens = append(tokens, strings.TrimSpace(v[len("bearer "):]))
+		}
+	}
+	tokens = append(tokens, md.Get(apiKeyHeader)...)
+
+	switch len(tokens) {
+	case 0:
+		return "", errUnauthenticated
+	case 1:
+		return tokens[0], nil
+	default:
+		return "", errMultipleTokens
+	}
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *authenticator) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authenticatedStream is a server stream with the context returned by
+// authenticate.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// gatewayHeaderMatcher forwards the API key header to the gRPC server on top
+// of the headers forwarded by default, the authorization header among them.
+func gatewayHeaderMatcher(key string) (string, bool) {
+	if strings.EqualFold(key, apiKeyHeader) {
+		return apiKeyHeader, true
+	}
+	return gatewayruntime.DefaultHeaderMatcher(key)
+}
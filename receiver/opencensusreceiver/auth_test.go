@@ -0,0 +1,304 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	resourcepb "github.com/census-instrumentation/opencensus-proto/gen-go/resource/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
+	"github.com/open-telemetry/opentelemetry-service/exporter/exportertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuth_endToEnd(t *testing.T) {
+	cfg := &Config{
+		ReceiverSettings: configmodels.ReceiverSettings{
+			TypeVal:  typeStr,
+			NameVal:  typeStr,
+			Endpoint: getAvailableLoopbackAddress(t),
+		},
+		EnableBackPressure: true,
+		Auth: &authConfig{
+			Tokens: []tokenConfig{
+				{Token: "acme-token", Tenant: "acme"},
+				{Token: "shared-token"},
+			},
+			TenantLabel: "customer",
+		},
+	}
+	traceSink := new(exportertest.SinkTraceExporter)
+	metricsSink := new(exportertest.SinkMetricsExporter)
+	ocr := startTestReceiver(t, cfg, traceSink, metricsSink)
+	defer ocr.stop()
+
+	cc, err := grpc.Dial(cfg.Endpoint, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+	client := agenttracepb.NewTraceServiceClient(cc)
+
+	grpcTests := []struct {
+		name       string
+		md         metadata.MD
+		wantCode   codes.Code
+		wantTenant string
+	}{
+		{
+			name:     "no_token",
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "invalid_token",
+			md:       metadata.Pairs("authorization", "Bearer other-token"),
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "not_bearer",
+			md:       metadata.Pairs("authorization", "Basic acme-token"),
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "bearer_and_api_key",
+			md:       metadata.Pairs("authorization", "Bearer acme-token", "x-api-key", "shared-token"),
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:       "bearer",
+			md:         metadata.Pairs("authorization", "bearer acme-token"),
+			wantTenant: "acme",
+		},
+		{
+			name:       "api_key",
+			md:         metadata.Pairs("x-api-key", "acme-token"),
+			wantTenant: "acme",
+		},
+		{
+			name: "no_tenant",
+			md:   metadata.Pairs("x-api-key", "shared-token"),
+		},
+	}
+	for _, tt := range grpcTests {
+		t.Run("grpc_"+tt.name, func(t *testing.T) {
+			before := len(traceSink.AllTraces())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			ctx = metadata.NewOutgoingContext(ctx, tt.md)
+			// The tenant label sent by the client is never trusted.
+			_, err := client.ExportOne(ctx, &agenttracepb.ExportTraceServiceRequest{
+				Node:     &commonpb.Node{},
+				Resource: &resourcepb.Resource{Labels: map[string]string{"customer": "spoofed"}},
+				Spans:    []*tracepb.Span{{}},
+			})
+			assert.Equal(t, tt.wantCode, status.Code(err))
+
+			traces := traceSink.AllTraces()[before:]
+			if tt.wantCode != codes.OK {
+				assert.Len(t, traces, 0)
+				return
+			}
+			require.Len(t, traces, 1)
+			assert.Equal(t, tt.wantTenant, traces[0].Resource.GetLabels()["customer"])
+		})
+	}
+
+	// The stream calls are authenticated too.
+	stream, err := client.Export(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&agenttracepb.ExportTraceServiceRequest{Node: &commonpb.Node{}}))
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	httpTests := []struct {
+		name       string
+		path       string
+		header     http.Header
+		wantStatus int
+		wantTenant string
+	}{
+		{
+			name:       "no_token",
+			path:       "/v1/trace",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "metrics_no_token",
+			path:       "/v1/metrics",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "bearer",
+			path:       "/v1/trace",
+			header:     http.Header{"Authorization": {"Bearer acme-token"}},
+			wantStatus: http.StatusOK,
+			wantTenant: "acme",
+		},
+		{
+			name:       "api_key",
+			path:       "/v1/trace",
+			header:     http.Header{"X-Api-Key": {"acme-token"}},
+			wantStatus: http.StatusOK,
+			wantTenant: "acme",
+		},
+		{
+			name:       "invalid_api_key",
+			path:       "/v1/trace",
+			header:     http.Header{"X-Api-Key": {"other-token"}},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range httpTests {
+		t.Run("http_"+tt.name, func(t *testing.T) {
+			before := len(traceSink.AllTraces())
+			body := testTraceJSON
+			if tt.path == "/v1/metrics" {
+				body = testMetricsJSON
+			}
+			req, err := http.NewRequest("POST", "http://"+cfg.Endpoint+tt.path, strings.NewReader(body))
+			require.NoError(t, err)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+
+			traces := traceSink.AllTraces()[before:]
+			if tt.wantStatus != http.StatusOK {
+				assert.Len(t, traces, 0)
+				return
+			}
+			require.Len(t, traces, 1)
+			assert.Equal(t, tt.wantTenant, traces[0].Resource.GetLabels()["customer"])
+		})
+	}
+	assert.Len(t, metricsSink.AllMetrics(), 0)
+}
+
+func TestAuthenticator_tokensFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opencensusreceiver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tokensFile := filepath.Join(dir, "tokens")
+	require.NoError(t, ioutil.WriteFile(tokensFile, []byte("# Agents\n\ntoken-1 tenant-1\ntoken-2\n"), 0600))
+
+	a, err := newAuthenticator(&authConfig{
+		Tokens:     []tokenConfig{{Token: "static-token"}},
+		TokensFile: tokensFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, defaultTenantLabel, a.tenantLabel)
+
+	authenticate := func(token string) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(apiKeyHeader, token))
+		_, err := a.authenticate(ctx)
+		return err
+	}
+	assert.NoError(t, authenticate("static-token"))
+	assert.NoError(t, authenticate("token-1"))
+	assert.NoError(t, authenticate("token-2"))
+	assert.Equal(t, errUnauthenticated, authenticate("token-3"))
+
+	// The file isn't checked when authenticating, only when it's reloaded.
+	require.NoError(t, ioutil.WriteFile(tokensFile, []byte("token-2\ntoken-3 tenant-3\n"), 0600))
+	mtime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(tokensFile, mtime, mtime))
+	assert.Equal(t, errUnauthenticated, authenticate("token-3"))
+	a.reloader.reload()
+	assert.NoError(t, authenticate("static-token"))
+	assert.Equal(t, errUnauthenticated, authenticate("token-1"))
+	assert.NoError(t, authenticate("token-2"))
+	assert.NoError(t, authenticate("token-3"))
+
+	// An invalid file is ignored, the previous tokens are kept.
+	require.NoError(t, ioutil.WriteFile(tokensFile, []byte("token-4 tenant-4 extra\n"), 0600))
+	mtime = mtime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(tokensFile, mtime, mtime))
+	a.reloader.reload()
+	assert.NoError(t, authenticate("token-3"))
+	assert.Equal(t, errUnauthenticated, authenticate("token-4"))
+
+	// The file is checked in the background while it's watched.
+	a.reloader.checkInterval = 10 * time.Millisecond
+	a.reloader.watch()
+	defer a.reloader.stop()
+	require.NoError(t, ioutil.WriteFile(tokensFile, []byte("token-5\n"), 0600))
+	mtime = mtime.Add(time.Minute)
+	require.NoError(t, os.Chtimes(tokensFile, mtime, mtime))
+	for deadline := time.Now().Add(5 * time.Second); authenticate("token-5") != nil; {
+		require.True(t, time.Now().Before(deadline), "tokens file not reloaded")
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, errUnauthenticated, authenticate("token-3"))
+}
+
+func TestNewAuthenticator_errors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opencensusreceiver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	invalidFile := filepath.Join(dir, "invalid")
+	require.NoError(t, ioutil.WriteFile(invalidFile, []byte("token tenant extra\n"), 0600))
+
+	tests := []struct {
+		name    string
+		cfg     authConfig
+		wantErr string
+	}{
+		{
+			name:    "no_tokens",
+			wantErr: errNoTokens.Error(),
+		},
+		{
+			name:    "empty_token",
+			cfg:     authConfig{Tokens: []tokenConfig{{Tenant: "acme"}}},
+			wantErr: errEmptyToken.Error(),
+		},
+		{
+			name:    "missing_file",
+			cfg:     authConfig{TokensFile: filepath.Join(dir, "missing")},
+			wantErr: "missing",
+		},
+		{
+			name:    "invalid_file",
+			cfg:     authConfig{TokensFile: invalidFile},
+			wantErr: invalidFile + ":1: want a token and an optional tenant, got 3 fields",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newAuthenticator(&tt.cfg)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
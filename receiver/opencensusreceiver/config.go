@@ -15,12 +15,13 @@
 package opencensusreceiver
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
+	"golang.org/x/net/http2"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 
 	"github.com/Omnition/omnition-opentelemetry-service/receiver/opencensusreceiver/octrace"
@@ -33,7 +34,9 @@ type Config struct {
 	// TLSCredentials is a (cert_file, key_file) configuration.
 	TLSCredentials *tlsCredentials `mapstructure:"tls-credentials,omitempty"`
 
-	// Keepalive anchor for all the settings related to keepalive.
+	// Keepalive anchor for all the settings related to keepalive. Only
+	// max-connection-idle applies to the connections of the clients, the
+	// gRPC requests are served by the HTTP/2 server of the HTTP/JSON ones.
 	Keepalive *serverParametersAndEnforcementPolicy `mapstructure:"keepalive,omitempty"`
 
 	// MaxRecvMsgSizeMiB sets the maximum size (in MiB) of messages accepted by the server.
@@ -48,6 +51,64 @@ type Config struct {
 
 	// MaxServerStreams sets the limit on the number of receiving routines for the trace receiver.
 	MaxServerStreams uint64 `mapstructure:"max-server-streams"`
+
+	// Auth enables the authentication of the clients with a bearer token or an API key.
+	Auth *authConfig `mapstructure:"auth,omitempty"`
+
+	// RateLimit enables the rate limiting of the spans received from each
+	// client.
+	RateLimit *rateLimitConfig `mapstructure:"rate-limit,omitempty"`
+}
+
+// rateLimitConfig holds the token bucket limits of the spans received from
+// each client, the requests over the limits are rejected with a
+// RESOURCE_EXHAUSTED status, or a 429 one over HTTP, and a retry delay. Only
+// the first message of a stream is rejected, the following ones over the
+// limits are dropped and the stream stays open.
+type rateLimitConfig struct {
+	// Key is what identifies the clients: "peer" (the default) for their IP
+	// address, "host-name" for the host name of their node or
+	// "service-name" for the service name of their node. The clients
+	// without host or service name are limited by their IP address.
+	Key string `mapstructure:"key,omitempty"`
+
+	// SpansPerSecond is the number of spans accepted per second, 0 disables
+	// the limit.
+	SpansPerSecond float64 `mapstructure:"spans-per-second,omitempty"`
+
+	// SpansBurst is the number of spans accepted at once, it defaults to
+	// SpansPerSecond.
+	SpansBurst int `mapstructure:"spans-burst,omitempty"`
+
+	// BytesPerSecond is the number of bytes of requests accepted per
+	// second, 0 disables the limit.
+	BytesPerSecond float64 `mapstructure:"bytes-per-second,omitempty"`
+
+	// BytesBurst is the number of bytes accepted at once, it defaults to
+	// BytesPerSecond.
+	BytesBurst int `mapstructure:"bytes-burst,omitempty"`
+}
+
+// authConfig holds the tokens the clients are authenticated with. A token is
+// sent as a bearer token in the authorization gRPC metadata or HTTP header,
+// or as an API key in the x-api-key one.
+type authConfig struct {
+	// Tokens are the accepted tokens.
+	Tokens []tokenConfig `mapstructure:"tokens,omitempty"`
+
+	// TokensFile is the path of a file with more accepted tokens, one per
+	// line optionally followed by its tenant. It is reloaded when it changes.
+	TokensFile string `mapstructure:"tokens-file,omitempty"`
+
+	// TenantLabel is the resource label the tenant of the token is set in on
+	// the received spans, "tenant" by default. The label sent by the clients
+	// is always replaced, or removed for the tokens without a tenant.
+	TenantLabel string `mapstructure:"tenant-label,omitempty"`
+}
+
+type tokenConfig struct {
+	Token  string `mapstructure:"token"`
+	Tenant string `mapstructure:"tenant,omitempty"`
 }
 
 // tlsCredentials holds the fields for TLS credentials
@@ -58,6 +119,25 @@ type tlsCredentials struct {
 
 	// KeyFile is the file path containing the TLS key.
 	KeyFile string `mapstructure:"key-file"`
+
+	// ClientCAFile is the file path containing the certificates of the CAs
+	// the client certificates are verified with. Setting it enables mutual
+	// TLS.
+	ClientCAFile string `mapstructure:"client-ca-file,omitempty"`
+
+	// ClientAuth is "required" (the default) to refuse the clients without
+	// a valid certificate or "optional" to only verify the certificates of
+	// the clients sending one. It requires ClientCAFile.
+	ClientAuth string `mapstructure:"client-auth,omitempty"`
+
+	// MinVersion is the minimum TLS version accepted: "1.0", "1.1", "1.2"
+	// or "1.3". It defaults to the Go default.
+	MinVersion string `mapstructure:"min-version,omitempty"`
+
+	// CipherSuites are the names of the cipher suites accepted for TLS 1.2
+	// and below, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". They default
+	// to the Go defaults.
+	CipherSuites []string `mapstructure:"cipher-suites,omitempty"`
 }
 
 type serverParametersAndEnforcementPolicy struct {
@@ -91,12 +171,38 @@ func (rOpts *Config) buildOptions() (opts []Option, err error) {
 		opts = append(opts, tlsCredsOption)
 	}
 
+	if rOpts.MaxRecvMsgSizeMiB > 0 {
+		opts = append(opts, WithMaxRecvMsgSize(int(rOpts.MaxRecvMsgSizeMiB*1024*1024)))
+	}
+
 	grpcServerOptions := rOpts.grpcServerOptions()
+	if rOpts.Auth != nil {
+		auth, err := newAuthenticator(rOpts.Auth)
+		if err != nil {
+			return opts, fmt.Errorf("OpenCensus receiver auth: %v", err)
+		}
+		grpcServerOptions = append(grpcServerOptions,
+			grpc.UnaryInterceptor(auth.unaryInterceptor),
+			grpc.StreamInterceptor(auth.streamInterceptor))
+		if auth.reloader != nil {
+			opts = append(opts, withFileReloaders(auth.reloader))
+		}
+	}
 	if len(grpcServerOptions) > 0 {
 		opts = append(opts, WithGRPCServerOptions(grpcServerOptions...))
 	}
+	if h2s := rOpts.http2Server(); h2s != nil {
+		opts = append(opts, WithHTTP2Server(h2s))
+	}
 
 	traceReceiverOptions := rOpts.traceReceiverOptions()
+	if rOpts.RateLimit != nil {
+		rateLimit, err := rOpts.RateLimit.toRateLimit()
+		if err != nil {
+			return opts, fmt.Errorf("OpenCensus receiver rate-limit: %v", err)
+		}
+		traceReceiverOptions = append(traceReceiverOptions, octrace.WithRateLimit(rateLimit))
+	}
 	if len(traceReceiverOptions) > 0 {
 		opts = append(opts, WithTraceReceiverOptions(traceReceiverOptions...))
 	}
@@ -117,6 +223,25 @@ func (rOpts *Config) traceReceiverOptions() []octrace.Option {
 	return opts
 }
 
+func (cfg *rateLimitConfig) toRateLimit() (octrace.RateLimit, error) {
+	limit := octrace.RateLimit{
+		Key:            octrace.RateLimitKey(cfg.Key),
+		SpansPerSecond: cfg.SpansPerSecond,
+		SpansBurst:     cfg.SpansBurst,
+		BytesPerSecond: cfg.BytesPerSecond,
+		BytesBurst:     cfg.BytesBurst,
+	}
+	if limit.Key == "" {
+		limit.Key = octrace.RateLimitByPeer
+	}
+	if limit.SpansPerSecond == 0 && limit.BytesPerSecond == 0 {
+		return limit, errors.New("spans-per-second or bytes-per-second must be set")
+	}
+	// The other settings are checked by the trace receiver, they are
+	// validated here so the errors are reported with the config ones.
+	return limit, limit.Validate()
+}
+
 func (rOpts *Config) grpcServerOptions() []grpc.ServerOption {
 	var grpcServerOptions []grpc.ServerOption
 	if rOpts.MaxRecvMsgSizeMiB > 0 {
@@ -148,20 +273,37 @@ func (rOpts *Config) grpcServerOptions() []grpc.ServerOption {
 	return grpcServerOptions
 }
 
+// http2Server returns the HTTP/2 server with the connection settings that
+// apply to it, or nil if there are none.
+func (rOpts *Config) http2Server() *http2.Server {
+	var idleTimeout time.Duration
+	if rOpts.Keepalive != nil && rOpts.Keepalive.ServerParameters != nil {
+		idleTimeout = rOpts.Keepalive.ServerParameters.MaxConnectionIdle
+	}
+	if rOpts.MaxConcurrentStreams == 0 && idleTimeout == 0 {
+		return nil
+	}
+	return &http2.Server{
+		MaxConcurrentStreams: rOpts.MaxConcurrentStreams,
+		IdleTimeout:          idleTimeout,
+	}
+}
+
 // ToOpenCensusReceiverServerOption checks if the TLS credentials
 // in the form of a certificate file and a key file. If they aren't,
 // it will return opencensusreceiver.WithNoopOption() and a nil error.
-// Otherwise, it will try to retrieve gRPC transport credentials from the file combinations,
-// and create a option, along with any errors encountered while retrieving the credentials.
+// Otherwise, it will try to load the key pair and the client CAs from the
+// files, and create a option serving the receiver over TLS, along with any
+// errors encountered while loading them. The files are reloaded when they
+// change.
 func (tlsCreds *tlsCredentials) ToOpenCensusReceiverServerOption() (opt Option, ok bool, err error) {
 	if tlsCreds == nil {
 		return WithNoopOption(), false, nil
 	}
 
-	transportCreds, err := credentials.NewServerTLSFromFile(tlsCreds.CertFile, tlsCreds.KeyFile)
+	reloader, err := newTLSReloader(tlsCreds)
 	if err != nil {
 		return nil, false, err
 	}
-	gRPCCredsOpt := grpc.Creds(transportCreds)
-	return WithGRPCServerOptions(gRPCCredsOpt), true, nil
+	return WithTLSConfig(reloader.tlsConfig()), true, nil
 }
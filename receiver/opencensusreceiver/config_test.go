@@ -39,7 +39,7 @@ func TestLoadConfig(t *testing.T) {
 	require.NoError(t, err)
 	require.NotNil(t, cfg)
 
-	assert.Equal(t, len(cfg.Receivers), 4)
+	assert.Equal(t, len(cfg.Receivers), 7)
 
 	r0 := cfg.Receivers["opencensus"]
 	assert.Equal(t, r0, factory.CreateDefaultConfig())
@@ -84,4 +84,56 @@ func TestLoadConfig(t *testing.T) {
 			MaxRecvMsgSizeMiB:    32,
 			MaxConcurrentStreams: 16,
 		})
+
+	r4 := cfg.Receivers["opencensus/tls"].(*Config)
+	assert.Equal(t, r4.TLSCredentials,
+		&tlsCredentials{
+			CertFile:     "/etc/ssl/receiver.pem",
+			KeyFile:      "/etc/ssl/receiver-key.pem",
+			ClientCAFile: "/etc/ssl/agents-ca.pem",
+			ClientAuth:   "optional",
+			MinVersion:   "1.2",
+			CipherSuites: []string{
+				"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+				"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			},
+		})
+
+	r5 := cfg.Receivers["opencensus/auth"].(*Config)
+	assert.Equal(t, r5.Auth,
+		&authConfig{
+			Tokens: []tokenConfig{
+				{Token: "acme-token", Tenant: "acme"},
+				{Token: "shared-token"},
+			},
+			TokensFile:  "/etc/otelsvc/tokens",
+			TenantLabel: "customer",
+		})
+
+	r6 := cfg.Receivers["opencensus/ratelimit"].(*Config)
+	assert.Equal(t, r6.RateLimit,
+		&rateLimitConfig{
+			Key:            "service-name",
+			SpansPerSecond: 1000,
+			SpansBurst:     5000,
+			BytesPerSecond: 1048576,
+		})
+}
+
+func TestConfig_http2Server(t *testing.T) {
+	assert.Nil(t, (&Config{}).http2Server())
+
+	cfg := &Config{
+		MaxConcurrentStreams: 16,
+		Keepalive: &serverParametersAndEnforcementPolicy{
+			ServerParameters: &keepaliveServerParameters{
+				MaxConnectionIdle: time.Minute,
+				Time:              30 * time.Second,
+			},
+		},
+	}
+	h2s := cfg.http2Server()
+	require.NotNil(t, h2s)
+	assert.Equal(t, uint32(16), h2s.MaxConcurrentStreams)
+	assert.Equal(t, time.Minute, h2s.IdleTimeout)
 }
@@ -0,0 +1,266 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
+	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	"github.com/open-telemetry/opentelemetry-service/exporter/exportertest"
+	"github.com/open-telemetry/opentelemetry-service/receiver/opencensusreceiver/ocmetrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	testTraceJSON = `{
+		"node":{"identifier":{"hostName":"testHost"}},
+		"spans":[{
+			"traceId":"W47/95gDgQPSabYzgT/GDA==",
+			"spanId":"7uGbfsPBsXM=",
+			"name":{"value":"testSpan"},
+			"startTime":"2018-12-13T14:51:00Z",
+			"endTime":"2018-12-13T14:51:01Z"
+		}]
+	}`
+	testMetricsJSON = `{
+		"node":{"identifier":{"hostName":"testHost"}},
+		"metrics":[{
+			"metricDescriptor":{"name":"testMetric","type":"GAUGE_INT64"},
+			"timeseries":[{"points":[{"timestamp":"2018-12-13T14:51:00Z","int64Value":"42"}]}]
+		}]
+	}`
+)
+
+func TestJSONExport_endToEnd(t *testing.T) {
+	tests := []struct {
+		name      string
+		tls       bool
+		http2     bool
+		wantProto string
+	}{
+		{
+			name:      "plaintext",
+			wantProto: "HTTP/1.1",
+		},
+		{
+			name:      "tls",
+			tls:       true,
+			wantProto: "HTTP/1.1",
+		},
+		{
+			name:      "tls_http2",
+			tls:       true,
+			http2:     true,
+			wantProto: "HTTP/2.0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				ReceiverSettings: configmodels.ReceiverSettings{
+					TypeVal:  typeStr,
+					NameVal:  typeStr,
+					Endpoint: getAvailableLoopbackAddress(t),
+				},
+			}
+			scheme := "http"
+			transport := &http.Transport{}
+			if tt.tls {
+				dir, err := ioutil.TempDir("", "opencensusreceiver")
+				require.NoError(t, err)
+				defer os.RemoveAll(dir)
+
+				certFile, keyFile, pool := writeTestCertificate(t, dir)
+				cfg.TLSCredentials = &tlsCredentials{CertFile: certFile, KeyFile: keyFile}
+				scheme = "https"
+				transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+			}
+			if tt.http2 {
+				require.NoError(t, http2.ConfigureTransport(transport))
+			}
+			client := &http.Client{Transport: transport}
+			defer transport.CloseIdleConnections()
+
+			traceSink := new(exportertest.SinkTraceExporter)
+			metricsSink := new(exportertest.SinkMetricsExporter)
+			ocr := startTestReceiver(t, cfg, traceSink, metricsSink)
+			defer ocr.stop()
+
+			url := scheme + "://" + cfg.Endpoint
+			resp := postJSON(t, client, url+"/v1/trace", strings.NewReader(testTraceJSON), true)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, tt.wantProto, resp.Proto)
+			resp = postJSON(t, client, url+"/v1/metrics", strings.NewReader(testMetricsJSON), true)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			traces := traceSink.AllTraces()
+			require.Len(t, traces, 1)
+			assert.Equal(t, "testHost", traces[0].Node.GetIdentifier().GetHostName())
+			require.Len(t, traces[0].Spans, 1)
+			assert.Equal(t, "testSpan", traces[0].Spans[0].GetName().GetValue())
+
+			// The metrics are exported asynchronously.
+			var metrics []consumerdata.MetricsData
+			for i := 0; len(metrics) == 0; i++ {
+				require.True(t, i < 1000, "metrics not exported")
+				time.Sleep(time.Millisecond)
+				metrics = metricsSink.AllMetrics()
+			}
+			require.Len(t, metrics, 1)
+			require.Len(t, metrics[0].Metrics, 1)
+			assert.Equal(t, "testMetric", metrics[0].Metrics[0].GetMetricDescriptor().GetName())
+
+			// gRPC is still served on the same port.
+			dialOpt := grpc.WithInsecure()
+			if tt.tls {
+				dialOpt = grpc.WithTransportCredentials(credentials.NewTLS(transport.TLSClientConfig))
+			}
+			cc, err := grpc.Dial(cfg.Endpoint, dialOpt)
+			require.NoError(t, err)
+			defer cc.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err = agenttracepb.NewTraceServiceClient(cc).ExportOne(ctx, &agenttracepb.ExportTraceServiceRequest{
+				Node:  &commonpb.Node{Identifier: &commonpb.ProcessIdentifier{HostName: "grpcHost"}},
+				Spans: []*tracepb.Span{{Name: &tracepb.TruncatableString{Value: "grpcSpan"}}},
+			})
+			require.NoError(t, err)
+			assert.Len(t, traceSink.AllTraces(), 2)
+		})
+	}
+}
+
+func TestJSONExport_bodySizeLimit(t *testing.T) {
+	cfg := &Config{
+		ReceiverSettings: configmodels.ReceiverSettings{
+			TypeVal:  typeStr,
+			NameVal:  typeStr,
+			Endpoint: getAvailableLoopbackAddress(t),
+		},
+		MaxRecvMsgSizeMiB: 1,
+	}
+	sink := new(exportertest.SinkTraceExporter)
+	ocr := startTestReceiver(t, cfg, sink, nil)
+	defer ocr.stop()
+
+	// Pad the request with white spaces to reach the limit, they are read
+	// before the JSON object.
+	body := func(size int) string {
+		return strings.Repeat(" ", size-len(testTraceJSON)) + testTraceJSON
+	}
+	tests := []struct {
+		name       string
+		size       int
+		withLength bool
+		wantStatus int
+	}{
+		{
+			name:       "at_limit",
+			size:       1024 * 1024,
+			withLength: true,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "over_limit",
+			size:       1024*1024 + 1,
+			withLength: true,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "chunked_at_limit",
+			size:       1024 * 1024,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "chunked_over_limit",
+			size:       1024*1024 + 1,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+	client := &http.Client{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := postJSON(t, client, "http://"+cfg.Endpoint+"/v1/trace", strings.NewReader(body(tt.size)), tt.withLength)
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+	assert.Len(t, sink.AllTraces(), 2)
+}
+
+// startTestReceiver creates the receiver for the configuration and starts
+// it.
+func startTestReceiver(t *testing.T, cfg *Config, tc *exportertest.SinkTraceExporter, mc *exportertest.SinkMetricsExporter) *Receiver {
+	opts, err := cfg.buildOptions()
+	require.NoError(t, err)
+	// Don't wait for more metrics before exporting them.
+	opts = append(opts, WithMetricsReceiverOptions(ocmetrics.WithMetricBufferPeriod(time.Millisecond)))
+	ocr, err := New(cfg.Endpoint, nil, nil, opts...)
+	require.NoError(t, err)
+	// The consumers are set on the receiver, typed nil consumers would be
+	// registered otherwise.
+	if tc != nil {
+		ocr.traceConsumer = tc
+	}
+	if mc != nil {
+		ocr.metricsConsumer = mc
+	}
+	require.NoError(t, ocr.start())
+	return ocr
+}
+
+// postJSON posts the body to the url, with its length if withLength is true
+// or chunked otherwise, and returns the response once its body was read.
+func postJSON(t *testing.T, client *http.Client, url string, body io.Reader, withLength bool) *http.Response {
+	if !withLength {
+		// Hide the length of the reader from http.NewRequest.
+		body = ioutil.NopCloser(body)
+	}
+	req, err := http.NewRequest("POST", url, body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	return resp
+}
+
+// getAvailableLoopbackAddress returns an available address on the loopback
+// interface, matching the test certificate.
+func getAvailableLoopbackAddress(t *testing.T) string {
+	_, port, err := net.SplitHostPort(getAvailableLocalAddress(t))
+	require.NoError(t, err)
+	return net.JoinHostPort("127.0.0.1", port)
+}
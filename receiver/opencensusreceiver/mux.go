@@ -0,0 +1,151 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// grpcHandler serves the gRPC requests with grpcServer and the other ones,
+// e.g. the HTTP/JSON requests of the grpc-gateway, with next. The gRPC and
+// HTTP/JSON requests can share an HTTP/2 connection, they can't be told apart
+// before their headers are read.
+func grpcHandler(grpcServer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			grpcServer.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var errPipeListenerClosed = errors.New("pipe listener closed")
+
+// pipeListener is an in-process listener, the connections it accepts are
+// created by DialContext with net.Pipe.
+type pipeListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errPipeListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// DialContext returns the client end of a connection, once its server end is
+// accepted by the listener.
+func (l *pipeListener) DialContext(ctx context.Context, _ string) (net.Conn, error) {
+	server, client := net.Pipe()
+	var err error
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		err = errPipeListenerClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	_ = server.Close()
+	_ = client.Close()
+	return nil, err
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// connTrackingListener is a listener closing the connections it accepted
+// when it is closed. The HTTP server doesn't close the h2c connections, they
+// are hijacked from it, and the gRPC streams they carry would otherwise
+// outlive the receiver.
+type connTrackingListener struct {
+	net.Listener
+
+	mu     sync.Mutex
+	conns  map[*trackedConn]struct{}
+	closed bool
+}
+
+func newConnTrackingListener(ln net.Listener) *connTrackingListener {
+	return &connTrackingListener{Listener: ln, conns: map[*trackedConn]struct{}{}}
+}
+
+func (l *connTrackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		_ = c.Close()
+		return nil, errAlreadyStopped
+	}
+	tc := &trackedConn{Conn: c, l: l}
+	l.conns[tc] = struct{}{}
+	return tc, nil
+}
+
+func (l *connTrackingListener) Close() error {
+	err := l.Listener.Close()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for c := range l.conns {
+		_ = c.Conn.Close()
+	}
+	l.conns = nil
+	return err
+}
+
+type trackedConn struct {
+	net.Conn
+	l *connTrackingListener
+}
+
+func (c *trackedConn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeListener(t *testing.T) {
+	ln := newPipeListener()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		assert.NoError(t, err)
+		accepted <- c
+	}()
+	client, err := ln.DialContext(context.Background(), "pipe")
+	require.NoError(t, err)
+	server := <-accepted
+
+	go func() {
+		_, err := client.Write([]byte("ping"))
+		assert.NoError(t, err)
+		assert.NoError(t, client.Close())
+	}()
+	b, err := ioutil.ReadAll(server)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(b))
+	assert.NoError(t, server.Close())
+
+	// Dialing waits for the connection to be accepted.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = ln.DialContext(ctx, "pipe")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.NoError(t, ln.Close())
+	assert.NoError(t, ln.Close())
+	_, err = ln.Accept()
+	assert.Equal(t, errPipeListenerClosed, err)
+	_, err = ln.DialContext(context.Background(), "pipe")
+	assert.Equal(t, errPipeListenerClosed, err)
+}
+
+func TestGRPCHandler(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		})
+	}
+	h := grpcHandler(named("grpc"), named("next"))
+
+	tests := []struct {
+		name        string
+		protoMajor  int
+		contentType string
+		want        string
+	}{
+		{name: "grpc", protoMajor: 2, contentType: "application/grpc", want: "grpc"},
+		{name: "grpc_proto", protoMajor: 2, contentType: "application/grpc+proto", want: "grpc"},
+		{name: "json", protoMajor: 2, contentType: "application/json", want: "next"},
+		{name: "http1_grpc", protoMajor: 1, contentType: "application/grpc", want: "next"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+			r.ProtoMajor = tt.protoMajor
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
+
+func TestConnTrackingListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	ln := newConnTrackingListener(inner)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		assert.NoError(t, err)
+		accepted <- c
+	}()
+	client, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	<-accepted
+
+	// The accepted connections are closed with the listener.
+	require.NoError(t, ln.Close())
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
@@ -40,6 +40,8 @@ const (
 type Receiver struct {
 	backPressureOn   bool
 	maxServerStreams int64
+	rateLimit        *RateLimit
+	rateLimiter      *rateLimiter
 
 	nextConsumer       consumer.TraceConsumer
 	serverStreamsCount int64
@@ -59,6 +61,13 @@ func New(nextConsumer consumer.TraceConsumer, opts ...Option) (*Receiver, error)
 		opt(ocr)
 	}
 
+	if ocr.rateLimit != nil {
+		var err error
+		if ocr.rateLimiter, err = newRateLimiter(*ocr.rateLimit); err != nil {
+			return nil, err
+		}
+	}
+
 	return ocr, nil
 }
 
@@ -83,6 +92,9 @@ func (ocr *Receiver) ExportOne(ctx context.Context, req *agenttracepb.ExportTrac
 
 	// We need to ensure that it propagates the receiver name as a tag
 	ctxWithReceiverName := observability.ContextWithReceiverName(ctx, receiverUnaryTagValue)
+	if err := ocr.checkRateLimit(ctxWithReceiverName, req.Node, req); err != nil {
+		return nil, err
+	}
 	_, _, err := ocr.processReceivedMsg(ctxWithReceiverName, nil, nil, req)
 	if !ocr.backPressureOn {
 		// Metrics and z-pages record data loss but there is no back pressure.
@@ -124,14 +136,33 @@ func (ocr *Receiver) Export(tes agenttracepb.TraceService_ExportServer) error {
 	var resource *resourcepb.Resource
 	// Now that we've got the first message with a Node, we can start to receive streamed up spans.
 	for {
-		lastNonNilNode, resource, err = ocr.processReceivedMsg(ctxWithReceiverName, lastNonNilNode, resource, recv)
-		if err != nil {
-			if ocr.backPressureOn {
+		node := recv.Node
+		if node == nil {
+			node = lastNonNilNode
+		}
+		// A rate limited first message ends the stream with the error, e.g.
+		// for the grpc-gateway calls. The following ones are dropped but the
+		// stream is kept open: a stream can't reject a single message, and
+		// ending it would lose the messages the client already sent. The
+		// next messages still use the node and resource of the dropped ones.
+		if err := ocr.checkRateLimit(ctxWithReceiverName, node, recv); err != nil {
+			if lastNonNilNode == nil {
 				return err
 			}
-			// Metrics and z-pages record data loss but there is no back pressure.
-			// However, cause the stream to be closed.
-			return nil
+			lastNonNilNode = node
+			if recv.Resource != nil {
+				resource = recv.Resource
+			}
+		} else {
+			lastNonNilNode, resource, err = ocr.processReceivedMsg(ctxWithReceiverName, lastNonNilNode, resource, recv)
+			if err != nil {
+				if ocr.backPressureOn {
+					return err
+				}
+				// Metrics and z-pages record data loss but there is no back pressure.
+				// However, cause the stream to be closed.
+				return nil
+			}
 		}
 
 		recv, err = tes.Recv()
@@ -146,6 +177,20 @@ func (ocr *Receiver) Export(tes agenttracepb.TraceService_ExportServer) error {
 	}
 }
 
+// checkRateLimit takes the spans and bytes of the request from the rate limits
+// of its client. The spans of a rejected request are recorded as dropped.
+func (ocr *Receiver) checkRateLimit(ctx context.Context, node *commonpb.Node, req *agenttracepb.ExportTraceServiceRequest) error {
+	if ocr.rateLimiter == nil {
+		return nil
+	}
+	key := ocr.rateLimiter.clientKey(ctx, node)
+	if err := ocr.rateLimiter.allow(key, len(req.Spans), req.Size()); err != nil {
+		observability.RecordTraceReceiverMetrics(ctx, 0, len(req.Spans))
+		return err
+	}
+	return nil
+}
+
 func (ocr *Receiver) processReceivedMsg(
 	ctx context.Context,
 	lastNonNilNode *commonpb.Node,
@@ -165,7 +210,7 @@ func (ocr *Receiver) processReceivedMsg(
 
 	td := &consumerdata.TraceData{
 		Node:         lastNonNilNode,
-		Resource:     resource,
+		Resource:     withContextResourceLabels(ctx, resource),
 		Spans:        recv.Spans,
 		SourceFormat: "oc_trace",
 	}
@@ -174,6 +219,44 @@ func (ocr *Receiver) processReceivedMsg(
 	return lastNonNilNode, resource, err
 }
 
+type resourceLabelsKey struct{}
+
+// ContextWithResourceLabels returns a context whose received trace data have
+// the labels set on their resource. They override the labels of the same
+// keys sent by the clients, the labels with an empty value are removed.
+func ContextWithResourceLabels(ctx context.Context, labels map[string]string) context.Context {
+	return context.WithValue(ctx, resourceLabelsKey{}, labels)
+}
+
+// withContextResourceLabels returns a copy of the resource with the labels of
+// the context set, or the resource itself if the context has none.
+func withContextResourceLabels(ctx context.Context, resource *resourcepb.Resource) *resourcepb.Resource {
+	labels, _ := ctx.Value(resourceLabelsKey{}).(map[string]string)
+	if len(labels) == 0 {
+		return resource
+	}
+
+	// The resource is shared by the following messages of the stream, it
+	// isn't modified.
+	withLabels := &resourcepb.Resource{
+		Labels: make(map[string]string, len(resource.GetLabels())+len(labels)),
+	}
+	if resource != nil {
+		withLabels.Type = resource.Type
+	}
+	for k, v := range resource.GetLabels() {
+		withLabels.Labels[k] = v
+	}
+	for k, v := range labels {
+		if v == "" {
+			delete(withLabels.Labels, k)
+			continue
+		}
+		withLabels.Labels[k] = v
+	}
+	return withLabels
+}
+
 func (ocr *Receiver) sendToNextConsumer(longLivedCtx context.Context, tracedata *consumerdata.TraceData) error {
 	if tracedata == nil {
 		return nil
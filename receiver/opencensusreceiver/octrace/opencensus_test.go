@@ -32,10 +32,12 @@ import (
 	"contrib.go.opencensus.io/exporter/ocagent"
 	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
 	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	resourcepb "github.com/census-instrumentation/opencensus-proto/gen-go/resource/v1"
 	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
 	"github.com/golang/protobuf/proto"
 	"github.com/open-telemetry/opentelemetry-service/consumer"
 	"github.com/open-telemetry/opentelemetry-service/consumer/consumerdata"
+	"github.com/open-telemetry/opentelemetry-service/exporter/exportertest"
 	"github.com/open-telemetry/opentelemetry-service/observability"
 	"go.opencensus.io/trace"
 	"go.opencensus.io/trace/tracestate"
@@ -430,6 +432,82 @@ func TestExportProtocolConformation_spansInFirstMessage(t *testing.T) {
 	}
 }
 
+func TestContextWithResourceLabels(t *testing.T) {
+	sink := new(exportertest.SinkTraceExporter)
+	ocr, err := New(sink)
+	if err != nil {
+		t.Fatalf("Failed to create the receiver: %v", err)
+	}
+
+	clientResource := &resourcepb.Resource{
+		Type:   "host",
+		Labels: map[string]string{"tenant": "spoofed", "zone": "a"},
+	}
+	ctx := ContextWithResourceLabels(context.Background(), map[string]string{"tenant": "acme"})
+	// The labels with an empty value are removed.
+	noTenantCtx := ContextWithResourceLabels(context.Background(), map[string]string{"tenant": ""})
+	requests := []struct {
+		ctx context.Context
+		req *agenttracepb.ExportTraceServiceRequest
+	}{
+		{
+			ctx: ctx,
+			req: &agenttracepb.ExportTraceServiceRequest{
+				Node:     &commonpb.Node{},
+				Resource: clientResource,
+				Spans:    []*tracepb.Span{{}},
+			},
+		},
+		{
+			ctx: ctx,
+			req: &agenttracepb.ExportTraceServiceRequest{
+				Node:  &commonpb.Node{},
+				Spans: []*tracepb.Span{{}},
+			},
+		},
+		{
+			ctx: noTenantCtx,
+			req: &agenttracepb.ExportTraceServiceRequest{
+				Node:     &commonpb.Node{},
+				Resource: clientResource,
+				Spans:    []*tracepb.Span{{}},
+			},
+		},
+	}
+	for _, r := range requests {
+		if _, err := ocr.ExportOne(r.ctx, r.req); err != nil {
+			t.Fatalf("Failed to export: %v", err)
+		}
+	}
+
+	want := []*resourcepb.Resource{
+		{
+			Type:   "host",
+			Labels: map[string]string{"tenant": "acme", "zone": "a"},
+		},
+		{
+			Labels: map[string]string{"tenant": "acme"},
+		},
+		{
+			Type:   "host",
+			Labels: map[string]string{"zone": "a"},
+		},
+	}
+	got := sink.AllTraces()
+	if len(got) != len(want) {
+		t.Fatalf("Got %d trace data, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !proto.Equal(got[i].Resource, want[i]) {
+			t.Errorf("Trace data %d: got resource %v, want %v", i, got[i].Resource, want[i])
+		}
+	}
+	// The resource sent by the client isn't modified.
+	if g, w := clientResource.Labels["tenant"], "spoofed"; g != w {
+		t.Errorf("Client resource modified: got tenant %q, want %q", g, w)
+	}
+}
+
 // Helper functions from here on below
 func makeTraceServiceClient(port int) (agenttracepb.TraceService_ExportClient, func(), error) {
 	addr := fmt.Sprintf(":%d", port)
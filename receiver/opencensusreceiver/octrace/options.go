@@ -33,3 +33,11 @@ func WithMaxServerStream(maxServerStreams int64) Option {
 		r.maxServerStreams = maxServerStreams
 	}
 }
+
+// WithRateLimit rate limits the spans and bytes received from each client,
+// the requests over the limits fail with RESOURCE_EXHAUSTED.
+func WithRateLimit(limit RateLimit) Option {
+	return func(r *Receiver) {
+		r.rateLimit = &limit
+	}
+}
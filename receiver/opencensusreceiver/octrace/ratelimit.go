@@ -0,0 +1,257 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package octrace
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RateLimitKey identifies the clients the rate limits apply to.
+type RateLimitKey string
+
+const (
+	// RateLimitByPeer applies the limits per client IP address.
+	RateLimitByPeer RateLimitKey = "peer"
+	// RateLimitByHostName applies the limits per Node.Identifier.HostName.
+	RateLimitByHostName RateLimitKey = "host-name"
+	// RateLimitByServiceName applies the limits per Node.ServiceInfo.Name.
+	RateLimitByServiceName RateLimitKey = "service-name"
+)
+
+// rateLimitCleanupInterval is the minimum interval between the removals of
+// the idle clients.
+const rateLimitCleanupInterval = time.Minute
+
+// RateLimit is the token bucket rate limiting of the spans received from each
+// client. The clients without a value for the key, e.g. without host name,
+// are limited per IP address instead.
+type RateLimit struct {
+	Key RateLimitKey
+
+	// SpansPerSecond is the rate of spans accepted, 0 disables the limit.
+	SpansPerSecond float64
+	// SpansBurst is the number of spans accepted at once, it defaults to
+	// SpansPerSecond.
+	SpansBurst int
+
+	// BytesPerSecond is the rate of bytes of serialized requests accepted,
+	// 0 disables the limit.
+	BytesPerSecond float64
+	// BytesBurst is the number of bytes accepted at once, it defaults to
+	// BytesPerSecond.
+	BytesBurst int
+}
+
+// rateLimiter keeps the token buckets of the clients.
+type rateLimiter struct {
+	limit RateLimit
+	// idleTimeout is the duration after which the buckets of a client are
+	// full again and can be forgotten.
+	idleTimeout time.Duration
+	now         func() time.Time
+
+	mu          sync.Mutex
+	clients     map[string]*clientBuckets
+	lastCleanup time.Time
+}
+
+type clientBuckets struct {
+	spans    tokenBucket
+	bytes    tokenBucket
+	lastSeen time.Time
+}
+
+// Validate returns the error WithRateLimit would fail with for the limit, so
+// that configurations can be checked before creating the receiver.
+func (limit RateLimit) Validate() error {
+	switch limit.Key {
+	case RateLimitByPeer, RateLimitByHostName, RateLimitByServiceName:
+	default:
+		return fmt.Errorf("unknown rate limit key %q, it must be %q, %q or %q",
+			limit.Key, RateLimitByPeer, RateLimitByHostName, RateLimitByServiceName)
+	}
+	if limit.SpansPerSecond < 0 || limit.BytesPerSecond < 0 || limit.SpansBurst < 0 || limit.BytesBurst < 0 {
+		return fmt.Errorf("rate limits can't be negative")
+	}
+	return nil
+}
+
+func newRateLimiter(limit RateLimit) (*rateLimiter, error) {
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+	if limit.SpansBurst == 0 {
+		limit.SpansBurst = int(math.Ceil(limit.SpansPerSecond))
+	}
+	if limit.BytesBurst == 0 {
+		limit.BytesBurst = int(math.Ceil(limit.BytesPerSecond))
+	}
+
+	rl := &rateLimiter{
+		limit:   limit,
+		now:     time.Now,
+		clients: map[string]*clientBuckets{},
+	}
+	if limit.SpansPerSecond > 0 {
+		rl.idleTimeout = time.Duration(float64(limit.SpansBurst) / limit.SpansPerSecond * float64(time.Second))
+	}
+	if limit.BytesPerSecond > 0 {
+		idle := time.Duration(float64(limit.BytesBurst) / limit.BytesPerSecond * float64(time.Second))
+		if idle > rl.idleTimeout {
+			rl.idleTimeout = idle
+		}
+	}
+	rl.lastCleanup = rl.now()
+	return rl, nil
+}
+
+// clientKey returns the key of the client sending the request.
+func (rl *rateLimiter) clientKey(ctx context.Context, node *commonpb.Node) string {
+	var key string
+	switch rl.limit.Key {
+	case RateLimitByHostName:
+		key = node.GetIdentifier().GetHostName()
+	case RateLimitByServiceName:
+		key = node.GetServiceInfo().GetName()
+	}
+	if key == "" {
+		key = peerAddr(ctx)
+	}
+	return key
+}
+
+// allow takes the spans and bytes from the buckets of the client, if they are
+// all available. It returns a RESOURCE_EXHAUSTED status with the delay after
+// which they will be otherwise.
+func (rl *rateLimiter) allow(key string, spans, bytes int) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if now.Sub(rl.lastCleanup) >= rateLimitCleanupInterval {
+		rl.lastCleanup = now
+		for k, c := range rl.clients {
+			if now.Sub(c.lastSeen) >= rl.idleTimeout {
+				delete(rl.clients, k)
+			}
+		}
+	}
+
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &clientBuckets{
+			spans: newTokenBucket(rl.limit.SpansPerSecond, rl.limit.SpansBurst, now),
+			bytes: newTokenBucket(rl.limit.BytesPerSecond, rl.limit.BytesBurst, now),
+		}
+		rl.clients[key] = c
+	}
+	c.lastSeen = now
+
+	wait := c.spans.wait(now, float64(spans))
+	if bytesWait := c.bytes.wait(now, float64(bytes)); bytesWait > wait {
+		wait = bytesWait
+	}
+	if wait > 0 {
+		return errRateLimited(key, wait)
+	}
+	c.spans.take(float64(spans))
+	c.bytes.take(float64(bytes))
+	return nil
+}
+
+func errRateLimited(key string, wait time.Duration) error {
+	// Round up so that retrying after the hint succeeds.
+	wait = (wait + time.Millisecond - 1).Truncate(time.Millisecond)
+	st := status.Newf(codes.ResourceExhausted, "rate limit exceeded for %q, retry after %v", key, wait)
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(wait)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// peerAddr returns the IP address of the client, the one set with
+// ContextWithPeerAddr or else the one of the connection.
+func peerAddr(ctx context.Context) string {
+	if addr, ok := ctx.Value(peerAddrKey{}).(string); ok {
+		return addr
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	// The port changes with each connection of the client.
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+type peerAddrKey struct{}
+
+// ContextWithPeerAddr returns a context whose requests are rate limited as
+// coming from addr when the limits apply per peer. It is used when the
+// requests are proxied, e.g. by the grpc-gateway.
+func ContextWithPeerAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, peerAddrKey{}, addr)
+}
+
+// tokenBucket is a token bucket, a zero rate disables it.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) tokenBucket {
+	return tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// wait refills the bucket and returns how long to wait for n tokens. Taking
+// more tokens than the burst only requires a full bucket, the bucket is left
+// in debt.
+func (b *tokenBucket) wait(now time.Time, n float64) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	missing := math.Min(n, b.burst) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b.rate != 0 {
+		b.tokens -= n
+	}
+}
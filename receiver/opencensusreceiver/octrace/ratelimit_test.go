@@ -0,0 +1,229 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package octrace
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/open-telemetry/opentelemetry-service/exporter/exportertest"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiter_allow(t *testing.T) {
+	rl, err := newRateLimiter(RateLimit{
+		Key:            RateLimitByPeer,
+		SpansPerSecond: 10,
+		BytesPerSecond: 1000,
+		BytesBurst:     500,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create the rate limiter: %v", err)
+	}
+	now := time.Unix(0, 0)
+	rl.now = func() time.Time { return now }
+	rl.lastCleanup = now
+
+	steps := []struct {
+		name     string
+		advance  time.Duration
+		key      string
+		spans    int
+		bytes    int
+		wantWait time.Duration
+	}{
+		{name: "within_burst", key: "a", spans: 6, bytes: 100},
+		{name: "spans_exhausted", key: "a", spans: 6, bytes: 100, wantWait: 200 * time.Millisecond},
+		{name: "other_client", key: "b", spans: 10, bytes: 100},
+		{name: "spans_refilled", advance: 200 * time.Millisecond, key: "a", spans: 6, bytes: 100},
+		{name: "bytes_exhausted", key: "a", bytes: 490, wantWait: 90 * time.Millisecond},
+		// The requests larger than the burst only wait for a full bucket,
+		// the following ones wait for the debt to be paid back.
+		{name: "larger_than_burst", advance: time.Second, key: "a", spans: 25, bytes: 100},
+		{name: "debt", key: "a", spans: 1, bytes: 1, wantWait: 1600 * time.Millisecond},
+		{name: "debt_paid_back", advance: 1600 * time.Millisecond, key: "a", spans: 1, bytes: 1},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		err := rl.allow(step.key, step.spans, step.bytes)
+		if step.wantWait == 0 {
+			if err != nil {
+				t.Fatalf("%s: got error %v, want none", step.name, err)
+			}
+			continue
+		}
+		if got := retryDelay(t, err); got != step.wantWait {
+			t.Fatalf("%s: got retry delay %v, want %v", step.name, got, step.wantWait)
+		}
+	}
+
+	// The idle clients are forgotten.
+	now = now.Add(rateLimitCleanupInterval)
+	if err := rl.allow("c", 1, 1); err != nil {
+		t.Fatalf("Got error %v, want none", err)
+	}
+	if _, ok := rl.clients["a"]; ok {
+		t.Errorf("Idle client still has rate limits")
+	}
+}
+
+func TestNewRateLimiter_errors(t *testing.T) {
+	limits := []RateLimit{
+		{Key: "tenant", SpansPerSecond: 1},
+		{Key: RateLimitByPeer, SpansPerSecond: -1},
+		{Key: RateLimitByPeer, BytesPerSecond: 1, BytesBurst: -1},
+	}
+	for _, limit := range limits {
+		if _, err := New(exportertest.NewNopTraceExporter(), WithRateLimit(limit)); err == nil {
+			t.Errorf("New with rate limit %+v: got no error", limit)
+		}
+	}
+}
+
+func TestExportOne_rateLimit(t *testing.T) {
+	sink := new(exportertest.SinkTraceExporter)
+	ocr, err := New(sink, WithRateLimit(RateLimit{Key: RateLimitByServiceName, SpansPerSecond: 2}))
+	if err != nil {
+		t.Fatalf("Failed to create the receiver: %v", err)
+	}
+
+	request := func(service string) *agenttracepb.ExportTraceServiceRequest {
+		return &agenttracepb.ExportTraceServiceRequest{
+			Node:  &commonpb.Node{ServiceInfo: &commonpb.ServiceInfo{Name: service}},
+			Spans: []*tracepb.Span{{}, {}},
+		}
+	}
+	if _, err := ocr.ExportOne(context.Background(), request("runaway")); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	// The error is returned even without back pressure.
+	_, err = ocr.ExportOne(context.Background(), request("runaway"))
+	if got := retryDelay(t, err); got <= 0 || got > time.Second {
+		t.Errorf("Got retry delay %v, want at most 1s", got)
+	}
+	if _, err := ocr.ExportOne(context.Background(), request("other")); err != nil {
+		t.Fatalf("Failed to export for another service: %v", err)
+	}
+
+	if got := len(sink.AllTraces()); got != 2 {
+		t.Errorf("Got %d trace data, want 2", got)
+	}
+}
+
+func TestExport_rateLimit(t *testing.T) {
+	sink := new(exportertest.SinkTraceExporter)
+	_, port, doneFn := ocReceiverOnGRPCServer(t, sink, WithRateLimit(RateLimit{Key: RateLimitByPeer, SpansPerSecond: 1}))
+	defer doneFn()
+
+	traceClient, traceClientDoneFn, err := makeTraceServiceClient(port)
+	if err != nil {
+		t.Fatalf("Failed to create the gRPC TraceService_ExportClient: %v", err)
+	}
+	defer traceClientDoneFn()
+
+	req := &agenttracepb.ExportTraceServiceRequest{
+		Node:  &commonpb.Node{},
+		Spans: []*tracepb.Span{{}},
+	}
+	for i := 0; i < 3; i++ {
+		if err := traceClient.Send(req); err != nil {
+			t.Fatalf("Failed to send request %d: %v", i, err)
+		}
+	}
+	// The rate limited messages after the first one are dropped without
+	// ending the stream.
+	if err := traceClient.CloseSend(); err != nil {
+		t.Fatalf("Failed to close the stream: %v", err)
+	}
+	if _, err := traceClient.Recv(); err != io.EOF {
+		t.Fatalf("Got error %v, want the stream to end without error", err)
+	}
+	if got := len(sink.AllTraces()); got != 1 {
+		t.Errorf("Got %d trace data, want 1", got)
+	}
+}
+
+func TestRateLimiter_clientKey(t *testing.T) {
+	ctx := ContextWithPeerAddr(context.Background(), "10.0.0.1")
+	node := &commonpb.Node{
+		Identifier:  &commonpb.ProcessIdentifier{HostName: "host"},
+		ServiceInfo: &commonpb.ServiceInfo{Name: "service"},
+	}
+	tests := []struct {
+		key  RateLimitKey
+		node *commonpb.Node
+		want string
+	}{
+		{key: RateLimitByPeer, node: node, want: "10.0.0.1"},
+		{key: RateLimitByHostName, node: node, want: "host"},
+		{key: RateLimitByServiceName, node: node, want: "service"},
+		{key: RateLimitByHostName, node: &commonpb.Node{}, want: "10.0.0.1"},
+		{key: RateLimitByServiceName, node: nil, want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		rl, err := newRateLimiter(RateLimit{Key: tt.key, SpansPerSecond: 1})
+		if err != nil {
+			t.Fatalf("Failed to create the rate limiter: %v", err)
+		}
+		if got := rl.clientKey(ctx, tt.node); got != tt.want {
+			t.Errorf("Got key %q for %q and node %v, want %q", got, tt.key, tt.node, tt.want)
+		}
+	}
+}
+
+func TestPeerAddr(t *testing.T) {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 41234},
+	})
+	if got, want := peerAddr(ctx), "10.0.0.1"; got != want {
+		t.Errorf("Got peer address %q, want %q", got, want)
+	}
+	ctx = ContextWithPeerAddr(ctx, "10.0.0.2")
+	if got, want := peerAddr(ctx), "10.0.0.2"; got != want {
+		t.Errorf("Got peer address %q, want %q", got, want)
+	}
+	if got := peerAddr(context.Background()); got != "" {
+		t.Errorf("Got peer address %q without peer, want none", got)
+	}
+}
+
+func retryDelay(t *testing.T, err error) time.Duration {
+	t.Helper()
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("Got error %v, want %v", err, codes.ResourceExhausted)
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			delay, err := ptypes.Duration(info.RetryDelay)
+			if err != nil {
+				t.Fatalf("Invalid retry delay: %v", err)
+			}
+			return delay
+		}
+	}
+	t.Fatalf("Got no retry info in %v", st.Details())
+	return 0
+}
@@ -16,8 +16,10 @@ package opencensusreceiver
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"sync"
@@ -31,7 +33,8 @@ import (
 	"github.com/open-telemetry/opentelemetry-service/receiver"
 	"github.com/open-telemetry/opentelemetry-service/receiver/opencensusreceiver/ocmetrics"
 	"github.com/rs/cors"
-	"github.com/soheilhy/cmux"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 
 	"github.com/Omnition/omnition-opentelemetry-service/receiver/opencensusreceiver/octrace"
@@ -46,6 +49,19 @@ type Receiver struct {
 	gatewayMux        *gatewayruntime.ServeMux
 	corsOrigins       []string
 	grpcServerOptions []grpc.ServerOption
+	tlsConfig         *tls.Config
+	http2Server       *http2.Server
+	maxRecvMsgSize    int
+
+	// gatewayLn is the in-process listener the grpc-gateway connects to the
+	// gRPC server through, so that the HTTP/JSON requests don't go back
+	// through the public listener and its TLS configuration.
+	gatewayLn   *pipeListener
+	gatewayConn *grpc.ClientConn
+
+	// fileReloaders watch their files from the start to the stop of the
+	// receiver.
+	fileReloaders []*fileReloader
 
 	traceReceiverOpts   []octrace.Option
 	metricsReceiverOpts []ocmetrics.Option
@@ -69,6 +85,12 @@ var (
 
 const source string = "OpenCensus"
 
+const (
+	// defaultMaxRecvMsgSize is the default gRPC limit on the size of the
+	// received messages, it is also applied to the HTTP/JSON bodies.
+	defaultMaxRecvMsgSize = 4 * 1024 * 1024
+)
+
 // New just creates the OpenCensus receiver services. It is the caller's
 // responsibility to invoke the respective Start*Reception methods as well
 // as the various Stop*Reception methods or simply Stop to end it.
@@ -80,9 +102,10 @@ func New(addr string, tc consumer.TraceConsumer, mc consumer.MetricsConsumer, op
 	}
 
 	ocr := &Receiver{
-		ln:          ln,
-		corsOrigins: []string{}, // Disable CORS by default.
-		gatewayMux:  gatewayruntime.NewServeMux(),
+		ln:             newConnTrackingListener(ln),
+		corsOrigins:    []string{}, // Disable CORS by default.
+		gatewayMux:     gatewayruntime.NewServeMux(gatewayruntime.WithIncomingHeaderMatcher(gatewayHeaderMatcher)),
+		maxRecvMsgSize: defaultMaxRecvMsgSize,
 	}
 
 	for _, opt := range opts {
@@ -113,7 +136,7 @@ func (ocr *Receiver) registerTraceConsumer() error {
 		ocr.traceReceiver, err = octrace.New(ocr.traceConsumer, ocr.traceReceiverOpts...)
 		if err == nil {
 			srv := ocr.grpcServer()
-			agenttracepb.RegisterTraceServiceServer(srv, ocr.traceReceiver)
+			agenttracepb.RegisterTraceServiceServer(srv, traceService{Receiver: ocr.traceReceiver})
 		}
 	})
 
@@ -198,6 +221,10 @@ func (ocr *Receiver) start() error {
 		return err
 	}
 
+	for _, r := range ocr.fileReloaders {
+		r.watch()
+	}
+
 	// At this point we've successfully started all the services/receivers.
 	// Add other start routines here.
 	return nil
@@ -214,14 +241,28 @@ func (ocr *Receiver) stop() error {
 
 		// No stop method on trace or metrics receivers.
 
-		if ocr.serverHTTP != nil {
-			_ = ocr.serverHTTP.Close()
+		for _, r := range ocr.fileReloaders {
+			r.stop()
 		}
 
+		// The listener closes the connections hijacked from the HTTP server
+		// by h2c, the HTTP server closes the other ones.
 		if ocr.ln != nil {
 			_ = ocr.ln.Close()
 		}
 
+		if ocr.gatewayConn != nil {
+			_ = ocr.gatewayConn.Close()
+		}
+
+		if ocr.gatewayLn != nil {
+			_ = ocr.gatewayLn.Close()
+		}
+
+		if ocr.serverHTTP != nil {
+			_ = ocr.serverHTTP.Close()
+		}
+
 		// TODO: @(odeke-em) investigate what utility invoking (*grpc.Server).Stop()
 		// gives us yet we invoke (net.Listener).Close().
 		// Sure (*grpc.Server).Stop() enables proper shutdown but imposes
@@ -232,58 +273,61 @@ func (ocr *Receiver) stop() error {
 	return err
 }
 
-func (ocr *Receiver) httpServer() *http.Server {
+func (ocr *Receiver) httpServer() (*http.Server, error) {
 	ocr.mu.Lock()
 	defer ocr.mu.Unlock()
 
 	if ocr.serverHTTP == nil {
 		var mux http.Handler = ocr.gatewayMux
+		mux = maxBodySizeHandler(mux, int64(ocr.maxRecvMsgSize))
 		if len(ocr.corsOrigins) > 0 {
 			co := cors.Options{AllowedOrigins: ocr.corsOrigins}
 			mux = cors.New(co).Handler(mux)
 		}
-		ocr.serverHTTP = &http.Server{Handler: mux}
+		// The gRPC and HTTP/JSON (grpc-gateway) requests are served on the
+		// same port by the HTTP server.
+		mux = grpcHandler(ocr.serverGRPC, mux)
+
+		h2s := ocr.http2Server
+		if h2s == nil {
+			h2s = &http2.Server{}
+		}
+		// The plaintext HTTP/2 connections are handled by h2c, the TLS ones
+		// negotiate h2 when TLS is terminated on the listener.
+		srv := &http.Server{Handler: h2c.NewHandler(mux, h2s)}
+		if err := http2.ConfigureServer(srv, h2s); err != nil {
+			return nil, err
+		}
+		ocr.serverHTTP = srv
 	}
 
-	return ocr.serverHTTP
+	return ocr.serverHTTP, nil
 }
 
 func (ocr *Receiver) startServer() error {
 	err := errAlreadyStarted
 	ocr.startServerOnce.Do(func() {
+		if err = ocr.registerGateway(); err != nil {
+			return
+		}
+		var srv *http.Server
+		if srv, err = ocr.httpServer(); err != nil {
+			return
+		}
+
+		// The HTTP server reports its error, without blocking once the start
+		// is over.
 		errChan := make(chan error, 1)
 		go func() {
-			// Register the grpc-gateway on the HTTP server mux
-			c := context.Background()
-			opts := []grpc.DialOption{grpc.WithInsecure()}
-			endpoint := ocr.ln.Addr().String()
-
-			err := agenttracepb.RegisterTraceServiceHandlerFromEndpoint(c, ocr.gatewayMux, endpoint, opts)
-			if err != nil {
-				errChan <- err
-				return
+			ln := ocr.ln
+			if ocr.tlsConfig != nil {
+				ln = tls.NewListener(ln, ocr.tlsConfig)
 			}
 
-			err = agentmetricspb.RegisterMetricsServiceHandlerFromEndpoint(c, ocr.gatewayMux, endpoint, opts)
-			if err != nil {
-				errChan <- err
-				return
-			}
-
-			// Start the gRPC and HTTP/JSON (grpc-gateway) servers on the same port.
-			m := cmux.New(ocr.ln)
-			grpcL := m.MatchWithWriters(
-				cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"),
-				cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc+proto"))
-
-			httpL := m.Match(cmux.Any())
 			go func() {
-				errChan <- ocr.serverGRPC.Serve(grpcL)
+				_ = ocr.serverGRPC.Serve(gatewayListener{Listener: ocr.gatewayLn})
 			}()
-			go func() {
-				errChan <- ocr.httpServer().Serve(httpL)
-			}()
-			errChan <- m.Serve()
+			errChan <- srv.Serve(ln)
 		}()
 
 		// Our goal is to heuristically try running the server
@@ -300,3 +344,92 @@ func (ocr *Receiver) startServer() error {
 	})
 	return err
 }
+
+// registerGateway registers the grpc-gateway on the HTTP server mux, it calls
+// the gRPC server through an in-process connection.
+func (ocr *Receiver) registerGateway() error {
+	ocr.mu.Lock()
+	defer ocr.mu.Unlock()
+
+	c := context.Background()
+	ocr.gatewayLn = newPipeListener()
+	conn, err := grpc.DialContext(c, "pipe",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(ocr.gatewayLn.DialContext))
+	if err != nil {
+		return err
+	}
+	ocr.gatewayConn = conn
+
+	if err := agenttracepb.RegisterTraceServiceHandler(c, ocr.gatewayMux, conn); err != nil {
+		return err
+	}
+	return agentmetricspb.RegisterMetricsServiceHandler(c, ocr.gatewayMux, conn)
+}
+
+// maxBodySizeHandler rejects the requests whose body is larger than limit
+// with a 413 status.
+func maxBodySizeHandler(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// The length isn't known for chunked bodies, the grpc-gateway fails
+		// to read them past the limit and its error status is replaced.
+		body := &maxBytesBody{ReadCloser: http.MaxBytesReader(w, r.Body, limit), limit: limit}
+		r.Body = body
+		next.ServeHTTP(&maxBytesResponseWriter{ResponseWriter: w, body: body}, r)
+	})
+}
+
+// maxBytesBody is a body read with http.MaxBytesReader, it records whether
+// the reads failed on the limit.
+type maxBytesBody struct {
+	io.ReadCloser
+	limit int64
+
+	mu       sync.Mutex
+	read     int64
+	tooLarge bool
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.read += int64(n)
+	// The reader returns the limit bytes before failing.
+	if err != nil && err != io.EOF && b.read == b.limit {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+func (b *maxBytesBody) isTooLarge() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tooLarge
+}
+
+// maxBytesResponseWriter replaces the error status with a 413 one once the
+// body failed on the limit.
+type maxBytesResponseWriter struct {
+	http.ResponseWriter
+	body *maxBytesBody
+}
+
+func (w *maxBytesResponseWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest && w.body.isTooLarge() {
+		code = http.StatusRequestEntityTooLarge
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush is required by the grpc-gateway for the responses of the streaming
+// calls.
+func (w *maxBytesResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -15,7 +15,10 @@
 package opencensusreceiver
 
 import (
+	"crypto/tls"
+
 	"github.com/open-telemetry/opentelemetry-service/receiver/opencensusreceiver/ocmetrics"
+	"golang.org/x/net/http2"
 	"google.golang.org/grpc"
 
 	"github.com/Omnition/omnition-opentelemetry-service/receiver/opencensusreceiver/octrace"
@@ -90,6 +93,69 @@ func WithGRPCServerOptions(gsOpts ...grpc.ServerOption) Option {
 	return gsvOpts
 }
 
+type tlsConfig struct {
+	config *tls.Config
+}
+
+var _ Option = (*tlsConfig)(nil)
+
+func (tc *tlsConfig) withReceiver(ocr *Receiver) {
+	ocr.tlsConfig = tc.config
+}
+
+// WithTLSConfig is an option to serve both the gRPC and the HTTP/JSON
+// requests over TLS with the given configuration.
+func WithTLSConfig(config *tls.Config) Option {
+	return &tlsConfig{config: config}
+}
+
+type http2Server struct {
+	server *http2.Server
+}
+
+var _ Option = (*http2Server)(nil)
+
+func (hs *http2Server) withReceiver(ocr *Receiver) {
+	ocr.http2Server = hs.server
+}
+
+// WithHTTP2Server is an option to specify the settings of the HTTP/2
+// connections of the clients. The gRPC requests are served over them with
+// the HTTP/JSON ones: the connection settings of the gRPC server, like
+// grpc.MaxConcurrentStreams or grpc.KeepaliveParams, don't apply to them.
+func WithHTTP2Server(server *http2.Server) Option {
+	return &http2Server{server: server}
+}
+
+type maxRecvMsgSize int
+
+var _ Option = (maxRecvMsgSize)(0)
+
+func (size maxRecvMsgSize) withReceiver(ocr *Receiver) {
+	ocr.maxRecvMsgSize = int(size)
+}
+
+// WithMaxRecvMsgSize is an option to specify the maximum size in bytes of the
+// HTTP/JSON request bodies, larger requests are rejected with a 413 status.
+// The limit of the gRPC messages is set with grpc.MaxRecvMsgSize.
+func WithMaxRecvMsgSize(size int) Option {
+	return maxRecvMsgSize(size)
+}
+
+type fileReloaders []*fileReloader
+
+var _ Option = (fileReloaders)(nil)
+
+func (frs fileReloaders) withReceiver(ocr *Receiver) {
+	ocr.fileReloaders = append(ocr.fileReloaders, frs...)
+}
+
+// withFileReloaders is an option to watch the files of the reloaders while
+// the receiver runs.
+func withFileReloaders(reloaders ...*fileReloader) Option {
+	return fileReloaders(reloaders)
+}
+
 type noopOption int
 
 var _ Option = (noopOption)(0)
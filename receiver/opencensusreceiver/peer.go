@@ -0,0 +1,108 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/Omnition/omnition-opentelemetry-service/receiver/opencensusreceiver/octrace"
+)
+
+// gatewayAddr is the remote address of the connections of the grpc-gateway
+// to the gRPC server. The clients connecting to the public listener can't
+// have it.
+type gatewayAddr struct{}
+
+func (gatewayAddr) Network() string { return "grpc-gateway" }
+func (gatewayAddr) String() string  { return "grpc-gateway" }
+
+// gatewayListener is the listener of the connections of the grpc-gateway,
+// their remote address is gatewayAddr.
+type gatewayListener struct {
+	net.Listener
+}
+
+func (l gatewayListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return gatewayConn{Conn: c}, nil
+}
+
+type gatewayConn struct {
+	net.Conn
+}
+
+func (gatewayConn) RemoteAddr() net.Addr {
+	return gatewayAddr{}
+}
+
+// traceService is the trace service of the gRPC server. The calls of the
+// grpc-gateway are rate limited by the address of the HTTP clients instead of
+// the one of the grpc-gateway.
+type traceService struct {
+	*octrace.Receiver
+}
+
+var _ agenttracepb.TraceServiceServer = traceService{}
+
+func (s traceService) ExportOne(ctx context.Context, req *agenttracepb.ExportTraceServiceRequest) (*agenttracepb.ExportTraceServiceResponse, error) {
+	return s.Receiver.ExportOne(withGatewayPeerAddr(ctx), req)
+}
+
+func (s traceService) Export(tes agenttracepb.TraceService_ExportServer) error {
+	return s.Receiver.Export(&traceExportStream{
+		TraceService_ExportServer: tes,
+		ctx:                       withGatewayPeerAddr(tes.Context()),
+	})
+}
+
+type traceExportStream struct {
+	agenttracepb.TraceService_ExportServer
+	ctx context.Context
+}
+
+func (s *traceExportStream) Context() context.Context {
+	return s.ctx
+}
+
+// withGatewayPeerAddr returns the context of the calls of the grpc-gateway
+// with the address of the HTTP client as peer address. The grpc-gateway
+// appends it to the x-forwarded-for header of the request, the addresses
+// before it are set by the client and can't be trusted.
+func withGatewayPeerAddr(ctx context.Context) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	if _, ok := p.Addr.(gatewayAddr); !ok {
+		return ctx
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	forwardedFor := md.Get("x-forwarded-for")
+	if len(forwardedFor) == 0 {
+		return ctx
+	}
+	addrs := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+	return octrace.ContextWithPeerAddr(ctx, strings.TrimSpace(addrs[len(addrs)-1]))
+}
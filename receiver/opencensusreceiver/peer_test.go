@@ -0,0 +1,172 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	commonpb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/common/v1"
+	agenttracepb "github.com/census-instrumentation/opencensus-proto/gen-go/agent/trace/v1"
+	tracepb "github.com/census-instrumentation/opencensus-proto/gen-go/trace/v1"
+	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
+	"github.com/open-telemetry/opentelemetry-service/exporter/exportertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/Omnition/omnition-opentelemetry-service/receiver/opencensusreceiver/octrace"
+)
+
+func TestRateLimit_endToEnd(t *testing.T) {
+	cfg := &Config{
+		ReceiverSettings: configmodels.ReceiverSettings{
+			TypeVal:  typeStr,
+			NameVal:  typeStr,
+			Endpoint: getAvailableLoopbackAddress(t),
+		},
+		// A single span is accepted every 10s.
+		RateLimit: &rateLimitConfig{
+			SpansPerSecond: 0.1,
+			SpansBurst:     1,
+		},
+	}
+	traceSink := new(exportertest.SinkTraceExporter)
+	ocr := startTestReceiver(t, cfg, traceSink, nil)
+	defer ocr.stop()
+
+	post := func(forwardedFor string) (int, string) {
+		req, err := http.NewRequest("POST", "http://"+cfg.Endpoint+"/v1/trace", strings.NewReader(testTraceJSON))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	code, _ := post("")
+	assert.Equal(t, http.StatusOK, code)
+	code, body := post("")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Contains(t, body, "RetryInfo")
+	// The addresses set by the client don't change its peer address.
+	code, _ = post("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+
+	// The gRPC calls from the same address share the limits.
+	cc, err := grpc.Dial(cfg.Endpoint, grpc.WithInsecure())
+	require.NoError(t, err)
+	defer cc.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = agenttracepb.NewTraceServiceClient(cc).ExportOne(ctx, &agenttracepb.ExportTraceServiceRequest{
+		Node:  &commonpb.Node{},
+		Spans: []*tracepb.Span{{}},
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	assert.Len(t, traceSink.AllTraces(), 1)
+}
+
+func TestWithGatewayPeerAddr(t *testing.T) {
+	md := metadata.Pairs("x-forwarded-for", "10.0.0.1, 192.168.0.1")
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{
+			name: "gateway",
+			addr: gatewayAddr{},
+			want: "192.168.0.1",
+		},
+		{
+			name: "grpc_client",
+			addr: &net.TCPAddr{IP: net.ParseIP("172.16.0.1"), Port: 41234},
+			want: "172.16.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), md)
+			ctx = peer.NewContext(ctx, &peer.Peer{Addr: tt.addr})
+
+			sink := new(exportertest.SinkTraceExporter)
+			tr, err := octrace.New(sink, octrace.WithRateLimit(octrace.RateLimit{
+				Key:            octrace.RateLimitByPeer,
+				SpansPerSecond: 0.1,
+				SpansBurst:     1,
+			}))
+			require.NoError(t, err)
+			svc := traceService{Receiver: tr}
+			req := &agenttracepb.ExportTraceServiceRequest{
+				Node:  &commonpb.Node{},
+				Spans: []*tracepb.Span{{}},
+			}
+			_, err = svc.ExportOne(ctx, req)
+			require.NoError(t, err)
+			_, err = svc.ExportOne(ctx, req)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), `"`+tt.want+`"`)
+		})
+	}
+}
+
+func TestBuildOptions_rateLimitErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     rateLimitConfig
+		wantErr string
+	}{
+		{
+			name:    "unknown_key",
+			cfg:     rateLimitConfig{Key: "tenant", SpansPerSecond: 1},
+			wantErr: `unknown rate limit key "tenant", it must be "peer", "host-name" or "service-name"`,
+		},
+		{
+			name:    "negative",
+			cfg:     rateLimitConfig{SpansPerSecond: 1, SpansBurst: -1},
+			wantErr: "rate limits can't be negative",
+		},
+		{
+			name:    "no_limit",
+			cfg:     rateLimitConfig{Key: "peer"},
+			wantErr: "spans-per-second or bytes-per-second must be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{RateLimit: &tt.cfg}
+			_, err := cfg.buildOptions()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadCheckInterval is the default interval between the checks of the
+// reloaded files for changes.
+const reloadCheckInterval = 10 * time.Second
+
+// fileReloader calls a load function again when the modification time of one
+// of its files changes. The files are checked either when check is called, at
+// most once per checkInterval, or every checkInterval in the background
+// between the calls of watch and stop, keeping the checks out of the request
+// path.
+type fileReloader struct {
+	files         []string
+	load          func() error
+	checkInterval time.Duration
+
+	mu        sync.Mutex
+	lastCheck time.Time
+	modTimes  []time.Time
+	done      chan struct{}
+}
+
+// newFileReloader returns the reloader of the files, load is called once
+// before returning.
+func newFileReloader(files []string, load func() error) (*fileReloader, error) {
+	r := &fileReloader{
+		files:         files,
+		load:          load,
+		checkInterval: reloadCheckInterval,
+	}
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := load(); err != nil {
+		return nil, err
+	}
+	r.modTimes = modTimes
+	r.lastCheck = time.Now()
+	return r, nil
+}
+
+// check calls reload if checkInterval passed since the last check.
+func (r *fileReloader) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) < r.checkInterval {
+		return
+	}
+	r.reloadLocked()
+}
+
+// watch starts checking the files every checkInterval, until stop is called.
+// It does nothing if the files are already watched.
+func (r *fileReloader) watch() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done != nil {
+		return
+	}
+	done := make(chan struct{})
+	r.done = done
+	ticker := time.NewTicker(r.checkInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// stop stops watching the files.
+func (r *fileReloader) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.done != nil {
+		close(r.done)
+		r.done = nil
+	}
+}
+
+// reload calls load if the files changed since the last successful load.
+// The files being rotated may be missing or inconsistent for a while, they
+// are checked again on the next interval in that case.
+func (r *fileReloader) reload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reloadLocked()
+}
+
+func (r *fileReloader) reloadLocked() {
+	r.lastCheck = time.Now()
+
+	modTimes, err := r.fileModTimes()
+	if err != nil || equalTimes(modTimes, r.modTimes) {
+		return
+	}
+	if err := r.load(); err == nil {
+		r.modTimes = modTimes
+	}
+}
+
+func (r *fileReloader) fileModTimes() ([]time.Time, error) {
+	modTimes := make([]time.Time, len(r.files))
+	for i, file := range r.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
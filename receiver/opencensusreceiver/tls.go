@@ -0,0 +1,171 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+const (
+	clientAuthRequired = "required"
+	clientAuthOptional = "optional"
+)
+
+var (
+	errClientAuthWithoutCA = errors.New("client-auth requires client-ca-file")
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// cipherSuites are the configurable cipher suites, the TLS 1.3 ones
+	// can't be configured.
+	cipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":          tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":        tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+)
+
+// tlsReloader provides the TLS configuration of the server, reloading the
+// certificate and the client CAs when their files change.
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	// base holds the settings that don't come from the files.
+	base *tls.Config
+
+	reloader *fileReloader
+	// config holds the current *tls.Config.
+	config atomic.Value
+}
+
+// newTLSReloader returns the reloader for the credentials, the files are
+// loaded once before returning.
+func newTLSReloader(tlsCreds *tlsCredentials) (*tlsReloader, error) {
+	base := &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+
+	switch tlsCreds.ClientAuth {
+	case "", clientAuthRequired:
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	case clientAuthOptional:
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client-auth %q, it must be %q or %q", tlsCreds.ClientAuth, clientAuthRequired, clientAuthOptional)
+	}
+	if tlsCreds.ClientCAFile == "" {
+		if tlsCreds.ClientAuth != "" {
+			return nil, errClientAuthWithoutCA
+		}
+		base.ClientAuth = tls.NoClientCert
+	}
+
+	if tlsCreds.MinVersion != "" {
+		version, ok := tlsVersions[tlsCreds.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min-version %q", tlsCreds.MinVersion)
+		}
+		base.MinVersion = version
+	}
+
+	for _, name := range tlsCreds.CipherSuites {
+		suite, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		base.CipherSuites = append(base.CipherSuites, suite)
+	}
+
+	r := &tlsReloader{
+		certFile:     tlsCreds.CertFile,
+		keyFile:      tlsCreds.KeyFile,
+		clientCAFile: tlsCreds.ClientCAFile,
+		base:         base,
+	}
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	var err error
+	if r.reloader, err = newFileReloader(files, r.load); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// tlsConfig returns the configuration to serve TLS with.
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		NextProtos:         r.base.NextProtos,
+		GetConfigForClient: r.getConfigForClient,
+	}
+}
+
+// getConfigForClient returns the current configuration, after reloading it
+// if the files changed since the last check.
+func (r *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.reloader.check()
+	return r.config.Load().(*tls.Config), nil
+}
+
+// load loads the files and, on success, replaces the configuration.
+func (r *tlsReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in client-ca-file %q", r.clientCAFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	r.config.Store(config)
+	return nil
+}
@@ -0,0 +1,364 @@
+// Copyright 2019 OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package opencensusreceiver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-telemetry/opentelemetry-service/config/configmodels"
+	"github.com/open-telemetry/opentelemetry-service/exporter/exportertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutualTLS_endToEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opencensusreceiver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, pool := writeTestCertificate(t, dir)
+	clientCA := newTestCert(t, "client CA", nil, x509.ExtKeyUsageClientAuth)
+	clientCAFile, _ := clientCA.write(t, dir, "client-ca")
+	clientCert := newTestCert(t, "client", clientCA, x509.ExtKeyUsageClientAuth)
+	untrustedCert := newTestCert(t, "untrusted client", nil, x509.ExtKeyUsageClientAuth)
+
+	tests := []struct {
+		name       string
+		clientAuth string
+		clientCert *testCert
+		wantErr    bool
+	}{
+		{
+			name:    "required_no_cert",
+			wantErr: true,
+		},
+		{
+			name:       "required_valid_cert",
+			clientCert: clientCert,
+		},
+		{
+			name:       "required_untrusted_cert",
+			clientCert: untrustedCert,
+			wantErr:    true,
+		},
+		{
+			name:       "optional_no_cert",
+			clientAuth: clientAuthOptional,
+		},
+		{
+			name:       "optional_valid_cert",
+			clientAuth: clientAuthOptional,
+			clientCert: clientCert,
+		},
+		{
+			name:       "optional_untrusted_cert",
+			clientAuth: clientAuthOptional,
+			clientCert: untrustedCert,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				ReceiverSettings: configmodels.ReceiverSettings{
+					TypeVal:  typeStr,
+					NameVal:  typeStr,
+					Endpoint: getAvailableLoopbackAddress(t),
+				},
+				TLSCredentials: &tlsCredentials{
+					CertFile:     certFile,
+					KeyFile:      keyFile,
+					ClientCAFile: clientCAFile,
+					ClientAuth:   tt.clientAuth,
+				},
+			}
+			sink := new(exportertest.SinkTraceExporter)
+			ocr := startTestReceiver(t, cfg, sink, nil)
+			defer ocr.stop()
+
+			tlsConfig := &tls.Config{RootCAs: pool}
+			if tt.clientCert != nil {
+				// The certificate is sent even if the server doesn't list
+				// its issuer as acceptable.
+				cert := tt.clientCert.tlsCertificate(t)
+				tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+			transport := &http.Transport{TLSClientConfig: tlsConfig}
+			defer transport.CloseIdleConnections()
+
+			req, err := http.NewRequest("POST", "https://"+cfg.Endpoint+"/v1/trace", strings.NewReader(testTraceJSON))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := (&http.Client{Transport: transport}).Do(req)
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Len(t, sink.AllTraces(), 0)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Len(t, sink.AllTraces(), 1)
+		})
+	}
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opencensusreceiver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	serverCA := newTestCert(t, "server CA", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := newTestCert(t, "server 1", serverCA, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	clientCAFile, _ := newTestCert(t, "client CA 1", nil, x509.ExtKeyUsageClientAuth).write(t, dir, "client-ca")
+
+	r, err := newTLSReloader(&tlsCredentials{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCAFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, reloadCheckInterval, r.reloader.checkInterval)
+	r.reloader.checkInterval = 0
+
+	// The mtime of the files is moved forward on each change so that it
+	// differs even on file systems with a coarse resolution.
+	changes := 0
+	touch := func(files ...string) {
+		changes++
+		mtime := time.Now().Add(time.Duration(changes) * time.Minute)
+		for _, file := range files {
+			require.NoError(t, os.Chtimes(file, mtime, mtime))
+		}
+	}
+	assertConfig := func(wantServer, wantClientCA string) {
+		config, err := r.getConfigForClient(nil)
+		require.NoError(t, err)
+		require.Len(t, config.Certificates, 1)
+		cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		require.NoError(t, err)
+		assert.Equal(t, wantServer, cert.Subject.CommonName)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+		assert.Equal(t, []string{"h2", "http/1.1"}, config.NextProtos)
+		require.Len(t, config.ClientCAs.Subjects(), 1)
+		assert.Contains(t, string(config.ClientCAs.Subjects()[0]), wantClientCA)
+	}
+	assertConfig("server 1", "client CA 1")
+
+	// Rotate the server certificate.
+	newTestCert(t, "server 2", serverCA, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	touch(certFile, keyFile)
+	assertConfig("server 2", "client CA 1")
+
+	// Rotate the client CA.
+	newTestCert(t, "client CA 2", nil, x509.ExtKeyUsageClientAuth).write(t, dir, "client-ca")
+	touch(clientCAFile)
+	assertConfig("server 2", "client CA 2")
+
+	// A certificate that doesn't match its key is ignored until the key is
+	// written too.
+	next := newTestCert(t, "server 3", serverCA, x509.ExtKeyUsageServerAuth)
+	require.NoError(t, ioutil.WriteFile(certFile, next.certPEM, 0600))
+	touch(certFile)
+	assertConfig("server 2", "client CA 2")
+	require.NoError(t, ioutil.WriteFile(keyFile, next.keyPEM, 0600))
+	touch(keyFile)
+	assertConfig("server 3", "client CA 2")
+
+	// The files aren't checked again before the interval.
+	r.reloader.checkInterval = time.Hour
+	newTestCert(t, "server 4", serverCA, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	touch(certFile, keyFile)
+	assertConfig("server 3", "client CA 2")
+}
+
+func TestNewTLSReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opencensusreceiver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, _ := writeTestCertificate(t, dir)
+	clientCAFile, _ := newTestCert(t, "client CA", nil, x509.ExtKeyUsageClientAuth).write(t, dir, "client-ca")
+	emptyFile := filepath.Join(dir, "empty.pem")
+	require.NoError(t, ioutil.WriteFile(emptyFile, nil, 0600))
+
+	tests := []struct {
+		name    string
+		creds   tlsCredentials
+		want    *tls.Config
+		wantErr string
+	}{
+		{
+			name:  "server_only",
+			creds: tlsCredentials{CertFile: certFile, KeyFile: keyFile},
+			want:  &tls.Config{ClientAuth: tls.NoClientCert},
+		},
+		{
+			name: "all_settings",
+			creds: tlsCredentials{
+				CertFile:     certFile,
+				KeyFile:      keyFile,
+				ClientCAFile: clientCAFile,
+				ClientAuth:   clientAuthOptional,
+				MinVersion:   "1.2",
+				CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305"},
+			},
+			want: &tls.Config{
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+				MinVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+			},
+		},
+		{
+			name:    "unknown_client_auth",
+			creds:   tlsCredentials{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile, ClientAuth: "sometimes"},
+			wantErr: `unknown client-auth "sometimes"`,
+		},
+		{
+			name:    "client_auth_without_ca",
+			creds:   tlsCredentials{CertFile: certFile, KeyFile: keyFile, ClientAuth: clientAuthRequired},
+			wantErr: errClientAuthWithoutCA.Error(),
+		},
+		{
+			name:    "unknown_min_version",
+			creds:   tlsCredentials{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.4"},
+			wantErr: `unknown min-version "1.4"`,
+		},
+		{
+			name:    "unknown_cipher_suite",
+			creds:   tlsCredentials{CertFile: certFile, KeyFile: keyFile, CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+			wantErr: `unknown cipher suite "TLS_AES_128_GCM_SHA256"`,
+		},
+		{
+			name:    "missing_key",
+			creds:   tlsCredentials{CertFile: certFile, KeyFile: filepath.Join(dir, "missing.pem")},
+			wantErr: "missing.pem",
+		},
+		{
+			name:    "empty_client_ca",
+			creds:   tlsCredentials{CertFile: certFile, KeyFile: keyFile, ClientCAFile: emptyFile},
+			wantErr: "no certificate found in client-ca-file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newTLSReloader(&tt.creds)
+			if tt.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			config, err := r.getConfigForClient(nil)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want.ClientAuth, config.ClientAuth)
+			assert.Equal(t, tt.want.MinVersion, config.MinVersion)
+			assert.Equal(t, tt.want.CipherSuites, config.CipherSuites)
+			assert.Equal(t, tt.creds.ClientCAFile != "", config.ClientCAs != nil)
+		})
+	}
+}
+
+// testCert is a certificate and its key generated for the tests.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert returns a certificate for the loopback addresses signed by
+// parent, or a self-signed CA certificate if parent is nil.
+func newTestCert(t *testing.T, commonName string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	issuer, issuerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		issuer, issuerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// write writes the certificate and its key to dir, in name.pem and
+// name-key.pem, and returns their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, c.certPEM, 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, c.keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// writeTestCertificate writes a self-signed certificate for the loopback
+// addresses and its key to dir, and returns their paths along with a pool
+// trusting the certificate.
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	c := newTestCert(t, "opencensusreceiver test", nil, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile = c.write(t, dir, "server")
+	pool = x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return certFile, keyFile, pool
+}